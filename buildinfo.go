@@ -0,0 +1,39 @@
+//go:build go1.18
+
+package metrics
+
+import (
+	"runtime"
+	"runtime/debug"
+)
+
+// NewBuildInfo returns an Info with labels from the binary build info:
+//
+//	version     main module version, like "v1.2.3" or "(devel)"
+//	revision    VCS revision (git SHA), if built from a repo
+//	modified    "true" if the repo had uncommitted changes
+//	go_version  Go version, like "go1.21.0"
+//
+// Labels not in the build info are not set. If the binary was built without
+// module support, only go_version is set.
+func NewBuildInfo() *Info {
+	labels := map[string]string{}
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		labels["go_version"] = runtime.Version()
+		return NewInfo(labels)
+	}
+	labels["go_version"] = bi.GoVersion
+	if bi.Main.Version != "" {
+		labels["version"] = bi.Main.Version
+	}
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			labels["revision"] = s.Value
+		case "vcs.modified":
+			labels["modified"] = s.Value
+		}
+	}
+	return NewInfo(labels)
+}
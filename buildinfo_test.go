@@ -0,0 +1,17 @@
+//go:build go1.18
+
+package metrics_test
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/daniel-nichter/go-metrics"
+)
+
+func TestBuildInfo(t *testing.T) {
+	i := metrics.NewBuildInfo()
+	if got := i.Labels()["go_version"]; got != runtime.Version() {
+		t.Errorf("go_version = %q, expected %q", got, runtime.Version())
+	}
+}
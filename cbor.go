@@ -0,0 +1,481 @@
+package metrics
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"sort"
+	"time"
+)
+
+// --------------------------------------------------------------------------
+// CBOR
+// --------------------------------------------------------------------------
+
+// A Batch is encoded in CBOR (RFC 8949) as a map with the same keys as
+// EncodeMsgPack: "v", "t", and "s", and the short keys of only the non-zero
+// Snapshot fields. Times are encoded as RFC 3339 strings (tag 0) with
+// nanoseconds.
+//
+// The encoding is deterministic (RFC 8949 section 4.2.1): integers, lengths,
+// and floats use the shortest form that is exact, lengths are definite, and
+// map keys are sorted by their encoded bytes. So the same batch is always
+// encoded to the same bytes, which can be hashed or signed. Decoders skip
+// unknown keys, so new fields can be added.
+
+// ErrCBOR is returned by DecodeCBOR if the data is not a valid Batch.
+var ErrCBOR = errors.New("metrics: invalid CBOR batch")
+
+// CBOR major types
+const (
+	cborUint   = 0
+	cborNegInt = 1
+	cborBytes  = 2
+	cborText   = 3
+	cborArray  = 4
+	cborMap    = 5
+	cborTag    = 6
+	cborSimple = 7
+)
+
+// EncodeCBOR writes b to w in deterministic CBOR.
+func EncodeCBOR(w io.Writer, b Batch) error {
+	e := &cborEncoder{}
+	snapshots := make([]cborEntry, 0, len(b.Snapshots))
+	for name, s := range b.Snapshots {
+		name, s := name, s
+		snapshots = append(snapshots, cborEntry{
+			key:   func(e *cborEncoder) { e.str(name) },
+			value: func(e *cborEncoder) { e.snapshot(s) },
+		})
+	}
+	e.sortedMap([]cborEntry{
+		cborField("v", func(e *cborEncoder) { e.int(BatchVersion) }),
+		cborField("t", func(e *cborEncoder) { e.time(b.Time) }),
+		cborField("s", func(e *cborEncoder) { e.sortedMap(snapshots) }),
+	})
+	_, err := w.Write(e.buf)
+	return err
+}
+
+type cborEncoder struct {
+	buf []byte
+}
+
+// cborEntry is a map entry, encoded by the functions.
+type cborEntry struct {
+	key   func(*cborEncoder)
+	value func(*cborEncoder)
+}
+
+func cborField(key string, value func(*cborEncoder)) cborEntry {
+	return cborEntry{key: func(e *cborEncoder) { e.str(key) }, value: value}
+}
+
+// sortedMap encodes the entries sorted by the bytes of their encoded keys.
+func (e *cborEncoder) sortedMap(entries []cborEntry) {
+	type encoded struct{ key, value []byte }
+	m := make([]encoded, len(entries))
+	for i, entry := range entries {
+		k, v := &cborEncoder{}, &cborEncoder{}
+		entry.key(k)
+		entry.value(v)
+		m[i] = encoded{key: k.buf, value: v.buf}
+	}
+	sort.Slice(m, func(i, j int) bool { return bytes.Compare(m[i].key, m[j].key) < 0 })
+	e.head(cborMap, uint64(len(m)))
+	for _, entry := range m {
+		e.buf = append(e.buf, entry.key...)
+		e.buf = append(e.buf, entry.value...)
+	}
+}
+
+func (e *cborEncoder) snapshot(s Snapshot) {
+	var fields []cborEntry
+	intField := func(key string, v int64) {
+		if v != 0 {
+			fields = append(fields, cborField(key, func(e *cborEncoder) { e.int(v) }))
+		}
+	}
+	floatField := func(key string, v float64) {
+		if v != 0 {
+			fields = append(fields, cborField(key, func(e *cborEncoder) { e.float(v) }))
+		}
+	}
+	intField("n", s.N)
+	floatField("sum", s.Sum)
+	floatField("sumsq", s.SumOfSquares)
+	floatField("min", s.Min)
+	floatField("max", s.Max)
+	if s.Percentile != nil {
+		fields = append(fields, cborField("p", func(e *cborEncoder) {
+			m := make([]cborEntry, 0, len(s.Percentile))
+			for p, v := range s.Percentile {
+				p, v := p, v
+				m = append(m, cborEntry{
+					key:   func(e *cborEncoder) { e.float(p) },
+					value: func(e *cborEncoder) { e.float(v) },
+				})
+			}
+			e.sortedMap(m)
+		}))
+	}
+	floatField("last", s.Last)
+	floatField("lastd", s.LastDelta)
+	if s.Threshold != nil {
+		fields = append(fields, cborField("th", func(e *cborEncoder) {
+			m := make([]cborEntry, 0, len(s.Threshold))
+			for t, n := range s.Threshold {
+				t, n := t, n
+				m = append(m, cborEntry{
+					key:   func(e *cborEncoder) { e.float(t) },
+					value: func(e *cborEncoder) { e.int(n) },
+				})
+			}
+			e.sortedMap(m)
+		}))
+	}
+	intField("dropped", s.Dropped)
+	intField("invalid", s.Invalid)
+	intField("rejected", s.Rejected)
+	floatField("rate", s.SampleRate)
+	if s.Exemplars != nil {
+		fields = append(fields, cborField("ex", func(e *cborEncoder) {
+			e.head(cborArray, uint64(len(s.Exemplars)))
+			for _, ex := range s.Exemplars {
+				ex := ex
+				e.sortedMap([]cborEntry{
+					cborField("v", func(e *cborEncoder) { e.float(ex.Value) }),
+					cborField("l", func(e *cborEncoder) { e.str(ex.Label) }),
+					cborField("t", func(e *cborEncoder) { e.time(ex.Time) }),
+				})
+			}
+		}))
+	}
+	e.sortedMap(fields)
+}
+
+// head encodes the major type and argument in the shortest form.
+func (e *cborEncoder) head(major byte, n uint64) {
+	major <<= 5
+	switch {
+	case n < 24:
+		e.buf = append(e.buf, major|byte(n))
+	case n <= math.MaxUint8:
+		e.buf = append(e.buf, major|24, byte(n))
+	case n <= math.MaxUint16:
+		e.buf = append(e.buf, major|25, byte(n>>8), byte(n))
+	case n <= math.MaxUint32:
+		e.buf = appendUint32(append(e.buf, major|26), uint32(n))
+	default:
+		e.buf = appendUint64(append(e.buf, major|27), n)
+	}
+}
+
+func (e *cborEncoder) int(v int64) {
+	if v < 0 {
+		e.head(cborNegInt, uint64(-1-v))
+		return
+	}
+	e.head(cborUint, uint64(v))
+}
+
+func (e *cborEncoder) str(s string) {
+	e.head(cborText, uint64(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+// float encodes v as a half, single, or double float: the shortest that is
+// exact. NaN is encoded as the half 0x7e00.
+func (e *cborEncoder) float(v float64) {
+	if f := float32(v); float64(f) == v || math.IsNaN(v) {
+		if h, ok := float16Bits(f); ok {
+			e.buf = append(e.buf, cborSimple<<5|25, byte(h>>8), byte(h))
+			return
+		}
+		e.buf = appendUint32(append(e.buf, cborSimple<<5|26), math.Float32bits(f))
+		return
+	}
+	e.buf = appendUint64(append(e.buf, cborSimple<<5|27), math.Float64bits(v))
+}
+
+func (e *cborEncoder) time(t time.Time) {
+	e.head(cborTag, 0)
+	e.str(t.UTC().Format(time.RFC3339Nano))
+}
+
+// float16Bits returns the IEEE 754 half-precision bits of f if f is exactly
+// representable as a half.
+func float16Bits(f float32) (uint16, bool) {
+	bits := math.Float32bits(f)
+	sign := uint16(bits>>16) & 0x8000
+	exp := int(bits>>23&0xff) - 127
+	mant := bits & 0x7fffff
+	switch {
+	case f != f:
+		return 0x7e00, true
+	case exp == 128: // Inf
+		return sign | 0x7c00, true
+	case f == 0:
+		return sign, true
+	case exp >= -14 && exp <= 15 && mant&0x1fff == 0: // normal
+		return sign | uint16(exp+15)<<10 | uint16(mant>>13), true
+	case exp >= -24 && exp < -14: // subnormal: m * 2^-24
+		full := mant | 0x800000
+		shift := uint(-1 - exp)
+		if full&(1<<shift-1) == 0 {
+			return sign | uint16(full>>shift), true
+		}
+	}
+	return 0, false
+}
+
+// float16 returns the value of IEEE 754 half-precision bits.
+func float16(h uint16) float64 {
+	exp := int(h>>10) & 0x1f
+	mant := float64(h & 0x3ff)
+	var v float64
+	switch exp {
+	case 0:
+		v = math.Ldexp(mant, -24)
+	case 31:
+		if mant != 0 {
+			return math.NaN()
+		}
+		v = math.Inf(1)
+	default:
+		v = math.Ldexp(mant+1024, exp-25)
+	}
+	if h&0x8000 != 0 {
+		return -v
+	}
+	return v
+}
+
+// DecodeCBOR reads a Batch written by EncodeCBOR from r. If r is not an
+// io.ByteReader, it is buffered, so it can read past the end of the batch.
+// Indefinite lengths are not supported. Like DecodeMsgPack, it is safe to
+// decode untrusted data: lengths more than the bytes left return ErrCBOR if r
+// has a Len method, else io.ErrUnexpectedEOF when the data ends.
+func DecodeCBOR(r io.Reader) (Batch, error) {
+	d := &cborDecoder{newByteDecoder(r, ErrCBOR)}
+	b := d.batch()
+	return b, d.error()
+}
+
+type cborDecoder struct {
+	byteDecoder
+}
+
+func (d *cborDecoder) batch() Batch {
+	var b Batch
+	n := d.expect(cborMap)
+	for i := 0; i < n && d.err == nil; i++ {
+		switch d.str() {
+		case "v":
+			b.Version = int(d.int())
+		case "t":
+			b.Time = d.time()
+		case "s":
+			m := d.expect(cborMap)
+			b.Snapshots = make(map[string]Snapshot, prealloc(m))
+			for j := 0; j < m && d.err == nil; j++ {
+				name := d.str()
+				b.Snapshots[name] = d.snapshot()
+			}
+		default:
+			d.skip()
+		}
+	}
+	return b
+}
+
+func (d *cborDecoder) snapshot() Snapshot {
+	var s Snapshot
+	n := d.expect(cborMap)
+	for i := 0; i < n && d.err == nil; i++ {
+		switch d.str() {
+		case "n":
+			s.N = d.int()
+		case "sum":
+			s.Sum = d.float()
+		case "sumsq":
+			s.SumOfSquares = d.float()
+		case "min":
+			s.Min = d.float()
+		case "max":
+			s.Max = d.float()
+		case "p":
+			m := d.expect(cborMap)
+			s.Percentile = make(map[float64]float64, prealloc(m))
+			for j := 0; j < m && d.err == nil; j++ {
+				p := d.float()
+				s.Percentile[p] = d.float()
+			}
+		case "last":
+			s.Last = d.float()
+		case "lastd":
+			s.LastDelta = d.float()
+		case "th":
+			m := d.expect(cborMap)
+			s.Threshold = make(map[float64]int64, prealloc(m))
+			for j := 0; j < m && d.err == nil; j++ {
+				t := d.float()
+				s.Threshold[t] = d.int()
+			}
+		case "dropped":
+			s.Dropped = d.int()
+		case "invalid":
+			s.Invalid = d.int()
+		case "rejected":
+			s.Rejected = d.int()
+		case "rate":
+			s.SampleRate = d.float()
+		case "ex":
+			m := d.expect(cborArray)
+			s.Exemplars = make([]Exemplar, 0, prealloc(m))
+			for j := 0; j < m && d.err == nil; j++ {
+				var ex Exemplar
+				fields := d.expect(cborMap)
+				for k := 0; k < fields && d.err == nil; k++ {
+					switch d.str() {
+					case "v":
+						ex.Value = d.float()
+					case "l":
+						ex.Label = d.str()
+					case "t":
+						ex.Time = d.time()
+					default:
+						d.skip()
+					}
+				}
+				s.Exemplars = append(s.Exemplars, ex)
+			}
+		default:
+			d.skip()
+		}
+	}
+	return s
+}
+
+// head decodes the major type, additional info, and argument of the next item.
+// For floats (major type 7), the argument is the bits.
+func (d *cborDecoder) head() (major byte, info byte, n uint64) {
+	c := d.byte()
+	major, info = c>>5, c&0x1f
+	switch {
+	case info < 24:
+		n = uint64(info)
+	case info <= 27:
+		n = d.uint(1 << (info - 24))
+	default:
+		d.fail() // indefinite length or reserved
+	}
+	return major, info, n
+}
+
+// expect decodes the head of an item of the major type and returns its
+// argument as a length, or the tag number.
+func (d *cborDecoder) expect(major byte) int {
+	m, _, n := d.head()
+	if m != major {
+		d.fail()
+		return 0
+	}
+	return d.length(n, cborItemSize(major))
+}
+
+// cborItemSize returns the min size of each item counted by the length of
+// an item of the major type: a map has pairs, and a tag has one item.
+func cborItemSize(major byte) int {
+	if major == cborMap {
+		return 2
+	}
+	return 1
+}
+
+func (d *cborDecoder) str() string {
+	return string(d.bytes(d.expect(cborText)))
+}
+
+// number decodes any CBOR integer or float.
+func (d *cborDecoder) number() (int64, float64, bool) {
+	major, info, n := d.head()
+	switch {
+	case major == cborUint:
+		return int64(n), 0, true
+	case major == cborNegInt:
+		return -1 - int64(n), 0, true
+	case major == cborSimple && info == 25:
+		return 0, float16(uint16(n)), false
+	case major == cborSimple && info == 26:
+		return 0, float64(math.Float32frombits(uint32(n))), false
+	case major == cborSimple && info == 27:
+		return 0, math.Float64frombits(n), false
+	}
+	d.fail()
+	return 0, 0, true
+}
+
+func (d *cborDecoder) int() int64 {
+	i, f, isInt := d.number()
+	if !isInt {
+		return int64(f)
+	}
+	return i
+}
+
+func (d *cborDecoder) float() float64 {
+	i, f, isInt := d.number()
+	if isInt {
+		return float64(i)
+	}
+	return f
+}
+
+// time decodes a standard (tag 0) or epoch (tag 1) time.
+func (d *cborDecoder) time() time.Time {
+	switch d.expect(cborTag) {
+	case 0:
+		t, err := time.Parse(time.RFC3339Nano, d.str())
+		if err != nil {
+			d.fail()
+		}
+		return t.UTC()
+	case 1:
+		sec, f, isInt := d.number()
+		if !isInt {
+			sec = int64(math.Floor(f))
+			return time.Unix(sec, int64((f-float64(sec))*1e9)).UTC()
+		}
+		return time.Unix(sec, 0).UTC()
+	}
+	d.fail()
+	return time.Time{}
+}
+
+// skip skips one item of any type.
+func (d *cborDecoder) skip() {
+	defer d.unnest()
+	if !d.nest() {
+		return
+	}
+	major, _, n := d.head()
+	switch major {
+	case cborBytes, cborText:
+		d.bytes(d.length(n, 1))
+	case cborArray:
+		d.skipN(d.length(n, 1))
+	case cborMap:
+		d.skipN(2 * d.length(n, 2))
+	case cborTag:
+		d.skip()
+	}
+}
+
+func (d *cborDecoder) skipN(n int) {
+	for i := 0; i < n && d.err == nil; i++ {
+		d.skip()
+	}
+}
@@ -0,0 +1,96 @@
+package metrics
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+// --------------------------------------------------------------------------
+// CertExpiry
+// --------------------------------------------------------------------------
+
+// CertExpiry is a Metric for the number of seconds until a TLS certificate
+// expires, computed when snapshot: N = 1, and Sum, Min, Max, and Last are the
+// seconds, which are negative after the certificate expires. Use one CertExpiry
+// per certificate.
+//
+// If the certificate cannot be loaded, the snapshot is zero and Err returns the
+// error, so alert on N = 0 as well as on too few seconds.
+type CertExpiry struct {
+	load func() (*x509.Certificate, error)
+	*sync.Mutex
+	err error
+}
+
+// ErrNoCertificate is returned by CertExpiry.Err if the TLS certificate or PEM
+// file has no certificate.
+var ErrNoCertificate = errors.New("metrics: no certificate")
+
+// NewCertExpiry returns a CertExpiry for the leaf certificate of cert: its
+// Leaf, or else the first certificate in the chain.
+func NewCertExpiry(cert tls.Certificate) *CertExpiry {
+	return newCertExpiry(func() (*x509.Certificate, error) {
+		if cert.Leaf != nil {
+			return cert.Leaf, nil
+		}
+		if len(cert.Certificate) == 0 {
+			return nil, ErrNoCertificate
+		}
+		return x509.ParseCertificate(cert.Certificate[0])
+	})
+}
+
+// NewCertExpiryFile returns a CertExpiry for the first certificate in the PEM
+// file. The file is read on each snapshot, so a renewed certificate is
+// reported without restarting.
+func NewCertExpiryFile(file string) *CertExpiry {
+	return newCertExpiry(func() (*x509.Certificate, error) {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		for {
+			var block *pem.Block
+			block, data = pem.Decode(data)
+			if block == nil {
+				return nil, ErrNoCertificate
+			}
+			if block.Type == "CERTIFICATE" {
+				return x509.ParseCertificate(block.Bytes)
+			}
+		}
+	})
+}
+
+func newCertExpiry(load func() (*x509.Certificate, error)) *CertExpiry {
+	return &CertExpiry{
+		load:  load,
+		Mutex: &sync.Mutex{},
+	}
+}
+
+// Snapshot loads the certificate and returns the seconds until it expires.
+// Reset does nothing because the value is computed when snapshot.
+func (c *CertExpiry) Snapshot(reset bool) Snapshot {
+	c.Lock()
+	defer c.Unlock()
+	cert, err := c.load()
+	c.err = err
+	if err != nil {
+		return Snapshot{}
+	}
+	s := time.Until(cert.NotAfter).Seconds()
+	return Snapshot{N: 1, Sum: s, Min: s, Max: s, Last: s}
+}
+
+// Err returns the error loading the certificate for the last snapshot, if any.
+func (c *CertExpiry) Err() error {
+	c.Lock()
+	defer c.Unlock()
+	return c.err
+}
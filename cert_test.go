@@ -0,0 +1,70 @@
+package metrics_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/daniel-nichter/go-metrics"
+)
+
+// selfSignedCert returns a DER certificate that expires in d.
+func selfSignedCert(t *testing.T, d time.Duration) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(d),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func TestCertExpiry(t *testing.T) {
+	day := 24 * time.Hour
+	c := metrics.NewCertExpiry(tls.Certificate{Certificate: [][]byte{selfSignedCert(t, day)}})
+	gotSnap := c.Snapshot(true)
+	if gotSnap.N != 1 || gotSnap.Last > day.Seconds() || gotSnap.Last < day.Seconds()-60 {
+		t.Errorf("got N=%d, Last=%f; expected 1, about %f", gotSnap.N, gotSnap.Last, day.Seconds())
+	}
+
+	c = metrics.NewCertExpiry(tls.Certificate{})
+	if gotSnap := c.Snapshot(true); gotSnap.N != 0 || c.Err() != metrics.ErrNoCertificate {
+		t.Errorf("got N=%d, err %v; expected 0, ErrNoCertificate", gotSnap.N, c.Err())
+	}
+
+	// File is read on each snapshot, so renewal is reported
+	file := filepath.Join(t.TempDir(), "cert.pem")
+	c = metrics.NewCertExpiryFile(file)
+	if gotSnap := c.Snapshot(true); gotSnap.N != 0 || !os.IsNotExist(c.Err()) {
+		t.Errorf("got N=%d, err %v; expected 0, not exist", gotSnap.N, c.Err())
+	}
+	for _, d := range []time.Duration{-day, 90 * day} {
+		data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: selfSignedCert(t, d)})
+		if err := os.WriteFile(file, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		gotSnap := c.Snapshot(true)
+		if c.Err() != nil {
+			t.Fatal(c.Err())
+		}
+		if gotSnap.Last > d.Seconds() || gotSnap.Last < d.Seconds()-60 {
+			t.Errorf("got Last=%f, expected about %f", gotSnap.Last, d.Seconds())
+		}
+	}
+}
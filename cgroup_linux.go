@@ -0,0 +1,270 @@
+package metrics
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// --------------------------------------------------------------------------
+// CgroupCollector
+// --------------------------------------------------------------------------
+
+// CgroupCollector reports the cgroup (container) memory and CPU limits and
+// usage of the process, so a containerized service can report how close it
+// is to its limits, which host-level collectors miss. Call Collect every
+// interval before reporting the metrics. It supports cgroup v2 and v1.
+type CgroupCollector struct {
+	MemoryUsage *Gauge // bytes
+	MemoryLimit *Gauge // bytes, or 0 if unlimited
+	CPULimit    *Gauge // CPUs (quota / period), or 0 if unlimited
+
+	// CFS periods, throttled periods, and throttled time in microseconds.
+	// Throttled / Periods is the fraction of periods that the process used
+	// its entire CPU quota and had to wait.
+	CPUPeriods        *MonotonicCounter
+	CPUThrottled      *MonotonicCounter
+	CPUThrottledMicro *MonotonicCounter
+
+	root string
+}
+
+// ErrNoCgroup is returned by CgroupCollector.Collect if no cgroup files are
+// found, like when not running in a container on a cgroup v1 host.
+var ErrNoCgroup = errors.New("metrics: cgroup files not found")
+
+// NewCgroupCollector returns a CgroupCollector that reads cgroup files from
+// root, or /sys/fs/cgroup if root is empty.
+func NewCgroupCollector(root string) *CgroupCollector {
+	if root == "" {
+		root = "/sys/fs/cgroup"
+	}
+	return &CgroupCollector{
+		MemoryUsage:       NewGauge(Config{}),
+		MemoryLimit:       NewGauge(Config{}),
+		CPULimit:          NewGauge(Config{}),
+		CPUPeriods:        NewMonotonicCounter(0),
+		CPUThrottled:      NewMonotonicCounter(0),
+		CPUThrottledMicro: NewMonotonicCounter(0),
+		root:              root,
+	}
+}
+
+// Collect reads the cgroup files and records the values. It returns ErrNoCgroup
+// if none of the files are found, or the first error reading a file that
+// exists. Values that cannot be read are not recorded.
+func (c *CgroupCollector) Collect() error {
+	var s cgroupStats
+	var err error
+	if _, statErr := os.Stat(filepath.Join(c.root, "cgroup.controllers")); statErr == nil {
+		s, err = readCgroupV2(c.cgroupDir("", ""))
+	} else {
+		s, err = readCgroupV1(c.cgroupDir("memory", "memory"), c.cgroupDir("cpu", "cpu"))
+	}
+	if err != nil {
+		return err
+	}
+	if !s.memory && !s.cpu {
+		return ErrNoCgroup
+	}
+	if s.memory {
+		c.MemoryUsage.Record(float64(s.memoryUsage))
+		c.MemoryLimit.Record(float64(s.memoryLimit))
+	}
+	if s.cpu {
+		c.CPULimit.Record(s.cpuLimit)
+		c.CPUPeriods.Set(s.periods)
+		c.CPUThrottled.Set(s.throttled)
+		c.CPUThrottledMicro.Set(s.throttledMicro)
+	}
+	return nil
+}
+
+// cgroupDir returns the cgroup directory of the process for the v1 controller,
+// or v2 if controller is empty: root/subdir plus the path in /proc/self/cgroup.
+// In a container, the path is often not mounted (the container's cgroup is the
+// root), so root/subdir is returned if the path does not exist.
+func (c *CgroupCollector) cgroupDir(subdir, controller string) string {
+	base := filepath.Join(c.root, subdir)
+	data, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return base
+	}
+	// Lines are "hierarchy-ID:controller-list:path"; v2 is "0::path"
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		f := strings.SplitN(scanner.Text(), ":", 3)
+		if len(f) != 3 {
+			continue
+		}
+		match := controller == "" && f[0] == "0" && f[1] == ""
+		for _, ctrl := range strings.Split(f[1], ",") {
+			match = match || (controller != "" && ctrl == controller)
+		}
+		if !match {
+			continue
+		}
+		dir := filepath.Join(base, f[2])
+		if _, err := os.Stat(dir); err == nil {
+			return dir
+		}
+		break
+	}
+	return base
+}
+
+// cgroupStats are the values read from cgroup files. memory and cpu are true
+// if the memory and cpu values were read.
+type cgroupStats struct {
+	memory         bool
+	memoryUsage    uint64
+	memoryLimit    uint64
+	cpu            bool
+	cpuLimit       float64
+	periods        uint64
+	throttled      uint64
+	throttledMicro uint64
+}
+
+// unlimitedV1 is the min v1 limit treated as unlimited: v1 reports "no limit"
+// as a huge value rounded down to the page size, like 9223372036854771712.
+const unlimitedV1 = 1 << 62
+
+func readCgroupV2(dir string) (cgroupStats, error) {
+	var s cgroupStats
+	var err error
+
+	// memory.current: bytes; memory.max: bytes or "max"
+	if s.memoryUsage, err = readCgroupUint(filepath.Join(dir, "memory.current")); err == nil {
+		s.memory = true
+		limit, err := readCgroupString(filepath.Join(dir, "memory.max"))
+		if err != nil && !os.IsNotExist(err) {
+			return s, err
+		}
+		if limit != "max" && limit != "" {
+			if s.memoryLimit, err = strconv.ParseUint(limit, 10, 64); err != nil {
+				return s, err
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return s, err
+	}
+
+	// cpu.max: "quota period" or "max period"
+	if line, err := readCgroupString(filepath.Join(dir, "cpu.max")); err == nil {
+		s.cpu = true
+		f := strings.Fields(line)
+		if len(f) == 2 && f[0] != "max" {
+			quota, err := strconv.ParseFloat(f[0], 64)
+			if err != nil {
+				return s, err
+			}
+			period, err := strconv.ParseFloat(f[1], 64)
+			if err != nil {
+				return s, err
+			}
+			if period > 0 {
+				s.cpuLimit = quota / period
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return s, err
+	}
+
+	stat, err := readStatFile(filepath.Join(dir, "cpu.stat"))
+	if err != nil && !os.IsNotExist(err) {
+		return s, err
+	}
+	s.periods = stat["nr_periods"]
+	s.throttled = stat["nr_throttled"]
+	s.throttledMicro = stat["throttled_usec"]
+	return s, nil
+}
+
+func readCgroupV1(memoryDir, cpuDir string) (cgroupStats, error) {
+	var s cgroupStats
+	var err error
+
+	if s.memoryUsage, err = readCgroupUint(filepath.Join(memoryDir, "memory.usage_in_bytes")); err == nil {
+		s.memory = true
+		limit, err := readCgroupUint(filepath.Join(memoryDir, "memory.limit_in_bytes"))
+		if err != nil && !os.IsNotExist(err) {
+			return s, err
+		}
+		if limit < unlimitedV1 {
+			s.memoryLimit = limit
+		}
+	} else if !os.IsNotExist(err) {
+		return s, err
+	}
+
+	// cpu.cfs_quota_us is -1 if unlimited
+	if quota, err := readCgroupString(filepath.Join(cpuDir, "cpu.cfs_quota_us")); err == nil {
+		s.cpu = true
+		if quota != "-1" {
+			q, err := strconv.ParseFloat(quota, 64)
+			if err != nil {
+				return s, err
+			}
+			period, err := readCgroupUint(filepath.Join(cpuDir, "cpu.cfs_period_us"))
+			if err != nil {
+				return s, err
+			}
+			if period > 0 {
+				s.cpuLimit = q / float64(period)
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return s, err
+	}
+
+	stat, err := readStatFile(filepath.Join(cpuDir, "cpu.stat"))
+	if err != nil && !os.IsNotExist(err) {
+		return s, err
+	}
+	s.periods = stat["nr_periods"]
+	s.throttled = stat["nr_throttled"]
+	s.throttledMicro = stat["throttled_time"] / 1000 // ns
+	return s, nil
+}
+
+func readCgroupString(file string) (string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func readCgroupUint(file string) (uint64, error) {
+	s, err := readCgroupString(file)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(s, 10, 64)
+}
+
+// readStatFile reads a file of "key value" or "key: value" lines, like
+// cpu.stat and /proc/self/io.
+func readStatFile(file string) (map[string]uint64, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	stat := map[string]uint64{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		f := strings.Fields(scanner.Text())
+		if len(f) != 2 {
+			continue
+		}
+		if v, err := strconv.ParseUint(f[1], 10, 64); err == nil {
+			stat[strings.TrimSuffix(f[0], ":")] = v
+		}
+	}
+	return stat, nil
+}
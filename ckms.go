@@ -0,0 +1,234 @@
+package metrics
+
+import (
+	"math"
+	"sort"
+)
+
+// --------------------------------------------------------------------------
+// CKMS targeted quantiles: Cormode, Korn, Muthukrishnan, and Srivastava,
+// "Effective Computation of Biased Quantiles over Data Streams" (ICDE 2005).
+// http://www.cs.rutgers.edu/~muthu/bquant.pdf
+// --------------------------------------------------------------------------
+
+const ckmsBufferSize = 128
+
+type ckmsTarget struct {
+	p   float64
+	eps float64
+}
+
+type ckmsItem struct {
+	v     float64
+	g     float64 // rank difference from previous item
+	delta float64 // max rank error
+}
+
+type ckmsStream struct {
+	targets []ckmsTarget
+	n       int64
+	sum     float64
+	sumSq   float64
+	min     float64
+	max     float64
+	buf     []float64
+	items   []ckmsItem
+	m       float64 // number of values merged into items
+}
+
+func newCKMSStream(percentiles []float64, targetErrors map[float64]float64) *ckmsStream {
+	s := &ckmsStream{
+		buf: make([]float64, 0, ckmsBufferSize),
+	}
+	for _, p := range percentiles {
+		if p <= 0 || p >= 1 {
+			continue // min and max are exact
+		}
+		eps, ok := targetErrors[p]
+		if !ok || eps <= 0 {
+			eps = math.Min(p, 1-p) / 10
+		}
+		s.targets = append(s.targets, ckmsTarget{p: p, eps: eps})
+	}
+	return s
+}
+
+func (s *ckmsStream) record(v float64) {
+	if s.n == 0 || v < s.min {
+		s.min = v
+	}
+	if s.n == 0 || v > s.max {
+		s.max = v
+	}
+	s.n++
+	s.sum += v
+	s.sumSq += v * v
+	if len(s.targets) == 0 {
+		return // no percentiles, or only min and max
+	}
+	s.buf = append(s.buf, v)
+	if len(s.buf) == cap(s.buf) {
+		s.flush()
+	}
+}
+
+func (s *ckmsStream) reset() {
+	s.n = 0
+	s.sum = 0
+	s.sumSq = 0
+	s.min = 0
+	s.max = 0
+	s.buf = s.buf[:0]
+	s.items = nil
+	s.m = 0
+}
+
+func (s *ckmsStream) take() sample {
+	t := *s
+	s.buf = make([]float64, 0, ckmsBufferSize) // t has the old buffer
+	s.reset()
+	return &t
+}
+
+func (s *ckmsStream) snapshot(snapshot *Snapshot, p []float64, scores map[float64]float64, reset bool) {
+	if s.n == 0 {
+		return // reset then called again without any new values
+	}
+	s.flush()
+	snapshot.N = s.n
+	snapshot.Sum = s.sum
+	snapshot.SumOfSquares = s.sumSq
+	snapshot.Min = s.min
+	snapshot.Max = s.max
+	scores = resetScores(scores, p)
+	for _, q := range p {
+		switch {
+		case q <= 0:
+			scores[q] = s.min
+		case q >= 1:
+			scores[q] = s.max
+		default:
+			scores[q] = s.query(q)
+		}
+	}
+	snapshot.Percentile = scores
+	if reset {
+		s.reset()
+	}
+}
+
+// invariant returns the max allowed g+delta for an item at rank r such that
+// every target percentile is within its error.
+func (s *ckmsStream) invariant(r float64) float64 {
+	f := math.MaxFloat64
+	for _, t := range s.targets {
+		var ft float64
+		if t.p*s.m <= r {
+			ft = 2 * t.eps * r / t.p
+		} else {
+			ft = 2 * t.eps * (s.m - r) / (1 - t.p)
+		}
+		if ft < f {
+			f = ft
+		}
+	}
+	return f
+}
+
+// flush merges the sorted buffer into items, then compresses items.
+func (s *ckmsStream) flush() {
+	if len(s.buf) == 0 {
+		return
+	}
+	sort.Float64s(s.buf)
+	var r float64
+	i := 0
+	for _, v := range s.buf {
+		for ; i < len(s.items) && s.items[i].v <= v; i++ {
+			r += s.items[i].g
+		}
+		delta := 0.0
+		if i > 0 && i < len(s.items) {
+			delta = math.Max(0, math.Floor(s.invariant(r))-1)
+		}
+		s.items = append(s.items, ckmsItem{})
+		copy(s.items[i+1:], s.items[i:])
+		s.items[i] = ckmsItem{v: v, g: 1, delta: delta}
+		s.m++
+		r++
+		i++
+	}
+	s.buf = s.buf[:0]
+	s.compress()
+}
+
+func (s *ckmsStream) compress() {
+	if len(s.items) < 2 {
+		return
+	}
+	x := s.items[len(s.items)-1]
+	xi := len(s.items) - 1
+	r := s.m - 1 - x.g
+	for i := len(s.items) - 2; i >= 0; i-- {
+		c := s.items[i]
+		if c.g+x.g+x.delta <= s.invariant(r) {
+			x.g += c.g
+			s.items[xi] = x
+			s.items = append(s.items[:i], s.items[i+1:]...)
+			xi--
+		} else {
+			x = c
+			xi = i
+		}
+		r -= c.g
+	}
+}
+
+func (s *ckmsStream) query(q float64) float64 {
+	t := math.Ceil(q * s.m)
+	t += s.invariant(t) / 2
+	prev := s.items[0]
+	var r float64
+	for _, c := range s.items[1:] {
+		r += prev.g
+		if r+c.g+c.delta > t {
+			return prev.v
+		}
+		prev = c
+	}
+	return prev.v
+}
+
+// ckmsQuantiles is a copy of a ckmsStream for View. Percentiles other than
+// the targets can be queried, but their error is not bounded.
+type ckmsQuantiles struct {
+	s ckmsStream
+}
+
+func (s *ckmsStream) quantiles() quantiles {
+	s.flush()
+	return &ckmsQuantiles{s: ckmsStream{
+		targets: s.targets,
+		n:       s.n,
+		min:     s.min,
+		max:     s.max,
+		items:   append([]ckmsItem(nil), s.items...),
+		m:       s.m,
+	}}
+}
+
+func (q *ckmsQuantiles) sort() {} // items are sorted
+
+func (q *ckmsQuantiles) quantile(p float64) float64 {
+	switch {
+	case q.s.n == 0:
+		return 0
+	case p <= 0:
+		return q.s.min
+	case p >= 1:
+		return q.s.max
+	case len(q.s.items) == 0:
+		return 0 // no targets
+	}
+	return q.s.query(p)
+}
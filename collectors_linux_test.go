@@ -0,0 +1,159 @@
+package metrics_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/daniel-nichter/go-metrics"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		file := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCgroupCollectorV2(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		"cgroup.controllers": "cpu memory\n",
+		"memory.current":     "104857600\n",
+		"memory.max":         "209715200\n",
+		"cpu.max":            "150000 100000\n",
+		"cpu.stat":           "usage_usec 1000\nnr_periods 10\nnr_throttled 2\nthrottled_usec 5000\n",
+	})
+	c := metrics.NewCgroupCollector(root)
+	if err := c.Collect(); err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, root, map[string]string{
+		"cpu.stat": "usage_usec 2000\nnr_periods 30\nnr_throttled 7\nthrottled_usec 8000\n",
+	})
+	if err := c.Collect(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := c.MemoryUsage.Last(); got != 104857600 {
+		t.Errorf("MemoryUsage %f, expected 104857600", got)
+	}
+	if got := c.MemoryLimit.Last(); got != 209715200 {
+		t.Errorf("MemoryLimit %f, expected 209715200", got)
+	}
+	if got := c.CPULimit.Last(); got != 1.5 {
+		t.Errorf("CPULimit %f, expected 1.5", got)
+	}
+	// Deltas since first Collect
+	if got := c.CPUPeriods.Count(); got != 20 {
+		t.Errorf("CPUPeriods %d, expected 20", got)
+	}
+	if got := c.CPUThrottled.Count(); got != 5 {
+		t.Errorf("CPUThrottled %d, expected 5", got)
+	}
+	if got := c.CPUThrottledMicro.Count(); got != 3000 {
+		t.Errorf("CPUThrottledMicro %d, expected 3000", got)
+	}
+
+	// Unlimited
+	writeFiles(t, root, map[string]string{
+		"memory.max": "max\n",
+		"cpu.max":    "max 100000\n",
+	})
+	if err := c.Collect(); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.MemoryLimit.Last(); got != 0 {
+		t.Errorf("MemoryLimit %f, expected 0", got)
+	}
+	if got := c.CPULimit.Last(); got != 0 {
+		t.Errorf("CPULimit %f, expected 0", got)
+	}
+}
+
+func TestCgroupCollectorV1(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		"memory/memory.usage_in_bytes": "1048576\n",
+		"memory/memory.limit_in_bytes": "9223372036854771712\n", // unlimited
+		"cpu/cpu.cfs_quota_us":         "50000\n",
+		"cpu/cpu.cfs_period_us":        "100000\n",
+		"cpu/cpu.stat":                 "nr_periods 10\nnr_throttled 1\nthrottled_time 2000000\n",
+	})
+	c := metrics.NewCgroupCollector(root)
+	if err := c.Collect(); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.MemoryUsage.Last(); got != 1048576 {
+		t.Errorf("MemoryUsage %f, expected 1048576", got)
+	}
+	if got := c.MemoryLimit.Last(); got != 0 {
+		t.Errorf("MemoryLimit %f, expected 0", got)
+	}
+	if got := c.CPULimit.Last(); got != 0.5 {
+		t.Errorf("CPULimit %f, expected 0.5", got)
+	}
+
+	if err := metrics.NewCgroupCollector(t.TempDir()).Collect(); err != metrics.ErrNoCgroup {
+		t.Errorf("got error %v, expected ErrNoCgroup", err)
+	}
+}
+
+func TestIOCollector(t *testing.T) {
+	proc := t.TempDir()
+	writeFiles(t, proc, map[string]string{
+		"123/io": "rchar: 1000\nwchar: 2000\nsyscr: 10\nsyscw: 20\nread_bytes: 4096\nwrite_bytes: 8192\ncancelled_write_bytes: 0\n",
+	})
+	fdDir := filepath.Join(proc, "123", "fd")
+	if err := os.MkdirAll(fdDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for fd, target := range map[string]string{"0": "/dev/null", "3": "socket:[1]", "4": "socket:[2]", "5": "pipe:[3]"} {
+		if err := os.Symlink(target, filepath.Join(fdDir, fd)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := metrics.NewIOCollectorAt(proc, 123)
+	if err := c.Collect(); err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, proc, map[string]string{
+		"123/io": "rchar: 1500\nwchar: 2500\nsyscr: 15\nsyscw: 22\nread_bytes: 12288\nwrite_bytes: 8192\ncancelled_write_bytes: 0\n",
+	})
+	if err := c.Collect(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Deltas since first Collect
+	got := map[string]int64{
+		"ReadBytes":  c.ReadBytes.Count(),
+		"WriteBytes": c.WriteBytes.Count(),
+		"ReadOps":    c.ReadOps.Count(),
+		"WriteOps":   c.WriteOps.Count(),
+		"Sockets":    int64(c.Sockets.Last()),
+	}
+	expect := map[string]int64{
+		"ReadBytes":  8192,
+		"WriteBytes": 0,
+		"ReadOps":    5,
+		"WriteOps":   2,
+		"Sockets":    2,
+	}
+	for k, v := range expect {
+		if got[k] != v {
+			t.Errorf("%s = %d, expected %d", k, got[k], v)
+		}
+	}
+
+	// Real process
+	if err := metrics.NewIOCollector(0).Collect(); err != nil && !os.IsPermission(err) {
+		t.Error(err)
+	}
+}
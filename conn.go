@@ -0,0 +1,170 @@
+package metrics
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// --------------------------------------------------------------------------
+// ConnMetrics
+// --------------------------------------------------------------------------
+
+// ConnMetrics are transport-level metrics for network connections. Wrap a
+// net.Listener with Listener, or a dialed net.Conn with Conn, and the metrics
+// are recorded by the wrapped connections. Nil metrics are not recorded, so
+// callers can supply only the metrics they need.
+type ConnMetrics struct {
+	Accepted     *Counter     // connections accepted by Listener
+	Closed       *Counter     // connections closed
+	Open         *Concurrency // connections open now (Last) and peak (Max)
+	BytesRead    *Counter
+	BytesWritten *Counter
+	Lifetime     *Histogram // seconds from accept (or Conn) to Close
+}
+
+// NewConnMetrics returns ConnMetrics with all metrics. The Lifetime histogram
+// is configured by cfg.
+func NewConnMetrics(cfg Config) *ConnMetrics {
+	return &ConnMetrics{
+		Accepted:     NewCounter(),
+		Closed:       NewCounter(),
+		Open:         NewConcurrency(),
+		BytesRead:    NewCounter(),
+		BytesWritten: NewCounter(),
+		Lifetime:     NewHistogram(cfg),
+	}
+}
+
+// Listener returns l wrapped to record the metrics of accepted connections.
+func (m *ConnMetrics) Listener(l net.Listener) net.Listener {
+	return &listener{Listener: l, m: m}
+}
+
+// Conn returns c wrapped to record its metrics. Use it for dialed connections;
+// connections accepted by a Listener from this ConnMetrics are already wrapped.
+// The wrapped connection implements io.ReaderFrom, so a *net.TCPConn keeps its
+// sendfile and splice fast path, and CloseWrite and CloseRead if c does.
+func (m *ConnMetrics) Conn(c net.Conn) net.Conn {
+	if m.Open != nil {
+		m.Open.Start()
+	}
+	wc := &conn{Conn: c, m: m, start: time.Now()}
+	switch c.(type) {
+	case halfCloser:
+		return &halfCloseConn{wc}
+	case closeWriter:
+		return &closeWriteConn{wc}
+	}
+	return wc
+}
+
+type listener struct {
+	net.Listener
+	m *ConnMetrics
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if l.m.Accepted != nil {
+		l.m.Accepted.Add(1)
+	}
+	return l.m.Conn(c), nil
+}
+
+type conn struct {
+	net.Conn
+	m      *ConnMetrics
+	start  time.Time
+	closed sync.Once
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 && c.m.BytesRead != nil {
+		c.m.BytesRead.Add(int64(n))
+	}
+	return n, err
+}
+
+func (c *conn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 && c.m.BytesWritten != nil {
+		c.m.BytesWritten.Add(int64(n))
+	}
+	return n, err
+}
+
+// ReadFrom writes the data read from r to the connection with the ReadFrom of
+// the connection, if it has one, like *net.TCPConn.
+func (c *conn) ReadFrom(r io.Reader) (int64, error) {
+	var n int64
+	var err error
+	if rf, ok := c.Conn.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(r)
+	} else {
+		n, err = io.Copy(c.Conn, r)
+	}
+	if n > 0 && c.m.BytesWritten != nil {
+		c.m.BytesWritten.Add(n)
+	}
+	return n, err
+}
+
+// Close closes the connection. The metrics are recorded only on the first
+// call, so closing twice does not count twice.
+func (c *conn) Close() error {
+	err := c.Conn.Close()
+	c.closed.Do(func() {
+		if c.m.Closed != nil {
+			c.m.Closed.Add(1)
+		}
+		if c.m.Open != nil {
+			c.m.Open.Done()
+		}
+		if c.m.Lifetime != nil {
+			c.m.Lifetime.Record(time.Since(c.start).Seconds())
+		}
+	})
+	return err
+}
+
+// closeWriter is implemented by connections that can be half-closed for
+// writing, like *tls.Conn.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// halfCloser is implemented by connections that can be half-closed for reading
+// and writing, like *net.TCPConn and *net.UnixConn.
+type halfCloser interface {
+	closeWriter
+	CloseRead() error
+}
+
+// closeWriteConn is a conn that implements closeWriter, so the wrapper does not
+// hide it. Half-closing does not record the metrics; Close does.
+type closeWriteConn struct {
+	*conn
+}
+
+func (c *closeWriteConn) CloseWrite() error {
+	return c.Conn.(closeWriter).CloseWrite()
+}
+
+// halfCloseConn is a conn that implements halfCloser, like closeWriteConn.
+type halfCloseConn struct {
+	*conn
+}
+
+func (c *halfCloseConn) CloseWrite() error {
+	return c.Conn.(closeWriter).CloseWrite()
+}
+
+func (c *halfCloseConn) CloseRead() error {
+	return c.Conn.(halfCloser).CloseRead()
+}
@@ -0,0 +1,67 @@
+package metrics
+
+import (
+	"io"
+	"time"
+)
+
+// --------------------------------------------------------------------------
+// CountingReader and CountingWriter
+// --------------------------------------------------------------------------
+
+// CountingReader is an io.Reader that counts the bytes read and records the
+// latency of each Read call, in seconds, like for file transfers, proxies,
+// and backups. Nil metrics are not recorded.
+type CountingReader struct {
+	r       io.Reader
+	bytes   *Counter
+	latency *Histogram
+}
+
+func NewCountingReader(r io.Reader, bytes *Counter, latency *Histogram) *CountingReader {
+	return &CountingReader{
+		r:       r,
+		bytes:   bytes,
+		latency: latency,
+	}
+}
+
+func (r *CountingReader) Read(p []byte) (int, error) {
+	t0 := time.Now()
+	n, err := r.r.Read(p)
+	if r.latency != nil {
+		r.latency.Record(time.Since(t0).Seconds())
+	}
+	if n > 0 && r.bytes != nil {
+		r.bytes.Add(int64(n))
+	}
+	return n, err
+}
+
+// CountingWriter is an io.Writer that counts the bytes written and records the
+// latency of each Write call, in seconds. Nil metrics are not recorded.
+type CountingWriter struct {
+	w       io.Writer
+	bytes   *Counter
+	latency *Histogram
+}
+
+func NewCountingWriter(w io.Writer, bytes *Counter, latency *Histogram) *CountingWriter {
+	return &CountingWriter{
+		w:       w,
+		bytes:   bytes,
+		latency: latency,
+	}
+}
+
+func (w *CountingWriter) Write(p []byte) (int, error) {
+	t0 := time.Now()
+	n, err := w.w.Write(p)
+	if w.latency != nil {
+		w.latency.Record(time.Since(t0).Seconds())
+	}
+	if n > 0 && w.bytes != nil {
+		w.bytes.Add(int64(n))
+	}
+	return n, err
+}
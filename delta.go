@@ -0,0 +1,113 @@
+package metrics
+
+import (
+	"math"
+	"sync"
+)
+
+// Delta returns the interval snapshot between two cumulative snapshots, prev
+// and cur, of the same metric: the difference of N, Sum, SumOfSquares, and
+// each Threshold count. This is useful to wrap third-party libraries that only
+// expose running totals: record the totals as snapshots that are never reset,
+// then report the deltas.
+//
+// If cur.N is less than prev.N, the source restarted (the cumulative count
+// dropped), so cur is returned as the delta since the restart. Sum is not
+// checked because it decreases with negative values, like Counter.Add(-3),
+// unless N is zero in both, like totals recorded only as Sum.
+//
+// Min, Max, Percentile, and Last cannot be derived from cumulative values,
+// so they are copied from cur.
+func Delta(prev, cur Snapshot) Snapshot {
+	if cur.N < prev.N || (cur.N == 0 && prev.N == 0 && cur.Sum < prev.Sum) {
+		return cur // restarted
+	}
+	delta := cur
+	delta.N -= prev.N
+	delta.Sum -= prev.Sum
+	delta.SumOfSquares -= prev.SumOfSquares
+	if cur.Threshold != nil {
+		delta.Threshold = make(map[float64]int64, len(cur.Threshold))
+		for t, n := range cur.Threshold {
+			delta.Threshold[t] = n - prev.Threshold[t]
+		}
+	}
+	return delta
+}
+
+// DeltaStream converts a stream of cumulative snapshots into interval deltas.
+// The first snapshot is the baseline; each subsequent call to Next returns
+// the Delta from the previous snapshot.
+type DeltaStream struct {
+	*sync.Mutex
+	prev   Snapshot
+	primed bool
+}
+
+func NewDeltaStream() *DeltaStream {
+	return &DeltaStream{
+		Mutex: &sync.Mutex{},
+	}
+}
+
+// Next returns the Delta between the previous snapshot and cur. It returns
+// false for the first snapshot, which is the baseline.
+func (d *DeltaStream) Next(cur Snapshot) (Snapshot, bool) {
+	d.Lock()
+	defer d.Unlock()
+	prev, primed := d.prev, d.primed
+	d.prev, d.primed = cur, true
+	if !primed {
+		return Snapshot{}, false
+	}
+	return Delta(prev, cur), true
+}
+
+// Change is the interval-over-interval change of a counter: Sum of the current
+// interval snapshot compared to Sum of the previous interval snapshot.
+type Change struct {
+	Prev     float64
+	Cur      float64
+	Absolute float64 // Cur - Prev
+	Relative float64 // (Cur - Prev) / Prev, like -0.5 if Cur dropped by half
+}
+
+// ChangeStream computes the Change of a counter between consecutive interval
+// snapshots (taken with reset), so alerts like "traffic dropped 50% since the
+// last interval" can be computed at the source. If Prev is zero, Relative is
+// zero if Cur is also zero, else +Inf.
+type ChangeStream struct {
+	*sync.Mutex
+	prev   float64
+	primed bool
+}
+
+func NewChangeStream() *ChangeStream {
+	return &ChangeStream{
+		Mutex: &sync.Mutex{},
+	}
+}
+
+// Next returns the Change from the previous snapshot to cur. It returns false
+// for the first snapshot, which has no previous interval.
+func (c *ChangeStream) Next(cur Snapshot) (Change, bool) {
+	c.Lock()
+	defer c.Unlock()
+	prev, primed := c.prev, c.primed
+	c.prev, c.primed = cur.Sum, true
+	if !primed {
+		return Change{}, false
+	}
+	change := Change{
+		Prev:     prev,
+		Cur:      cur.Sum,
+		Absolute: cur.Sum - prev,
+	}
+	switch {
+	case prev != 0:
+		change.Relative = change.Absolute / prev
+	case cur.Sum != 0:
+		change.Relative = math.Inf(1)
+	}
+	return change, true
+}
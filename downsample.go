@@ -0,0 +1,146 @@
+package metrics
+
+import (
+	"math"
+	"math/rand"
+	"sync/atomic"
+)
+
+// --------------------------------------------------------------------------
+// Downsampling
+// --------------------------------------------------------------------------
+
+// downsampler decides which values Histogram.Record locks and records, for
+// Config.RecordEvery, RecordProbability, or RecordTarget. With RecordEvery,
+// values not recorded are counted atomically, so N, Sum, and SumOfSquares are
+// still exact. Else, values are recorded with a probability, values not
+// recorded are not counted, and snapshot counts are scaled by 1/p instead.
+type downsampler struct {
+	every int64
+	calls int64 // atomic
+
+	// Probability of recording a value if every is zero. With RecordTarget,
+	// it changes every reset.
+	prob   uint64  // math.Float64bits, atomic
+	target float64 // RecordTarget
+
+	// Values not recorded, atomic
+	n     int64
+	sum   uint64 // math.Float64bits
+	sumSq uint64 // math.Float64bits
+}
+
+// newDownsampler returns a downsampler for cfg, or nil if all values are
+// recorded.
+func newDownsampler(cfg Config) *downsampler {
+	if cfg.RecordEvery > 1 {
+		return &downsampler{every: int64(cfg.RecordEvery)}
+	}
+	if cfg.RecordProbability > 0 && cfg.RecordProbability < 1 {
+		return &downsampler{prob: math.Float64bits(cfg.RecordProbability)}
+	}
+	if cfg.RecordTarget > 0 {
+		return &downsampler{prob: math.Float64bits(1), target: float64(cfg.RecordTarget)}
+	}
+	return nil
+}
+
+// skip returns true if v is not recorded, after counting it.
+func (d *downsampler) skip(v float64) bool {
+	if d.every == 0 {
+		p := math.Float64frombits(atomic.LoadUint64(&d.prob))
+		return p < 1 && rand.Float64() >= p
+	}
+	if atomic.AddInt64(&d.calls, 1)%d.every == 0 {
+		return false
+	}
+	atomic.AddInt64(&d.n, 1)
+	addFloat64(&d.sum, v)
+	addFloat64(&d.sumSq, v*v)
+	return true
+}
+
+// adapt sets the probability for the next interval so that about target
+// values are recorded if it has as many values as the last interval, which
+// had n values (estimated). It does nothing without RecordTarget.
+func (d *downsampler) adapt(n int64) {
+	if d == nil || d.target == 0 {
+		return
+	}
+	p := 1.0
+	if float64(n) > d.target {
+		p = d.target / float64(n)
+	}
+	atomic.StoreUint64(&d.prob, math.Float64bits(p))
+}
+
+// skipped are the counts of values not recorded, added to a snapshot, and the
+// factor to scale the counts of the values recorded.
+type skipped struct {
+	n          int64
+	sum, sumSq float64
+	scale      float64 // 1/p, or zero if not scaled
+	rate       float64 // Snapshot.SampleRate
+}
+
+// take returns the counts of values not recorded, and resets them if reset is
+// true. It is safe to call on a nil downsampler.
+func (d *downsampler) take(reset bool) skipped {
+	if d == nil {
+		return skipped{}
+	}
+	if d.every == 0 {
+		p := math.Float64frombits(atomic.LoadUint64(&d.prob))
+		return skipped{scale: 1 / p, rate: p}
+	}
+	if reset {
+		return skipped{
+			n:     atomic.SwapInt64(&d.n, 0),
+			sum:   math.Float64frombits(atomic.SwapUint64(&d.sum, 0)),
+			sumSq: math.Float64frombits(atomic.SwapUint64(&d.sumSq, 0)),
+			rate:  1 / float64(d.every),
+		}
+	}
+	return skipped{
+		n:     atomic.LoadInt64(&d.n),
+		sum:   math.Float64frombits(atomic.LoadUint64(&d.sum)),
+		sumSq: math.Float64frombits(atomic.LoadUint64(&d.sumSq)),
+		rate:  1 / float64(d.every),
+	}
+}
+
+// add adds the values not recorded to the snapshot of the values recorded.
+// If scaled, the counts, Sum, and SumOfSquares are estimates of all values
+// (Horvitz-Thompson): each value recorded stands for 1/p values. Mean and
+// Variance are ratios of these, so they are not changed by the scaling.
+// Else, N, Sum, and SumOfSquares are exact, and Threshold counts are scaled
+// by all values / values recorded, so Over (N - Under) is not inflated by
+// the values not recorded.
+func (s skipped) add(snapshot *Snapshot) {
+	snapshot.SampleRate = s.rate
+	if s.scale > 0 {
+		count := func(n int64) int64 { return int64(math.Round(float64(n) * s.scale)) }
+		snapshot.N = count(snapshot.N)
+		snapshot.Sum *= s.scale
+		snapshot.SumOfSquares *= s.scale
+		for t, n := range snapshot.Threshold {
+			snapshot.Threshold[t] = count(n)
+		}
+		snapshot.Dropped = count(snapshot.Dropped)
+		snapshot.Invalid = count(snapshot.Invalid)
+		snapshot.Rejected = count(snapshot.Rejected)
+		return
+	}
+	if s.n == 0 {
+		return
+	}
+	if recorded := snapshot.N; recorded > 0 {
+		scale := float64(recorded+s.n) / float64(recorded)
+		for t, n := range snapshot.Threshold {
+			snapshot.Threshold[t] = int64(math.Round(float64(n) * scale))
+		}
+	}
+	snapshot.N += s.n
+	snapshot.Sum += s.sum
+	snapshot.SumOfSquares += s.sumSq
+}
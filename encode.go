@@ -0,0 +1,230 @@
+package metrics
+
+import (
+	"bufio"
+	"encoding/gob"
+	"io"
+	"math"
+	"time"
+)
+
+// --------------------------------------------------------------------------
+// Encoding
+// --------------------------------------------------------------------------
+
+// Batch is a set of named snapshots taken at the same time, like every metric
+// of a program at the end of an interval. It is the unit of serialization for
+// transports between programs. Names are chosen by the caller.
+type Batch struct {
+	// Version is the schema version of the encoded batch. The encoders in
+	// this package set it to BatchVersion. A decoded batch has the version
+	// it was encoded with, or 0 if it was encoded before versions.
+	Version int
+
+	Time      time.Time
+	Snapshots map[string]Snapshot
+}
+
+// BatchVersion is the schema version of Batch and Snapshot. It is incremented
+// when fields are added. Fields are never removed or changed, and decoders of
+// every encoding skip unknown fields, so programs with different versions can
+// exchange batches, like during a rolling upgrade: a decoder returns the
+// fields it knows, and the rest are zero.
+//
+//	1: initial version
+//	2: Snapshot.SampleRate
+const BatchVersion = 2
+
+func init() {
+	// Register the types so they can be sent as interface values, like
+	// net/rpc arguments
+	gob.Register(Snapshot{})
+	gob.Register(Batch{})
+}
+
+// EncodeGob writes b to w with encoding/gob. Each call writes a new gob stream
+// with the type information, for one batch per stream, like a file. To send
+// many batches on one stream, use a GobEncoder.
+func EncodeGob(w io.Writer, b Batch) error {
+	return NewGobEncoder(w).Encode(b)
+}
+
+// DecodeGob reads a Batch written by EncodeGob from r. Each call reads a new
+// gob stream, and if r is not an io.ByteReader, it is buffered, so it can read
+// past the end of the batch. Call it once per stream; to receive many batches
+// on one stream, use a GobDecoder.
+func DecodeGob(r io.Reader) (Batch, error) {
+	return NewGobDecoder(r).Decode()
+}
+
+// GobEncoder writes batches to one gob stream, like a net/rpc connection or a
+// pipe between programs. The type information is written once, before the
+// first batch, so the stream must be read by one GobDecoder.
+type GobEncoder struct {
+	enc *gob.Encoder
+}
+
+func NewGobEncoder(w io.Writer) *GobEncoder {
+	return &GobEncoder{enc: gob.NewEncoder(w)}
+}
+
+// Encode writes b with Version set to BatchVersion.
+func (e *GobEncoder) Encode(b Batch) error {
+	b.Version = BatchVersion
+	return e.enc.Encode(b)
+}
+
+// GobDecoder reads batches written by a GobEncoder from one gob stream.
+type GobDecoder struct {
+	dec *gob.Decoder
+}
+
+func NewGobDecoder(r io.Reader) *GobDecoder {
+	return &GobDecoder{dec: gob.NewDecoder(r)}
+}
+
+// Decode reads the next batch. It returns io.EOF if the stream ends before a
+// batch.
+func (d *GobDecoder) Decode() (Batch, error) {
+	var b Batch
+	err := d.dec.Decode(&b)
+	return b, err
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	return appendUint32(appendUint32(b, uint32(v>>32)), uint32(v))
+}
+
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// Limits for decoding untrusted data. Lengths are read from the data, so
+// a few corrupt bytes can claim billions of items: decoders allocate at most
+// maxPrealloc items or bytes before reading them, and skip unknown items
+// nested at most maxDepth deep.
+const (
+	maxPrealloc = 4096
+	maxDepth    = 64
+)
+
+// byteDecoder reads the bytes of a binary encoding until the first error,
+// which is kept in err. After an error, values are zero, so decoders check
+// err only at the end. invalid is the error for data that is not valid.
+type byteDecoder struct {
+	r       byteReader
+	left    func() int // bytes left in r, or nil if not known
+	err     error
+	invalid error
+	depth   int // of items being skipped
+}
+
+func newByteDecoder(r io.Reader, invalid error) byteDecoder {
+	d := byteDecoder{invalid: invalid}
+	br, ok := r.(byteReader)
+	if !ok {
+		br = bufio.NewReader(r)
+	} else if l, ok := r.(interface{ Len() int }); ok {
+		d.left = l.Len // like bytes.Reader and bytes.Buffer
+	}
+	d.r = br
+	return d
+}
+
+func (d *byteDecoder) byte() byte {
+	if d.err != nil {
+		return 0
+	}
+	c, err := d.r.ReadByte()
+	if err != nil {
+		d.err = err
+	}
+	return c
+}
+
+// bytes reads n bytes, at most maxPrealloc at a time, so a corrupt length
+// allocates no more than the data read before it ends.
+func (d *byteDecoder) bytes(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	b := make([]byte, 0, prealloc(n))
+	for len(b) < n {
+		start := len(b)
+		b = append(b, make([]byte, prealloc(n-start))...)
+		if _, err := io.ReadFull(d.r, b[start:]); err != nil {
+			d.err = err
+			return nil
+		}
+	}
+	return b
+}
+
+// uint reads an n-byte big-endian unsigned integer.
+func (d *byteDecoder) uint(n int) uint64 {
+	b := d.bytes(n)
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+// length returns n, a length read from the data, of items encoded in at
+// least size bytes each. It fails if n is more than math.MaxInt32 or, if the
+// bytes left are known, more items than fit in them.
+func (d *byteDecoder) length(n uint64, size int) int {
+	if d.err != nil {
+		return 0
+	}
+	if n > math.MaxInt32 || (d.left != nil && n*uint64(size) > uint64(d.left())) {
+		d.fail()
+		return 0
+	}
+	return int(n)
+}
+
+// prealloc returns n capped at maxPrealloc, to make a map or slice for n
+// items before they are read.
+func prealloc(n int) int {
+	if n > maxPrealloc {
+		return maxPrealloc
+	}
+	return n
+}
+
+// nest counts one more level of nested items being skipped. It fails and
+// returns false if the items are nested more than maxDepth deep. Call unnest
+// when done.
+func (d *byteDecoder) nest() bool {
+	d.depth++
+	if d.depth > maxDepth {
+		d.fail()
+		return false
+	}
+	return true
+}
+
+func (d *byteDecoder) unnest() {
+	d.depth--
+}
+
+func (d *byteDecoder) fail() {
+	if d.err == nil {
+		d.err = d.invalid
+	}
+}
+
+// error returns the decoding error. EOF is unexpected because it is returned
+// only if the data ends before the batch.
+func (d *byteDecoder) error() error {
+	if d.err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return d.err
+}
@@ -0,0 +1,116 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// --------------------------------------------------------------------------
+// ErrorCounter
+// --------------------------------------------------------------------------
+
+// Error classes returned by ClassifyError.
+const (
+	ErrorTimeout  = "timeout"
+	ErrorCanceled = "canceled"
+	ErrorOther    = "other"
+)
+
+// ClassifyError is the default ErrorCounter classifier. It returns ErrorTimeout
+// if err is context.DeadlineExceeded or has a Timeout method that returns true
+// (like net.Error), ErrorCanceled if err is context.Canceled, else ErrorOther.
+// It returns an empty string if err is nil.
+func ClassifyError(err error) string {
+	var timeout interface{ Timeout() bool }
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, context.DeadlineExceeded):
+		return ErrorTimeout
+	case errors.As(err, &timeout) && timeout.Timeout():
+		return ErrorTimeout
+	case errors.Is(err, context.Canceled):
+		return ErrorCanceled
+	default:
+		return ErrorOther
+	}
+}
+
+// ErrorCounter counts errors by class, like timeout, canceled, and other. Use
+// one classifier across a codebase so that error taxonomies are consistent.
+type ErrorCounter struct {
+	classify func(error) string
+	*sync.Mutex
+	counters map[string]*Counter
+}
+
+// NewErrorCounter returns an ErrorCounter that classifies errors with classify,
+// or ClassifyError if classify is nil. A classifier can wrap ClassifyError to
+// add classes, like "5xx" for HTTP server errors. Errors classified as an
+// empty string are not counted.
+func NewErrorCounter(classify func(error) string) *ErrorCounter {
+	if classify == nil {
+		classify = ClassifyError
+	}
+	return &ErrorCounter{
+		classify: classify,
+		Mutex:    &sync.Mutex{},
+		counters: map[string]*Counter{},
+	}
+}
+
+// Record counts err in its class. Nil errors are not counted by ClassifyError.
+func (c *ErrorCounter) Record(err error) {
+	if class := c.classify(err); class != "" {
+		c.Counter(class).Add(1)
+	}
+}
+
+// Counter returns the counter for the class. The counter is created if it does
+// not exist, so it can be reported before any errors are recorded.
+func (c *ErrorCounter) Counter(class string) *Counter {
+	c.Lock()
+	counter, ok := c.counters[class]
+	if !ok {
+		counter = NewCounter()
+		c.counters[class] = counter
+	}
+	c.Unlock()
+	return counter
+}
+
+// Counters returns a copy of all counters by class.
+func (c *ErrorCounter) Counters() map[string]*Counter {
+	c.Lock()
+	counters := make(map[string]*Counter, len(c.counters))
+	for class, counter := range c.counters {
+		counters[class] = counter
+	}
+	c.Unlock()
+	return counters
+}
+
+// CountPanics calls fn and, if it panics, counts the panic in c by the type
+// of the panic value, like "runtime.Error" or "string", then panics again with
+// the same value. The panic is counted even if it is recovered higher up or
+// logs are sampled. The classifier of c is not used.
+func CountPanics(c *ErrorCounter, fn func()) {
+	defer func() {
+		if v := recover(); v != nil {
+			c.Counter(panicType(v)).Add(1)
+			panic(v)
+		}
+	}()
+	fn()
+}
+
+// panicType returns the type of panic value v. Runtime errors are all
+// "runtime.Error" because their concrete types are not exported.
+func panicType(v interface{}) string {
+	if _, ok := v.(interface{ RuntimeError() }); ok {
+		return "runtime.Error"
+	}
+	return fmt.Sprintf("%T", v)
+}
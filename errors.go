@@ -0,0 +1,94 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// --------------------------------------------------------------------------
+// Errors
+// --------------------------------------------------------------------------
+
+// Errors returned by Config.Validate, Histogram.Merge, and Status.Set. Errors
+// from Validate wrap ErrInvalidPercentile or ErrInvalidConfig with the
+// details, so check them with errors.Is. Errors of other types are declared
+// with the types that return them, like ErrUnknownRuntimeMetric and ErrMsgPack.
+var (
+	// ErrInvalidPercentile is returned if a percentile is not between 0 and 1,
+	// inclusive, like 99 instead of 0.99.
+	ErrInvalidPercentile = errors.New("metrics: invalid percentile")
+
+	// ErrInvalidConfig is returned if a Config field other than a percentile
+	// is invalid, like a negative SampleSize. Constructors without a Config,
+	// like NewGoroutineWatchdog, NewHeatmap, and NewSampler, panic with an
+	// error wrapping it if an argument is invalid.
+	ErrInvalidConfig = errors.New("metrics: invalid config")
+
+	// ErrMergeSelf is returned if a histogram is merged with itself.
+	ErrMergeSelf = errors.New("metrics: cannot merge histogram with itself")
+
+	// ErrNotMergeable is returned if either histogram of a merge does not use
+	// the KLL estimator, or their thresholds are different.
+	ErrNotMergeable = errors.New("metrics: Merge requires KLL estimator and same thresholds")
+
+	// ErrUnknownStatus is returned by Status.Set if the state is not one of
+	// the Status states.
+	ErrUnknownStatus = errors.New("metrics: unknown status")
+)
+
+// Validate returns an error if any field of cfg is invalid. NewGauge and
+// NewHistogram do not validate cfg: an invalid percentile like 99 is silently
+// reported as the max value. Call Validate if cfg is built from user input,
+// like a config file.
+func (cfg Config) Validate() error {
+	for _, p := range cfg.Percentiles {
+		if err := validPercentile(p); err != nil {
+			return err
+		}
+	}
+	switch cfg.Estimator {
+	case Reservoir, KLL, CKMS:
+	default:
+		return fmt.Errorf("%w: unknown Estimator %d", ErrInvalidConfig, cfg.Estimator)
+	}
+	if cfg.SampleSize < 0 {
+		return fmt.Errorf("%w: negative SampleSize %d", ErrInvalidConfig, cfg.SampleSize)
+	}
+	for p, e := range cfg.TargetErrors {
+		if err := validPercentile(p); err != nil {
+			return err
+		}
+		if !(e > 0 && e < 1) {
+			return fmt.Errorf("%w: TargetErrors %v for percentile %v is not between 0 and 1", ErrInvalidConfig, e, p)
+		}
+	}
+	for _, t := range cfg.Thresholds {
+		if math.IsNaN(t) {
+			return fmt.Errorf("%w: NaN threshold", ErrInvalidConfig)
+		}
+	}
+	if cfg.QueueSize < 0 {
+		return fmt.Errorf("%w: negative QueueSize %d", ErrInvalidConfig, cfg.QueueSize)
+	}
+	if cfg.RecordEvery < 0 {
+		return fmt.Errorf("%w: negative RecordEvery %d", ErrInvalidConfig, cfg.RecordEvery)
+	}
+	if !(cfg.RecordProbability >= 0 && cfg.RecordProbability <= 1) {
+		return fmt.Errorf("%w: RecordProbability %v is not between 0 and 1", ErrInvalidConfig, cfg.RecordProbability)
+	}
+	if cfg.RecordTarget < 0 {
+		return fmt.Errorf("%w: negative RecordTarget %d", ErrInvalidConfig, cfg.RecordTarget)
+	}
+	if cfg.OutlierStdDevs < 0 || cfg.OutlierMaxDeviation < 0 {
+		return fmt.Errorf("%w: negative outlier deviation", ErrInvalidConfig)
+	}
+	return nil
+}
+
+func validPercentile(p float64) error {
+	if !(p >= 0 && p <= 1) { // false for NaN
+		return fmt.Errorf("%w: %v is not between 0 and 1", ErrInvalidPercentile, p)
+	}
+	return nil
+}
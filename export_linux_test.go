@@ -0,0 +1,7 @@
+package metrics
+
+// NewIOCollectorAt returns an IOCollector that reads from proc instead of
+// /proc for testing.
+func NewIOCollectorAt(proc string, pid int) *IOCollector {
+	return newIOCollector(proc, pid)
+}
@@ -0,0 +1,20 @@
+package metrics
+
+import (
+	"time"
+)
+
+// SetHeatmapClock sets the clock of h for testing. The current column starts
+// at now().
+func SetHeatmapClock(h *Heatmap, now func() time.Time) {
+	h.Lock()
+	h.now = now
+	h.start = now().Truncate(h.interval)
+	h.counts = nil
+	h.Unlock()
+}
+
+// CollectGoroutines collects n goroutines for testing.
+func CollectGoroutines(w *GoroutineWatchdog, n int) {
+	w.collect(n)
+}
@@ -0,0 +1,121 @@
+package metrics
+
+import (
+	"math"
+)
+
+// valueFilter checks, and maybe changes, each value recorded by a Gauge or
+// Histogram before the value is sampled. It is not safe for use by multiple
+// goroutines: the metric must be locked.
+type valueFilter struct {
+	transform func(float64) (float64, bool) // Config.Transform
+	min, max  float64                       // Config.MinValue and MaxValue
+	checkMax  bool                          // MinValue < MaxValue
+	clamp     bool                          // Config.ClampInvalid
+	invalid   int64                         // Snapshot.Invalid
+
+	// Outlier rejection
+	stdDevs  float64 // Config.OutlierStdDevs
+	maxDev   float64 // Config.OutlierMaxDeviation
+	n        int64   // values seen, up to outlierWarmup
+	mean     float64 // EWMA
+	variance float64 // EWMA
+	rejected int64   // Snapshot.Rejected
+}
+
+const (
+	// outlierAlpha is the EWMA weight of each value. The running mean and
+	// variance reflect about the last 1/outlierAlpha values.
+	outlierAlpha = 0.01
+
+	// outlierWarmup is the number of values seen before any are rejected.
+	outlierWarmup = 100
+)
+
+// newValueFilter returns the valueFilter for cfg, or nil if values are recorded
+// as is.
+func newValueFilter(cfg Config) *valueFilter {
+	if cfg.Transform == nil && cfg.MinValue >= cfg.MaxValue &&
+		cfg.OutlierStdDevs <= 0 && cfg.OutlierMaxDeviation <= 0 {
+		return nil
+	}
+	return &valueFilter{
+		transform: cfg.Transform,
+		min:       cfg.MinValue,
+		max:       cfg.MaxValue,
+		checkMax:  cfg.MinValue < cfg.MaxValue,
+		clamp:     cfg.ClampInvalid,
+		stdDevs:   cfg.OutlierStdDevs,
+		maxDev:    cfg.OutlierMaxDeviation,
+	}
+}
+
+// apply returns the value to record, or false to drop v.
+func (f *valueFilter) apply(v float64) (float64, bool) {
+	if f.checkMax && (v < f.min || v > f.max || math.IsNaN(v)) {
+		f.invalid++
+		switch {
+		case !f.clamp || math.IsNaN(v):
+			return v, false
+		case v < f.min:
+			v = f.min
+		default:
+			v = f.max
+		}
+	}
+	if (f.stdDevs > 0 || f.maxDev > 0) && f.outlier(v) {
+		f.rejected++
+		return v, false
+	}
+	if f.transform != nil {
+		return f.transform(v)
+	}
+	return v, true
+}
+
+// outlier returns true if v is too far from the running mean. Every value
+// updates the running mean and variance, but outliers are clamped to the limit
+// first, so one huge value does not skew them, yet a real and lasting change in
+// values moves them until the values are no longer outliers.
+func (f *valueFilter) outlier(v float64) bool {
+	if f.n == 0 {
+		f.mean = v
+	}
+	outlier := false
+	if f.n >= outlierWarmup {
+		limit := math.Inf(1)
+		if f.stdDevs > 0 {
+			limit = f.stdDevs * math.Sqrt(f.variance)
+		}
+		if f.maxDev > 0 && f.maxDev < limit {
+			limit = f.maxDev
+		}
+		if v > f.mean+limit {
+			v, outlier = f.mean+limit, true
+		} else if v < f.mean-limit {
+			v, outlier = f.mean-limit, true
+		}
+	} else {
+		f.n++
+	}
+
+	// Finch (2009), "Incremental calculation of weighted mean and variance"
+	diff := v - f.mean
+	incr := outlierAlpha * diff
+	f.mean += incr
+	f.variance = (1 - outlierAlpha) * (f.variance + diff*incr)
+	return outlier
+}
+
+// counts sets the filter counts in snapshot, and resets them if reset is true.
+func (f *valueFilter) counts(snapshot *Snapshot, reset bool) {
+	if f == nil {
+		return
+	}
+	snapshot.Invalid = f.invalid
+	snapshot.Rejected = f.rejected
+	if reset {
+		f.invalid = 0
+		f.rejected = 0
+	}
+}
@@ -0,0 +1,54 @@
+package metrics
+
+import (
+	"runtime/debug"
+	"sync"
+)
+
+// --------------------------------------------------------------------------
+// GCPauseCollector
+// --------------------------------------------------------------------------
+
+// GCPauseCollector records each GC pause, in seconds, into a Histogram, so
+// P99 GC pause can be reported like any other latency. Call Collect every
+// interval before reporting Pauses. The runtime keeps only the last 256
+// pauses, so if there are more GCs between calls to Collect, the older pauses
+// are missed; they are counted in Missed.
+type GCPauseCollector struct {
+	Pauses *Histogram
+	Missed *Counter
+
+	*sync.Mutex
+	stats debug.GCStats
+	numGC int64
+}
+
+// NewGCPauseCollector returns a GCPauseCollector with the Pauses histogram
+// configured by cfg. Pauses before the first Collect are not recorded.
+func NewGCPauseCollector(cfg Config) *GCPauseCollector {
+	c := &GCPauseCollector{
+		Pauses: NewHistogram(cfg),
+		Missed: NewCounter(),
+		Mutex:  &sync.Mutex{},
+	}
+	debug.ReadGCStats(&c.stats)
+	c.numGC = c.stats.NumGC
+	return c
+}
+
+// Collect records the GC pauses since the last call.
+func (c *GCPauseCollector) Collect() {
+	c.Lock()
+	defer c.Unlock()
+	debug.ReadGCStats(&c.stats) // reuses c.stats.Pause
+	n := c.stats.NumGC - c.numGC
+	c.numGC = c.stats.NumGC
+	if n > int64(len(c.stats.Pause)) {
+		c.Missed.Add(n - int64(len(c.stats.Pause)))
+		n = int64(len(c.stats.Pause))
+	}
+	// Pause is most recent first, so record oldest first
+	for i := n - 1; i >= 0; i-- {
+		c.Pauses.Record(c.stats.Pause[i].Seconds())
+	}
+}
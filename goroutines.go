@@ -0,0 +1,83 @@
+package metrics
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+)
+
+// --------------------------------------------------------------------------
+// GoroutineWatchdog
+// --------------------------------------------------------------------------
+
+// GoroutineWatchdog records the number of goroutines and flags a suspected
+// goroutine leak: the number increased every interval for the configured
+// number of consecutive intervals. Call Collect every interval before
+// reporting the metrics. Normal load changes go up and down, but a leak only
+// goes up.
+type GoroutineWatchdog struct {
+	Goroutines *Gauge // number of goroutines
+	Growth     *Gauge // change since the previous Collect
+	Suspected  *Gauge // 1 if a leak is suspected, else 0
+
+	*sync.Mutex
+	intervals int
+	prev      int
+	primed    bool
+	increases int  // consecutive
+	leak      bool // Leak, not reset by Suspected snapshots
+}
+
+// NewGoroutineWatchdog returns a GoroutineWatchdog that suspects a leak after
+// the number of goroutines increased for intervals consecutive calls to Collect.
+// It panics with an error wrapping ErrInvalidConfig if intervals is less than
+// one, because a leak would be suspected on every Collect.
+func NewGoroutineWatchdog(intervals int) *GoroutineWatchdog {
+	if intervals < 1 {
+		panic(fmt.Errorf("%w: GoroutineWatchdog intervals %d is less than 1", ErrInvalidConfig, intervals))
+	}
+	return &GoroutineWatchdog{
+		Goroutines: NewGauge(Config{}),
+		Growth:     NewGauge(Config{}),
+		Suspected:  NewGauge(Config{}),
+		Mutex:      &sync.Mutex{},
+		intervals:  intervals,
+	}
+}
+
+// Collect records the current number of goroutines.
+func (w *GoroutineWatchdog) Collect() {
+	w.collect(runtime.NumGoroutine())
+}
+
+func (w *GoroutineWatchdog) collect(n int) {
+	w.Lock()
+	defer w.Unlock()
+	w.Goroutines.Record(float64(n))
+	if !w.primed {
+		w.prev, w.primed = n, true
+		w.Suspected.Record(0)
+		return
+	}
+	w.Growth.Record(float64(n - w.prev))
+	if n > w.prev {
+		w.increases++
+	} else {
+		w.increases = 0
+	}
+	w.prev = n
+	w.leak = w.increases >= w.intervals
+	if w.leak {
+		w.Suspected.Record(1)
+	} else {
+		w.Suspected.Record(0)
+	}
+}
+
+// Leak returns true if a leak is suspected as of the last Collect. Unlike
+// Suspected.Last, it is not reset by a Suspected snapshot with reset.
+func (w *GoroutineWatchdog) Leak() bool {
+	w.Lock()
+	defer w.Unlock()
+	return w.leak
+}
@@ -0,0 +1,82 @@
+package metrics
+
+import (
+	"sync"
+)
+
+// --------------------------------------------------------------------------
+// Group
+// --------------------------------------------------------------------------
+
+// Group is a request counter, an error counter, and a latency histogram that
+// share one lock and are recorded together. Recording a request is one lock
+// instead of one per metric, and snapshots are consistent: the number of
+// latency values always equals the number of requests, less the number of
+// latency values dropped by the Config filters (GroupSnapshot.DroppedLatency).
+type Group struct {
+	*sync.Mutex    // shared with latency
+	requests       int64
+	errors         int64
+	droppedLatency int64
+	latency        *Histogram
+}
+
+// GroupSnapshot is a snapshot of a Group. Requests and Errors are Counter
+// snapshots; Latency is a Histogram snapshot.
+type GroupSnapshot struct {
+	Requests Snapshot
+	Errors   Snapshot
+	Latency  Snapshot
+
+	// DroppedLatency is the number of requests whose latency was dropped by
+	// Config.MinValue and MaxValue (without ClampInvalid), OutlierStdDevs,
+	// OutlierMaxDeviation, or Transform. The requests are counted, so
+	// Latency.N equals Requests.N minus DroppedLatency.
+	DroppedLatency int64
+}
+
+// NewGroup returns a Group with the latency histogram configured by cfg.
+// Config.QueueSize is ignored because values are recorded under the shared lock.
+// Config.RecordEvery, RecordProbability, and RecordTarget are ignored because
+// every request is counted, so every latency is recorded too.
+func NewGroup(cfg Config) *Group {
+	cfg.QueueSize = 0
+	cfg.RecordEvery = 0
+	cfg.RecordProbability = 0
+	cfg.RecordTarget = 0
+	h := NewHistogram(cfg)
+	return &Group{
+		Mutex:   h.Mutex,
+		latency: h,
+	}
+}
+
+// Record records one request with the given latency. If err is not nil, the
+// request is also counted as an error. The request is counted even if the
+// latency is dropped by the Config filters.
+func (g *Group) Record(latency float64, err error) {
+	g.Lock()
+	g.requests++
+	if err != nil {
+		g.errors++
+	}
+	if _, ok := g.latency.record(latency); !ok {
+		g.droppedLatency++
+	}
+	g.Unlock()
+}
+
+func (g *Group) Snapshot(reset bool) GroupSnapshot {
+	var snapshot GroupSnapshot
+	snapshot.Latency = g.latency.snapshot(reset, false, func() {
+		snapshot.Requests = Snapshot{N: g.requests, Sum: float64(g.requests)}
+		snapshot.Errors = Snapshot{N: g.errors, Sum: float64(g.errors)}
+		snapshot.DroppedLatency = g.droppedLatency
+		if reset {
+			g.requests = 0
+			g.errors = 0
+			g.droppedLatency = 0
+		}
+	})
+	return snapshot
+}
@@ -0,0 +1,146 @@
+package metrics
+
+import (
+	"sync"
+)
+
+// --------------------------------------------------------------------------
+// HealthSignal
+// --------------------------------------------------------------------------
+
+// HealthState is the state of a HealthSignal, named like a circuit breaker.
+type HealthState int
+
+const (
+	// HealthClosed is healthy: allow all load.
+	HealthClosed HealthState = iota
+
+	// HealthOpen is unhealthy: shed load.
+	HealthOpen
+
+	// HealthHalfOpen is probing: allow some load to see if health recovered.
+	HealthHalfOpen
+)
+
+func (s HealthState) String() string {
+	switch s {
+	case HealthClosed:
+		return "closed"
+	case HealthOpen:
+		return "open"
+	case HealthHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// HealthConfig configures a HealthSignal. An interval is unhealthy if the
+// error ratio or the latency percentile exceeds its max. A zero max disables
+// that check.
+type HealthConfig struct {
+	// MaxErrorRatio is the max errors / requests, like 0.05 for 5%.
+	MaxErrorRatio float64
+
+	// MaxLatency is the max value of the latency LatencyPercentile.
+	MaxLatency float64
+
+	// LatencyPercentile is the latency percentile to check, like 0.99. It must
+	// be one of the latency metric's Config.Percentiles.
+	LatencyPercentile float64
+
+	// MinRequests is the min number of requests for an interval to be checked.
+	// Intervals with fewer requests are ignored (neither healthy nor unhealthy),
+	// so a few errors during low traffic do not open the signal.
+	MinRequests int64
+
+	// OpenIntervals is the number of intervals to stay open before half-open.
+	// If zero, it is 1.
+	OpenIntervals int
+
+	// OnChange is called when the state changes, if not nil. It is called
+	// synchronously by Observe, so it must not call Observe.
+	OnChange func(from, to HealthState)
+}
+
+// HealthSignal is a circuit-breaker signal derived from metrics. Each interval,
+// pass it the same request, error, and latency snapshots that are reported.
+// It opens when an interval is unhealthy, half-opens after OpenIntervals, then
+// closes if the next interval is healthy or opens again if not. The application
+// decides how to shed load based on State.
+type HealthSignal struct {
+	cfg HealthConfig
+	*sync.Mutex
+	state     HealthState
+	openCount int
+}
+
+func NewHealthSignal(cfg HealthConfig) *HealthSignal {
+	if cfg.OpenIntervals < 1 {
+		cfg.OpenIntervals = 1
+	}
+	return &HealthSignal{
+		cfg:   cfg,
+		Mutex: &sync.Mutex{},
+	}
+}
+
+// State returns the current state.
+func (h *HealthSignal) State() HealthState {
+	h.Lock()
+	defer h.Unlock()
+	return h.state
+}
+
+// Observe checks one interval and returns the new state. requests and errors
+// are Counter snapshots (Sum is used), and latency is a Histogram snapshot.
+func (h *HealthSignal) Observe(requests, errors, latency Snapshot) HealthState {
+	h.Lock()
+	from := h.state
+	healthy, checked := h.healthy(requests, errors, latency)
+	switch h.state {
+	case HealthClosed:
+		if checked && !healthy {
+			h.open()
+		}
+	case HealthOpen:
+		h.openCount++
+		if h.openCount >= h.cfg.OpenIntervals {
+			h.state = HealthHalfOpen
+		}
+	case HealthHalfOpen:
+		if checked {
+			if healthy {
+				h.state = HealthClosed
+			} else {
+				h.open()
+			}
+		}
+	}
+	to := h.state
+	h.Unlock()
+	if from != to && h.cfg.OnChange != nil {
+		h.cfg.OnChange(from, to)
+	}
+	return to
+}
+
+func (h *HealthSignal) open() {
+	h.state = HealthOpen
+	h.openCount = 0
+}
+
+// healthy returns true if the interval is healthy, and false for checked if
+// there were too few requests to check.
+func (h *HealthSignal) healthy(requests, errors, latency Snapshot) (healthy bool, checked bool) {
+	if requests.Sum <= 0 || int64(requests.Sum) < h.cfg.MinRequests {
+		return false, false
+	}
+	if h.cfg.MaxErrorRatio > 0 && errors.Sum/requests.Sum > h.cfg.MaxErrorRatio {
+		return false, true
+	}
+	if h.cfg.MaxLatency > 0 && latency.Percentile[h.cfg.LatencyPercentile] > h.cfg.MaxLatency {
+		return false, true
+	}
+	return true, true
+}
@@ -0,0 +1,124 @@
+package metrics
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// --------------------------------------------------------------------------
+// Heatmap
+// --------------------------------------------------------------------------
+
+// HeatmapSnapshot is a time × bucket matrix of counts. Counts[i] is the column
+// for the sub-interval starting at Start + i*Interval, and Counts[i][j] is the
+// number of values in (Bounds[j-1], Bounds[j]]. The last bucket in each
+// column, Counts[i][len(Bounds)], counts values greater than the last bound.
+// Buckets are not cumulative: this is the format that heatmap panels expect.
+type HeatmapSnapshot struct {
+	Start    time.Time
+	Interval time.Duration
+	Bounds   []float64
+	Counts   [][]int64
+}
+
+// Heatmap counts values by bucket per sub-interval, like latency per 10s in
+// buckets of 10ms, 50ms, 100ms, and 500ms. Reported every minute, it is a
+// matrix of 6 columns by 5 buckets, which backends render as a latency heatmap.
+// Counts are exact. Sub-intervals are aligned to the wall clock (truncated to
+// Interval), so heatmaps from several instances line up.
+type Heatmap struct {
+	bounds   []float64 // sorted
+	interval time.Duration
+	*sync.Mutex
+	start  time.Time // start of counts[0]
+	counts [][]int64
+	now    func() time.Time
+}
+
+// NewHeatmap returns a Heatmap with the given bucket upper bounds and
+// sub-interval duration. It panics with an error wrapping ErrInvalidConfig if
+// interval is not positive.
+func NewHeatmap(bounds []float64, interval time.Duration) *Heatmap {
+	if interval <= 0 {
+		panic(fmt.Errorf("%w: Heatmap interval %v is not positive", ErrInvalidConfig, interval))
+	}
+	h := &Heatmap{
+		bounds:   make([]float64, len(bounds)),
+		interval: interval,
+		Mutex:    &sync.Mutex{},
+		now:      time.Now,
+	}
+	copy(h.bounds, bounds)
+	sort.Float64s(h.bounds)
+	h.start = h.now().Truncate(interval)
+	return h
+}
+
+func (h *Heatmap) Record(v float64) {
+	h.Lock()
+	h.record(v, h.now())
+	h.Unlock()
+}
+
+// RecordAt records v in the column for time t instead of now, so values with
+// their own timestamps, like backfilled values parsed from a log, are counted
+// in the sub-interval when they happened. Times before the first column not
+// yet returned by a snapshot with reset are counted in that column, and times
+// after now are counted in the current column.
+func (h *Heatmap) RecordAt(v float64, t time.Time) {
+	h.Lock()
+	if now := h.now(); t.After(now) {
+		t = now
+	}
+	h.record(v, t)
+	h.Unlock()
+}
+
+func (h *Heatmap) record(v float64, t time.Time) {
+	i := h.column(t)
+	h.counts[i][sort.SearchFloat64s(h.bounds, v)]++
+}
+
+// column returns the index of the column for time t, adding columns as needed.
+// Times before start (the clock went backwards) are counted in the first column.
+func (h *Heatmap) column(t time.Time) int {
+	i := 0
+	if t.After(h.start) {
+		i = int(t.Sub(h.start) / h.interval)
+	}
+	for len(h.counts) <= i {
+		h.counts = append(h.counts, make([]int64, len(h.bounds)+1))
+	}
+	return i
+}
+
+// Snapshot returns the complete sub-intervals since the last reset. The current
+// sub-interval is not complete, so it is not returned until the next snapshot.
+// Sub-intervals without values are returned as columns of zero counts so that
+// the columns are contiguous.
+func (h *Heatmap) Snapshot(reset bool) HeatmapSnapshot {
+	h.Lock()
+	defer h.Unlock()
+	cur := h.column(h.now())
+	snapshot := HeatmapSnapshot{
+		Start:    h.start,
+		Interval: h.interval,
+		Bounds:   h.bounds,
+		Counts:   make([][]int64, cur),
+	}
+	for i := 0; i < cur; i++ {
+		if reset {
+			snapshot.Counts[i] = h.counts[i]
+		} else {
+			snapshot.Counts[i] = make([]int64, len(h.counts[i]))
+			copy(snapshot.Counts[i], h.counts[i])
+		}
+	}
+	if reset {
+		h.counts = h.counts[cur:]
+		h.start = h.start.Add(time.Duration(cur) * h.interval)
+	}
+	return snapshot
+}
@@ -0,0 +1,71 @@
+package metrics
+
+import (
+	"sync"
+)
+
+// --------------------------------------------------------------------------
+// History
+// --------------------------------------------------------------------------
+
+// History is a Metric that retains the last snapshots of another Metric in a
+// ring buffer. Report the History instead of the metric, and the last size
+// intervals are available from Snapshots for debug endpoints, anomaly
+// detection, and rollups without an external store.
+type History struct {
+	m Metric
+	*sync.Mutex
+	ring []Snapshot
+	next int  // next position to write
+	full bool // ring has wrapped
+}
+
+// NewHistory returns a History of m that retains the last size snapshots.
+func NewHistory(m Metric, size int) *History {
+	return &History{
+		m:     m,
+		Mutex: &sync.Mutex{},
+		ring:  make([]Snapshot, size),
+	}
+}
+
+// Snapshot returns a snapshot of the metric. If reset is true, the snapshot is
+// one interval, so it is retained. Snapshots without reset are not retained
+// because they overlap the current interval. The retained snapshot has its own
+// Percentile map, so Config.ReusePercentileMap does not change it.
+func (h *History) Snapshot(reset bool) Snapshot {
+	snapshot := h.m.Snapshot(reset)
+	if !reset || len(h.ring) == 0 {
+		return snapshot
+	}
+	retained := snapshot
+	if snapshot.Percentile != nil {
+		retained.Percentile = make(map[float64]float64, len(snapshot.Percentile))
+		for p, v := range snapshot.Percentile {
+			retained.Percentile[p] = v
+		}
+	}
+	h.Lock()
+	h.ring[h.next] = retained
+	h.next++
+	if h.next == len(h.ring) {
+		h.next = 0
+		h.full = true
+	}
+	h.Unlock()
+	return snapshot
+}
+
+// Snapshots returns the retained snapshots, oldest first.
+func (h *History) Snapshots() []Snapshot {
+	h.Lock()
+	defer h.Unlock()
+	if !h.full {
+		snapshots := make([]Snapshot, h.next)
+		copy(snapshots, h.ring[:h.next])
+		return snapshots
+	}
+	snapshots := make([]Snapshot, 0, len(h.ring))
+	snapshots = append(snapshots, h.ring[h.next:]...)
+	return append(snapshots, h.ring[:h.next]...)
+}
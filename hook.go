@@ -0,0 +1,110 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+)
+
+// --------------------------------------------------------------------------
+// Hook
+// --------------------------------------------------------------------------
+
+// Hook is called by client libraries, like Redis, Kafka, and HTTP clients,
+// before and after each call, so they can be instrumented without depending
+// on specific metric types. name identifies the call, like "GET" or "publish";
+// it must have low cardinality. Hooks must be safe for use by multiple
+// goroutines.
+type Hook interface {
+	BeforeCall(name string)
+	AfterCall(name string, d time.Duration, err error)
+}
+
+// Call calls fn between h.BeforeCall and h.AfterCall, and returns its error.
+func Call(h Hook, name string, fn func() error) error {
+	h.BeforeCall(name)
+	t0 := time.Now()
+	err := fn()
+	h.AfterCall(name, time.Since(t0), err)
+	return err
+}
+
+// CallMetrics is the standard Hook. For each call name, it records latency
+// in seconds, errors, and calls in flight.
+type CallMetrics struct {
+	cfg Config
+	*sync.Mutex
+	calls map[string]*callMetrics
+}
+
+type callMetrics struct {
+	latency  *Histogram
+	errors   *Counter
+	inFlight *Concurrency
+}
+
+var _ Hook = &CallMetrics{}
+
+// NewCallMetrics returns a CallMetrics with latency histograms configured by cfg.
+func NewCallMetrics(cfg Config) *CallMetrics {
+	return &CallMetrics{
+		cfg:   cfg,
+		Mutex: &sync.Mutex{},
+		calls: map[string]*callMetrics{},
+	}
+}
+
+func (m *CallMetrics) get(name string) *callMetrics {
+	m.Lock()
+	c, ok := m.calls[name]
+	if !ok {
+		c = &callMetrics{
+			latency:  NewHistogram(m.cfg),
+			errors:   NewCounter(),
+			inFlight: NewConcurrency(),
+		}
+		m.calls[name] = c
+	}
+	m.Unlock()
+	return c
+}
+
+func (m *CallMetrics) BeforeCall(name string) {
+	m.get(name).inFlight.Start()
+}
+
+func (m *CallMetrics) AfterCall(name string, d time.Duration, err error) {
+	c := m.get(name)
+	c.inFlight.Done()
+	c.latency.Record(d.Seconds())
+	if err != nil {
+		c.errors.Add(1)
+	}
+}
+
+// Latency returns the latency histogram for the call name. The metrics for a
+// name are created if they do not exist, so they can be reported before any
+// calls.
+func (m *CallMetrics) Latency(name string) *Histogram {
+	return m.get(name).latency
+}
+
+// Errors returns the error counter for the call name.
+func (m *CallMetrics) Errors(name string) *Counter {
+	return m.get(name).errors
+}
+
+// InFlight returns the calls in flight for the call name.
+func (m *CallMetrics) InFlight(name string) *Concurrency {
+	return m.get(name).inFlight
+}
+
+// Names returns the names of all calls.
+func (m *CallMetrics) Names() []string {
+	m.Lock()
+	names := make([]string, 0, len(m.calls))
+	for name := range m.calls {
+		names = append(names, name)
+	}
+	m.Unlock()
+	return names
+}
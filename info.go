@@ -0,0 +1,93 @@
+package metrics
+
+import (
+	"sync"
+)
+
+// --------------------------------------------------------------------------
+// Info
+// --------------------------------------------------------------------------
+
+// Info is a constant metric with string labels, like version and git revision.
+// Its Snapshot is always N = 1 and Sum = 1, so exporters can report it like the
+// Prometheus *_build_info pattern: a gauge with value 1 and the labels.
+type Info struct {
+	labels map[string]string
+}
+
+// NewInfo returns an Info with a copy of labels.
+func NewInfo(labels map[string]string) *Info {
+	i := &Info{
+		labels: make(map[string]string, len(labels)),
+	}
+	for k, v := range labels {
+		i.labels[k] = v
+	}
+	return i
+}
+
+// Labels returns a copy of the labels.
+func (i *Info) Labels() map[string]string {
+	labels := make(map[string]string, len(i.labels))
+	for k, v := range i.labels {
+		labels[k] = v
+	}
+	return labels
+}
+
+// Snapshot returns N = 1 and Sum = 1. Reset does nothing because the value is
+// constant.
+func (i *Info) Snapshot(reset bool) Snapshot {
+	return Snapshot{N: 1, Sum: 1}
+}
+
+// InfoGauge is an Info with labels that can change, like the active config
+// hash or the set of enabled feature flags. Like Info, its Snapshot is always
+// N = 1 and Sum = 1, and the labels are the value. It is safe for use by
+// multiple goroutines.
+type InfoGauge struct {
+	*sync.Mutex
+	labels map[string]string
+}
+
+// NewInfoGauge returns an InfoGauge with a copy of labels.
+func NewInfoGauge(labels map[string]string) *InfoGauge {
+	return &InfoGauge{
+		Mutex:  &sync.Mutex{},
+		labels: NewInfo(labels).labels,
+	}
+}
+
+// Set sets label key to value.
+func (i *InfoGauge) Set(key, value string) {
+	i.Lock()
+	i.labels[key] = value
+	i.Unlock()
+}
+
+// Delete removes label key.
+func (i *InfoGauge) Delete(key string) {
+	i.Lock()
+	delete(i.labels, key)
+	i.Unlock()
+}
+
+// SetLabels replaces all labels with a copy of labels.
+func (i *InfoGauge) SetLabels(labels map[string]string) {
+	copied := NewInfo(labels).labels
+	i.Lock()
+	i.labels = copied
+	i.Unlock()
+}
+
+// Labels returns a copy of the labels.
+func (i *InfoGauge) Labels() map[string]string {
+	i.Lock()
+	defer i.Unlock()
+	return (&Info{labels: i.labels}).Labels()
+}
+
+// Snapshot returns N = 1 and Sum = 1, like Info.Snapshot.
+func (i *InfoGauge) Snapshot(reset bool) Snapshot {
+	return Snapshot{N: 1, Sum: 1}
+}
@@ -0,0 +1,249 @@
+package metrics
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+)
+
+// --------------------------------------------------------------------------
+// KLL sketch: https://arxiv.org/abs/1603.05346
+// Based on the reference implementation by Edo Liberty:
+// https://github.com/edoliberty/streaming-quantiles
+// --------------------------------------------------------------------------
+
+const (
+	defaultKLLK = 200
+	kllC        = 2.0 / 3.0
+)
+
+type kllSketch struct {
+	k          int
+	n          int64
+	sum        float64
+	sumSq      float64
+	min        float64
+	max        float64
+	compactors [][]float64 // compactors[h] items have weight 2^h
+	size       int         // number of items in all compactors
+	maxSize    int         // sum of all compactor capacities
+}
+
+func newKLLSketch(k int) *kllSketch {
+	s := &kllSketch{k: k}
+	s.grow()
+	return s
+}
+
+func (s *kllSketch) record(v float64) {
+	if s.n == 0 || v < s.min {
+		s.min = v
+	}
+	if s.n == 0 || v > s.max {
+		s.max = v
+	}
+	s.n++
+	s.sum += v
+	s.sumSq += v * v
+	s.compactors[0] = append(s.compactors[0], v)
+	s.size++
+	if s.size >= s.maxSize {
+		s.compress()
+	}
+}
+
+func (s *kllSketch) merge(o *kllSketch) {
+	if o.n == 0 {
+		return
+	}
+	if s.n == 0 || o.min < s.min {
+		s.min = o.min
+	}
+	if s.n == 0 || o.max > s.max {
+		s.max = o.max
+	}
+	s.n += o.n
+	s.sum += o.sum
+	s.sumSq += o.sumSq
+	for len(s.compactors) < len(o.compactors) {
+		s.grow()
+	}
+	for h := range o.compactors {
+		s.compactors[h] = append(s.compactors[h], o.compactors[h]...)
+	}
+	s.size = 0
+	for _, c := range s.compactors {
+		s.size += len(c)
+	}
+	for s.size >= s.maxSize {
+		s.compress()
+	}
+}
+
+// clone returns a deep copy of the sketch.
+func (s *kllSketch) clone() *kllSketch {
+	c := *s
+	c.compactors = make([][]float64, len(s.compactors))
+	for h, items := range s.compactors {
+		c.compactors[h] = append(make([]float64, 0, cap(items)), items...)
+	}
+	return &c
+}
+
+func (s *kllSketch) reset() {
+	s.n = 0
+	s.sum = 0
+	s.sumSq = 0
+	s.min = 0
+	s.max = 0
+	s.compactors = nil
+	s.size = 0
+	s.grow()
+}
+
+func (s *kllSketch) take() sample {
+	t := *s
+	s.reset()
+	return &t
+}
+
+func (s *kllSketch) snapshot(snapshot *Snapshot, p []float64, scores map[float64]float64, reset bool) {
+	if s.n == 0 {
+		return // reset then called again without any new values
+	}
+	snapshot.N = s.n
+	snapshot.Sum = s.sum
+	snapshot.SumOfSquares = s.sumSq
+	snapshot.Min = s.min
+	snapshot.Max = s.max
+	snapshot.Percentile = s.percentiles(resetScores(scores, p), p)
+	if reset {
+		s.reset()
+	}
+}
+
+// capacity returns the max number of items at height h. Lower compactors
+// have smaller capacities, decreasing geometrically by kllC.
+func (s *kllSketch) capacity(h int) int {
+	depth := len(s.compactors) - h - 1
+	return int(math.Ceil(math.Pow(kllC, float64(depth))*float64(s.k))) + 1
+}
+
+func (s *kllSketch) grow() {
+	s.compactors = append(s.compactors, make([]float64, 0, s.k))
+	s.maxSize = 0
+	for h := range s.compactors {
+		s.maxSize += s.capacity(h)
+	}
+}
+
+// compress compacts the lowest full compactor, promoting every other item
+// (randomly odd or even) to the next height where each item has double weight.
+func (s *kllSketch) compress() {
+	for h := 0; h < len(s.compactors); h++ {
+		if len(s.compactors[h]) < s.capacity(h) {
+			continue
+		}
+		if h+1 >= len(s.compactors) {
+			s.grow()
+		}
+		c := s.compactors[h]
+		sort.Float64s(c)
+		odd := len(c) % 2 // an odd item out stays at this height
+		offset := rand.Intn(2)
+		for i := offset; i < len(c)-odd; i += 2 {
+			s.compactors[h+1] = append(s.compactors[h+1], c[i])
+		}
+		if odd == 1 {
+			c[0] = c[len(c)-1]
+		}
+		s.compactors[h] = c[:odd]
+		s.size = 0
+		for _, c := range s.compactors {
+			s.size += len(c)
+		}
+		if s.size < s.maxSize {
+			break
+		}
+	}
+}
+
+type kllItem struct {
+	v      float64
+	weight int64
+}
+
+// kllItemsPool reuses the temporary weighted items slices, like valuesPool.
+var kllItemsPool = sync.Pool{
+	New: func() interface{} {
+		items := make([]kllItem, 0, 3*defaultKLLK)
+		return &items
+	},
+}
+
+func (s *kllSketch) percentiles(scores map[float64]float64, percentiles []float64) map[float64]float64 {
+	if len(percentiles) == 0 {
+		return scores
+	}
+	pooled := kllItemsPool.Get().(*[]kllItem)
+	defer kllItemsPool.Put(pooled)
+	items := (*pooled)[:0]
+	var total int64
+	for h, c := range s.compactors {
+		w := int64(1) << uint(h)
+		for _, v := range c {
+			items = append(items, kllItem{v: v, weight: w})
+			total += w
+		}
+	}
+	*pooled = items
+	sort.Slice(items, func(i, j int) bool { return items[i].v < items[j].v })
+	for _, p := range percentiles {
+		scores[p] = kllRank(items, total, p)
+	}
+	return scores
+}
+
+// kllRank returns percentile p by nearest rank over the sorted weighted items,
+// which must not be empty.
+func kllRank(items []kllItem, total int64, p float64) float64 {
+	rank := int64(math.Ceil(p * float64(total)))
+	var cum int64
+	for _, it := range items {
+		cum += it.weight
+		if cum >= rank {
+			return it.v
+		}
+	}
+	return items[len(items)-1].v
+}
+
+// kllQuantiles is a copy of the weighted items of a kllSketch for View.
+type kllQuantiles struct {
+	items []kllItem
+	total int64
+}
+
+func (s *kllSketch) quantiles() quantiles {
+	q := &kllQuantiles{items: make([]kllItem, 0, s.size)}
+	for h, c := range s.compactors {
+		w := int64(1) << uint(h)
+		for _, v := range c {
+			q.items = append(q.items, kllItem{v: v, weight: w})
+			q.total += w
+		}
+	}
+	return q
+}
+
+func (q *kllQuantiles) sort() {
+	sort.Slice(q.items, func(i, j int) bool { return q.items[i].v < q.items[j].v })
+}
+
+func (q *kllQuantiles) quantile(p float64) float64 {
+	if len(q.items) == 0 {
+		return 0
+	}
+	return kllRank(q.items, q.total, p)
+}
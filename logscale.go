@@ -0,0 +1,84 @@
+package metrics
+
+import (
+	"math"
+)
+
+// logSample samples log(1+v) in another sample for Config.LogScale. The other
+// sample's N, Sum, SumOfSquares, Min, and Max would be in log scale, so they
+// are tracked here from the original values.
+type logSample struct {
+	s     sample
+	n     int64
+	sum   float64
+	sumSq float64
+	min   float64
+	max   float64
+}
+
+func newLogSample(s sample) *logSample {
+	return &logSample{s: s}
+}
+
+func (s *logSample) record(v float64) {
+	if s.n == 0 || v < s.min {
+		s.min = v
+	}
+	if s.n == 0 || v > s.max {
+		s.max = v
+	}
+	s.n++
+	s.sum += v
+	s.sumSq += v * v
+	s.s.record(math.Log1p(math.Max(v, 0)))
+}
+
+func (s *logSample) take() sample {
+	t := *s
+	t.s = s.s.take()
+	s.n = 0
+	s.sum = 0
+	s.sumSq = 0
+	s.min = 0
+	s.max = 0
+	return &t
+}
+
+func (s *logSample) snapshot(snapshot *Snapshot, p []float64, scores map[float64]float64, reset bool) {
+	if s.n == 0 {
+		return
+	}
+	s.s.snapshot(snapshot, p, scores, reset)
+	for q, v := range snapshot.Percentile {
+		snapshot.Percentile[q] = math.Expm1(v)
+	}
+	snapshot.N = s.n
+	snapshot.Sum = s.sum
+	snapshot.SumOfSquares = s.sumSq
+	snapshot.Min = s.min
+	snapshot.Max = s.max
+	if reset {
+		s.n = 0
+		s.sum = 0
+		s.sumSq = 0
+		s.min = 0
+		s.max = 0
+	}
+}
+
+// logQuantiles transforms the percentiles of a logSample copy for View.
+type logQuantiles struct {
+	q quantiles
+}
+
+func (s *logSample) quantiles() quantiles {
+	return logQuantiles{q: s.s.quantiles()}
+}
+
+func (q logQuantiles) sort() {
+	q.q.sort()
+}
+
+func (q logQuantiles) quantile(p float64) float64 {
+	return math.Expm1(q.q.quantile(p))
+}
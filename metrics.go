@@ -7,19 +7,24 @@
 //
 // This package differs from other Go metric packages in three significant ways:
 //
-// 1. Metrics: Only base metric types are provide (counter, gauge, histogram).
-// There are no sinks, registries, or derivative metric types. These should be
-// implement by other packages which import this package.
+// 1. Metrics: The base metric types are counter, gauge, and histogram. Everything
+// else in this package is built on them: derivative metric types (like Group,
+// History, Heatmap, Status, and HealthSignal), wrappers that record metrics for
+// database/sql, net.Conn, DNS lookups, and io, runtime and process collectors,
+// and snapshot encoders. There are no sinks or registries. These should be
+// implemented by other packages which import this package.
 //
 // 2. Sampling: Only "Algorithm R" by Jeffrey Vitter (https://www.cs.umd.edu/~samir/498/vitter.pdf)
-// is used to sample values for Gauge and Histogram. The reservoir size is fixed
-// at 2,000. Testing with real-world values shows that smaller and larger sizes
-// either yield no benefit or reduce accuracy. And the true maximum value is kept
-// and reported, which is not a feature of the original Algorithm R but critical
-// for application performance monitoring.
+// is used to sample values for Gauge and Histogram. The reservoir size is 2,000
+// by default; it can be set with Config.SampleSize and changed at the next reset
+// with Reconfigure. Testing with real-world values shows that smaller and larger
+// sizes either yield no benefit or reduce accuracy. And the true minimum and maximum
+// values are kept and reported, which is not a feature of the original Algorithm R but critical
+// for application performance monitoring. Alternative estimators, like the KLL
+// sketch, can be set with Config.Estimator.
 //
 // 3. Percentiles: Both nearest rank and linear interpolation are used calculate
-// percentile values. If the sample is full (>= 2,000 values), nearest rank is
+// percentile values. If the sample is full (>= SampleSize values), nearest rank is
 // used; else, "Definition 8"--better known as "R8"--is used (https://www.amherst.edu/media/view/129116/original/Sample+Quantiles.pdf).
 // Testing with real-world values shows that this combination produces more accurate
 // P999 (99.9th percentile) values, which is the gold standard for high-performance,
@@ -28,26 +33,181 @@
 // Additionally, this package supports atomic snapshots: metric values can be
 // reset to zero after snapshot with no loss of values between snapshot and reset.
 //
-// Counter, Gauge, and Histogram are safe for use by multiple goroutines.
+// All metric types are safe for use by multiple goroutines.
 package metrics
 
 import (
+	"context"
 	"math"
 	"math/rand"
+	"runtime/trace"
 	"sort"
+	"strconv"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 var defaultSampleSize = 2000
 
-// Config represents Gauge and Histogram configuration. Currently, only percentiles
-// are configured. This struct is placeholder for future configurations, if needed.
+// Estimator is the algorithm used to estimate percentiles.
+type Estimator int
+
+const (
+	// Reservoir samples values with Algorithm R. This is the default.
+	Reservoir Estimator = iota
+
+	// KLL uses the quantile sketch by Karnin, Lang, and Liberty (https://arxiv.org/abs/1603.05346).
+	// Unlike a random sample, the sketch is mergeable and has a provable error
+	// bound: with k = 200 (fixed), the normalized rank error is approximately
+	// 1.65% with 99% confidence. Use it when percentile accuracy must be
+	// justified; else, the default Reservoir is more accurate for P999 in practice.
+	KLL
+
+	// CKMS tracks only Config.Percentiles, each within its Config.TargetErrors
+	// (https://www.cs.rutgers.edu/~muthu/bquant.pdf). It uses much less memory
+	// than a 2,000-value reservoir, which matters with thousands of metrics,
+	// but percentiles not configured cannot be calculated.
+	CKMS
+)
+
+// Config represents Gauge and Histogram configuration.
 type Config struct {
 	// Percentiles to calculate for Gauge and Histogram snapshots. Values must
 	// be divided by 100, so the 99th percentile is 0.99. If the list is nil or
 	// empty, no percentiles are calculated.
 	Percentiles []float64
+
+	// Estimator is the algorithm used to estimate percentiles. The zero value
+	// is Reservoir.
+	Estimator Estimator
+
+	// SampleSize is the number of values in the Reservoir sample. If zero, it
+	// is 2,000, which is best for most applications. Other estimators ignore
+	// this field.
+	SampleSize int
+
+	// TargetErrors is the allowed rank error for each of Percentiles when
+	// Estimator is CKMS; it is ignored otherwise. For example, {0.99: 0.001}
+	// means P99 is between P98.9 and P99.1. A percentile not in the map has
+	// target error min(p, 1-p) / 10, so 0.001 for P99 and 0.0001 for P999.
+	TargetErrors map[float64]float64
+
+	// Thresholds for Histogram snapshots to count values less than or equal to,
+	// like 0.1 and 0.5 for 100ms and 500ms latency SLOs. Counts are exact: they
+	// are computed from all values recorded, not the sample. So a Histogram with
+	// thresholds is both a latency histogram and exact SLA counters: see
+	// Snapshot.Under and Snapshot.Over. If the list is nil or empty, no values
+	// are counted. Gauge ignores this field.
+	Thresholds []float64
+
+	// QueueSize makes Histogram.Record asynchronous if greater than zero:
+	// Record pushes the value into a lock-free queue of this size (rounded up
+	// to a power of two) and returns without locking the histogram. A background
+	// goroutine records queued values every 10ms, and Snapshot records all
+	// queued values first. If the queue is full, the value is dropped and
+	// counted in Snapshot.Dropped. Call Histogram.Close to stop the goroutine.
+	// Use this only for ultra-hot paths; else, the default (zero) is better.
+	// Gauge ignores this field.
+	QueueSize int
+
+	// RecordEvery makes Histogram.Record lock the histogram and record only
+	// every Nth value if greater than one. The other values are only counted
+	// with atomic operations, so N, Sum, and SumOfSquares (and so the mean and
+	// variance) are exact, but Min, Max, and percentiles are from the recorded
+	// values, and Threshold counts are estimates: the counts of the recorded
+	// values scaled by N / values recorded. Values not recorded are not
+	// checked or transformed by the Config filters. Use this only for paths
+	// so hot that a lock per value is too expensive; else, the default (zero)
+	// is better. It applies to RecordExemplar and LocalHistogram too. Gauge
+	// and Group ignore this field.
+	RecordEvery int
+
+	// RecordProbability makes Histogram.Record lock the histogram and record
+	// each value with this probability, like 0.01 for 1%, if less than one.
+	// The other values are not counted at all, so it costs less than
+	// RecordEvery, but all counts are estimates: Snapshot N, Sum,
+	// SumOfSquares, Threshold counts, Dropped, Invalid, and Rejected are
+	// scaled by 1/RecordProbability. The mean and variance are not changed by
+	// the scaling, so they are unbiased estimates too. Use this for events so
+	// frequent that an approximate count is enough, like per-packet sizes. It
+	// is ignored if RecordEvery is set. Gauge and Group ignore this field.
+	RecordProbability float64
+
+	// RecordTarget makes Histogram.Record record values with a probability
+	// that adapts to the volume, like RecordProbability, so that about this
+	// many values are recorded per interval (between snapshots with reset).
+	// The probability for each interval is RecordTarget divided by the
+	// (estimated) number of values in the previous interval, or 1 if fewer,
+	// so the cost of recording stays bounded as volume grows. It is reported
+	// in Snapshot.SampleRate, and counts are scaled like RecordProbability.
+	// It is ignored if RecordEvery or RecordProbability is set. Gauge and
+	// Group ignore this field.
+	RecordTarget int
+
+	// ReusePercentileMap makes Gauge and Histogram snapshots reuse the same
+	// Percentile map instead of allocating a new map for each snapshot. The
+	// caller does not own the map: the next Snapshot overwrites it, so copy
+	// any values needed before then, and do not modify or retain the map. Use
+	// this only if the per-snapshot map allocation matters (it shows up in
+	// profiles of services with many metrics); else, the default (false) is safer.
+	ReusePercentileMap bool
+
+	// SlowThreshold makes Histogram.RecordContext log a runtime/trace event
+	// in category "metrics.slow" for values greater than or equal to it, like
+	// 0.5 for latencies over 500ms. In an execution trace (go tool trace), the
+	// event is attached to the context's task, so the slow requests that make
+	// P999 can be found and inspected. If zero, no events are logged.
+	SlowThreshold float64
+
+	// Transform is called with each value recorded by Gauge.Record and
+	// Histogram, before the value is sampled. It returns the value to record,
+	// or false to drop the value: for example, to convert units, clamp, or
+	// drop warm-up values. It is called with the metric locked, so it must be
+	// fast and must not use the metric. Gauge.Add values are not transformed
+	// because they are relative to the last value. If nil, values are recorded
+	// as is.
+	Transform func(v float64) (float64, bool)
+
+	// MinValue and MaxValue are the range of valid values recorded by
+	// Gauge.Record and Histogram, inclusive. Invalid values, including NaN,
+	// are dropped (or clamped, see ClampInvalid) and counted in
+	// Snapshot.Invalid. This protects percentiles from sentinel values like
+	// -1 or math.MaxFloat64 recorded by buggy callers. Values are checked
+	// before Config.Transform. The range is checked only if MinValue is less
+	// than MaxValue, so the zero values disable it. To check only one bound,
+	// set the other to math.Inf.
+	MinValue float64
+	MaxValue float64
+
+	// ClampInvalid records invalid values as MinValue or MaxValue, whichever
+	// is nearer, instead of dropping them. NaN is always dropped.
+	ClampInvalid bool
+
+	// OutlierStdDevs and OutlierMaxDeviation make Gauge.Record and Histogram
+	// drop outliers: values more than OutlierStdDevs standard deviations, or
+	// more than OutlierMaxDeviation, from the running mean. Outliers are counted
+	// in Snapshot.Rejected. The running mean and standard deviation are
+	// exponentially weighted over about the last 100 values, and they are not
+	// reset by Snapshot. No values are rejected until 100 values have been
+	// recorded. Use this only for robust percentiles despite rare bogus values,
+	// like latencies from client clock jumps: it also drops real spikes.
+	// If zero, the check is disabled.
+	OutlierStdDevs      float64
+	OutlierMaxDeviation float64
+
+	// LastDelta makes Gauge snapshots report Snapshot.LastDelta. Histogram
+	// ignores this field.
+	LastDelta bool
+
+	// LogScale makes the estimator sample the logarithm of values, and
+	// percentiles are transformed back. Use it for heavily skewed values that
+	// span many orders of magnitude, like object sizes from bytes to gigabytes:
+	// interpolated percentiles are geometric, so they are not pulled toward the
+	// large values. Values must be greater than or equal to zero; negative
+	// values are sampled as zero. N, Sum, SumOfSquares, Min, and Max are exact
+	// and not affected. Merge is not supported.
+	LogScale bool
 }
 
 // A Metric generates a Snapshot of its current values. If reset is true, all
@@ -68,9 +228,15 @@ type Snapshot struct {
 	// average: Sum / N.
 	Sum float64
 
-	// Min is the minimum sample value. It might not be the true minimum value.
-	// For Counter, this is always zero. For Gauge and Histogram, it is the
-	// minimum value in the sample.
+	// SumOfSquares is the sum of all values squared (Σx²). For Counter, this is
+	// always zero. For Gauge and Histogram, it is used to calculate Variance.
+	// Unlike variance, it can be summed (like N and Sum) across snapshots from
+	// multiple instances, so the variance of the merged snapshots is exact.
+	SumOfSquares float64
+
+	// Min is the true minimum value. For Counter, this is always zero.
+	// For Gauge and Histogram, it is the true minimum value which might not
+	// be present in the sample but was recorded.
 	Min float64
 
 	// Max is the true maximum value. For Counter, this is always zero.
@@ -85,6 +251,241 @@ type Snapshot struct {
 	// Last is the last value recorded (or added) to a Gauge. This is the value
 	// returned by Last(). For Counter and Histogram, it is always zero.
 	Last float64
+
+	// Threshold is the number of values less than or equal to each
+	// Config.Thresholds. For Counter and Gauge, the map is always nil.
+	Threshold map[float64]int64
+
+	// LastDelta is the change of Last since the previous Gauge snapshot with
+	// reset, like memory growth per interval, if Config.LastDelta is true.
+	// It is zero if no values were recorded (or added) since the last reset,
+	// or if there is no previous snapshot with values. For Counter and
+	// Histogram, it is always zero.
+	LastDelta float64
+
+	// Dropped is the number of values not recorded because the Config.QueueSize
+	// queue was full. For Counter and Gauge, it is always zero.
+	Dropped int64
+
+	// Invalid is the number of values outside Config.MinValue and MaxValue.
+	// They were dropped or, if Config.ClampInvalid, clamped and recorded.
+	// For Counter, it is always zero.
+	Invalid int64
+
+	// Rejected is the number of outliers dropped because of
+	// Config.OutlierStdDevs or OutlierMaxDeviation. For Counter, it is
+	// always zero.
+	Rejected int64
+
+	// SampleRate is the fraction of values recorded by a Histogram with
+	// Config.RecordEvery (1/RecordEvery), RecordProbability, or RecordTarget
+	// (the probability for the interval). Divide by it to scale a count of
+	// recorded values to all values. It is zero if every value is recorded.
+	SampleRate float64
+
+	// Exemplars are a sample of values recorded with Histogram.RecordExemplar,
+	// a few per Thresholds bucket or percentile region, sorted by Value. The
+	// exemplar with the max value is always included. For Counter and Gauge,
+	// it is always nil.
+	Exemplars []Exemplar
+}
+
+// Exemplar is a value recorded with a small payload, like a trace ID, to link
+// a metric value to the request that produced it.
+type Exemplar struct {
+	Value float64
+	Label string
+	Time  time.Time
+}
+
+// exemplarsPerRegion is the number of exemplars sampled per region, not
+// counting the max-value exemplar which is always kept.
+const exemplarsPerRegion = 2
+
+// Exemplar returns the exemplar with the value closest to Percentile[p], or
+// false if there are no exemplars or p is not a configured percentile. For
+// example, Exemplar(0.999) links a P999 spike to a trace.
+func (s Snapshot) Exemplar(p float64) (Exemplar, bool) {
+	v, ok := s.Percentile[p]
+	if !ok || len(s.Exemplars) == 0 {
+		return Exemplar{}, false
+	}
+	i := sort.Search(len(s.Exemplars), func(i int) bool { return s.Exemplars[i].Value >= v })
+	switch {
+	case i == len(s.Exemplars):
+		i--
+	case i > 0 && v-s.Exemplars[i-1].Value < s.Exemplars[i].Value-v:
+		i--
+	}
+	return s.Exemplars[i], true
+}
+
+// Under returns the exact number of values less than or equal to threshold,
+// or false if threshold is not one of Config.Thresholds. With Over, this is
+// an SLA numerator: for example, Under(0.5) requests were served within 500ms.
+func (s Snapshot) Under(threshold float64) (int64, bool) {
+	n, ok := s.Threshold[threshold]
+	return n, ok
+}
+
+// Over returns the exact number of values greater than threshold, or false if
+// threshold is not one of Config.Thresholds.
+func (s Snapshot) Over(threshold float64) (int64, bool) {
+	n, ok := s.Threshold[threshold]
+	if !ok {
+		return 0, false
+	}
+	return s.N - n, true
+}
+
+// Spread returns Percentile[hi] - Percentile[lo], or false if either is not
+// a configured percentile. It is a measure of spread that can be alerted on
+// directly, without cross-series math in the backend.
+func (s Snapshot) Spread(lo, hi float64) (float64, bool) {
+	vlo, ok := s.Percentile[lo]
+	if !ok {
+		return 0, false
+	}
+	vhi, ok := s.Percentile[hi]
+	if !ok {
+		return 0, false
+	}
+	return vhi - vlo, true
+}
+
+// IQR returns the interquartile range: Spread(0.25, 0.75).
+func (s Snapshot) IQR() (float64, bool) {
+	return s.Spread(0.25, 0.75)
+}
+
+// TailSpread returns Spread(0.50, 0.99). It increases when the tail diverges
+// from the median, even if the median does not change.
+func (s Snapshot) TailSpread() (float64, bool) {
+	return s.Spread(0.50, 0.99)
+}
+
+// Bucket is a cumulative histogram bucket: the number of values less than or
+// equal to UpperBound.
+type Bucket struct {
+	UpperBound float64
+	Count      int64
+}
+
+// CumulativeBuckets returns Threshold as Prometheus-style "le" buckets sorted
+// by UpperBound, plus a final +Inf bucket with Count = N. It returns nil if
+// Threshold is nil.
+func (s Snapshot) CumulativeBuckets() []Bucket {
+	if s.Threshold == nil {
+		return nil
+	}
+	buckets := make([]Bucket, 0, len(s.Threshold)+1)
+	for t, n := range s.Threshold {
+		buckets = append(buckets, Bucket{UpperBound: t, Count: n})
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].UpperBound < buckets[j].UpperBound })
+	return append(buckets, Bucket{UpperBound: math.Inf(1), Count: s.N})
+}
+
+// SubtractBuckets returns CumulativeBuckets of only the values recorded
+// between prev and s, two snapshots without reset of the same histogram. It
+// lets a histogram that is never reset be exported both cumulatively (s) and
+// per interval. Buckets not in prev are subtracted from zero. If any count in
+// s is less than in prev, the histogram was reset (or the program restarted)
+// since prev, so it returns s.CumulativeBuckets(). It returns nil if
+// Threshold is nil.
+func (s Snapshot) SubtractBuckets(prev Snapshot) []Bucket {
+	buckets := s.CumulativeBuckets()
+	if buckets == nil {
+		return nil
+	}
+	interval := make([]Bucket, len(buckets))
+	for i, b := range buckets {
+		n := prev.N // +Inf bucket
+		if i < len(buckets)-1 {
+			n = prev.Threshold[b.UpperBound]
+		}
+		if b.Count < n {
+			return buckets
+		}
+		interval[i] = Bucket{UpperBound: b.UpperBound, Count: b.Count - n}
+	}
+	return interval
+}
+
+// PercentileValue is a percentile and its value, like {0.99, 1.5} for P99.
+type PercentileValue struct {
+	Percentile float64
+	Value      float64
+}
+
+// SortedPercentiles returns Percentile sorted by Percentile. Unlike ranging
+// over the map, the order is deterministic, so use it to serialize, log, or
+// compare percentiles. It returns nil if Percentile is nil.
+func (s Snapshot) SortedPercentiles() []PercentileValue {
+	if s.Percentile == nil {
+		return nil
+	}
+	percentiles := make([]PercentileValue, 0, len(s.Percentile))
+	for p, v := range s.Percentile {
+		percentiles = append(percentiles, PercentileValue{Percentile: p, Value: v})
+	}
+	sort.Slice(percentiles, func(i, j int) bool { return percentiles[i].Percentile < percentiles[j].Percentile })
+	return percentiles
+}
+
+// Scale returns a copy of the snapshot with all values multiplied by factor:
+// Sum, Min, Max, Percentile values, Last, LastDelta, Threshold keys, and
+// Exemplar values. SumOfSquares is multiplied by factor squared. N and
+// Threshold counts are not scaled. For example, if values are recorded in
+// nanoseconds, Scale(1e-6) returns the snapshot in milliseconds.
+func (s Snapshot) Scale(factor float64) Snapshot {
+	scaled := s
+	scaled.Sum *= factor
+	scaled.SumOfSquares *= factor * factor
+	scaled.Min *= factor
+	scaled.Max *= factor
+	scaled.Last *= factor
+	scaled.LastDelta *= factor
+	if s.Percentile != nil {
+		scaled.Percentile = make(map[float64]float64, len(s.Percentile))
+		for p, v := range s.Percentile {
+			scaled.Percentile[p] = v * factor
+		}
+	}
+	if s.Threshold != nil {
+		scaled.Threshold = make(map[float64]int64, len(s.Threshold))
+		for t, n := range s.Threshold {
+			scaled.Threshold[t*factor] = n
+		}
+	}
+	if s.Exemplars != nil {
+		scaled.Exemplars = make([]Exemplar, len(s.Exemplars))
+		for i, e := range s.Exemplars {
+			e.Value *= factor
+			scaled.Exemplars[i] = e
+		}
+	}
+	return scaled
+}
+
+// Variance returns the population variance of all values: SumOfSquares / N
+// minus the squared average. It returns zero if N is zero.
+func (s Snapshot) Variance() float64 {
+	if s.N == 0 {
+		return 0
+	}
+	n := float64(s.N)
+	avg := s.Sum / n
+	v := s.SumOfSquares/n - avg*avg
+	if v < 0 {
+		return 0 // floating-point error when all values are (nearly) equal
+	}
+	return v
+}
+
+// StdDev returns the population standard deviation: the square root of Variance.
+func (s Snapshot) StdDev() float64 {
+	return math.Sqrt(s.Variance())
 }
 
 // --------------------------------------------------------------------------
@@ -127,6 +528,108 @@ func (c *Counter) Snapshot(reset bool) Snapshot {
 	return snapshot
 }
 
+// --------------------------------------------------------------------------
+// FloatCounter
+// --------------------------------------------------------------------------
+
+// FloatCounter counts fractional things, like megabytes, dollars, and seconds
+// of CPU time. It is identical to Counter except Add takes a float64 delta.
+type FloatCounter struct {
+	*sync.Mutex
+	n   int64
+	sum uint64 // math.Float64bits
+}
+
+func NewFloatCounter() *FloatCounter {
+	return &FloatCounter{
+		Mutex: &sync.Mutex{},
+	}
+}
+
+func (c *FloatCounter) Add(delta float64) {
+	atomic.AddInt64(&c.n, 1)
+	addFloat64(&c.sum, delta)
+}
+
+func (c *FloatCounter) Count() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&c.sum))
+}
+
+func (c *FloatCounter) Snapshot(reset bool) Snapshot {
+	c.Lock()
+	var snapshot Snapshot
+	if reset {
+		snapshot.N = atomic.SwapInt64(&c.n, 0)
+		snapshot.Sum = math.Float64frombits(atomic.SwapUint64(&c.sum, 0))
+	} else {
+		snapshot.N = atomic.LoadInt64(&c.n)
+		snapshot.Sum = math.Float64frombits(atomic.LoadUint64(&c.sum))
+	}
+	c.Unlock()
+	return snapshot
+}
+
+// --------------------------------------------------------------------------
+// MonotonicCounter
+// --------------------------------------------------------------------------
+
+// MonotonicCounter is a Counter fed by absolute cumulative readings from a
+// source, like values read from /proc or a device. Set computes the delta from
+// the previous reading and adds it to the counter. The first reading is the
+// baseline, so it does not add to the counter.
+//
+// If a reading is less than the previous reading, either the source wrapped
+// around or it was reset (restarted from zero). If max is nonzero, the source
+// can wrap around after max (for example, math.MaxUint32 for a 32-bit source),
+// so the delta is the distance to max plus the new reading, unless that is
+// more than half of max: a source does not advance that much between readings,
+// so it is presumed reset. If the source is reset (or max is zero), the delta
+// is the new reading.
+type MonotonicCounter struct {
+	*sync.Mutex
+	c      *Counter
+	max    uint64
+	prev   uint64
+	primed bool
+}
+
+func NewMonotonicCounter(max uint64) *MonotonicCounter {
+	return &MonotonicCounter{
+		Mutex: &sync.Mutex{},
+		c:     NewCounter(),
+		max:   max,
+	}
+}
+
+func (m *MonotonicCounter) Set(total uint64) {
+	m.Lock()
+	defer m.Unlock()
+	if !m.primed {
+		m.prev = total
+		m.primed = true
+		return
+	}
+	var delta uint64
+	switch {
+	case total >= m.prev:
+		delta = total - m.prev
+	case m.max > 0 && m.prev <= m.max && (m.max-m.prev)+total < m.max/2:
+		delta = (m.max - m.prev) + total + 1 // wraparound
+	default:
+		delta = total // reset
+	}
+	m.prev = total
+	m.c.Add(int64(delta))
+}
+
+func (m *MonotonicCounter) Count() int64 {
+	return m.c.Count()
+}
+
+func (m *MonotonicCounter) Snapshot(reset bool) Snapshot {
+	return m.c.Snapshot(reset)
+}
+
 // --------------------------------------------------------------------------
 // Gauge
 // --------------------------------------------------------------------------
@@ -135,49 +638,209 @@ func (c *Counter) Snapshot(reset bool) Snapshot {
 type Gauge struct {
 	percentiles []float64
 	*sync.Mutex
-	resv *randomSample
-	last float64
+	snapshotMu sync.Mutex // serializes Snapshot
+	resv       sample
+	last       uint64              // math.Float64bits; written with lock, read atomically
+	scores     map[float64]float64 // Config.ReusePercentileMap
+	reconfig   *Config             // Reconfigure, applied on reset
+	filter     *valueFilter        // nil if values are recorded as is
+	primed     *primed             // Prime, until reset
+
+	// Config.LastDelta
+	lastDelta bool
+	recorded  bool    // since last reset
+	prevLast  float64 // Last of previous reset snapshot with values
+	hasPrev   bool
 }
 
 func NewGauge(cfg Config) *Gauge {
-	return &Gauge{
+	g := &Gauge{
 		percentiles: cfg.Percentiles,
 		Mutex:       &sync.Mutex{},
-		resv:        newRandomSample(defaultSampleSize),
+		resv:        newSample(cfg),
+		filter:      newValueFilter(cfg),
+		lastDelta:   cfg.LastDelta,
+	}
+	if cfg.ReusePercentileMap {
+		g.scores = make(map[float64]float64, len(cfg.Percentiles))
 	}
+	return g
 }
 
 func (g *Gauge) Record(v float64) {
 	g.Lock()
-	g.last = v
-	g.resv.record(g.last)
+	if g.filter != nil {
+		var ok bool
+		if v, ok = g.filter.apply(v); !ok {
+			g.Unlock()
+			return
+		}
+	}
+	atomic.StoreUint64(&g.last, math.Float64bits(v))
+	g.recorded = true
+	g.resv.record(v)
+	g.primed.record(v)
 	g.Unlock()
 }
 
 func (g *Gauge) Add(delta int64) {
 	g.Lock()
-	g.last += float64(delta)
-	g.resv.record(g.last)
+	v := math.Float64frombits(g.last) + float64(delta)
+	atomic.StoreUint64(&g.last, math.Float64bits(v))
+	g.recorded = true
+	g.resv.record(v)
+	g.primed.record(v)
 	g.Unlock()
 }
 
+// Last returns the last value recorded (or added). It does not lock the gauge,
+// so polling Last at high frequency does not block Record or Add.
 func (g *Gauge) Last() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&g.last))
+}
+
+// Snapshot returns a snapshot of the gauge. If reset is true, the sample is
+// swapped out, so sorting and calculating percentiles do not block Record or Add.
+func (g *Gauge) Snapshot(reset bool) Snapshot {
+	return g.snapshot(reset, false, nil)
+}
+
+// SnapshotCounts returns a snapshot of the gauge without percentiles, so it
+// does not copy or sort the sample. Use it to poll N, Sum, Min, Max, and Last
+// frequently, like for a health check. If reset is true, all values are reset,
+// like Snapshot, so percentiles of the interval are lost. Unlike Snapshot, it
+// does not change a reused Config.ReusePercentileMap map.
+func (g *Gauge) SnapshotCounts(reset bool) Snapshot {
+	return g.snapshot(reset, true, nil)
+}
+
+// snapshot returns a snapshot of the gauge, without percentiles if countsOnly
+// is true. If locked is not nil, it is called while the lock is held.
+func (g *Gauge) snapshot(reset, countsOnly bool, locked func()) Snapshot {
+	g.snapshotMu.Lock()
+	defer g.snapshotMu.Unlock()
+
 	g.Lock()
-	last := g.last
+	if locked != nil {
+		locked()
+	}
+	snapshot := Snapshot{
+		Last: math.Float64frombits(g.last),
+	}
+	g.filter.counts(&snapshot, reset)
+	if g.lastDelta && g.recorded && g.hasPrev {
+		snapshot.LastDelta = snapshot.Last - g.prevLast
+	}
+	primed := g.primed
+	percentiles, scores := g.percentiles, g.scores
+	if countsOnly {
+		percentiles, scores = nil, nil
+	} else if percentiles == nil {
+		percentiles = noPercentiles
+	}
+	if !reset {
+		g.resv.snapshot(&snapshot, percentiles, scores, false)
+		primed.counts(&snapshot)
+		g.Unlock()
+		return snapshot
+	}
+	resv := g.resv.take()
+	g.primed = nil
+	atomic.StoreUint64(&g.last, 0)
+	if g.recorded {
+		g.prevLast, g.hasPrev = snapshot.Last, true
+		g.recorded = false
+	}
+	if g.reconfig != nil {
+		g.percentiles = g.reconfig.Percentiles
+		g.resv = newSample(*g.reconfig)
+		g.reconfig = nil
+	}
 	g.Unlock()
-	return last
+
+	resv.snapshot(&snapshot, percentiles, scores, true)
+	primed.counts(&snapshot)
+	return snapshot
 }
 
-func (g *Gauge) Snapshot(reset bool) Snapshot {
+// Reconfigure changes the percentiles and sample at the next reset, so the
+// current interval is not mixed. Only Percentiles, Estimator, SampleSize,
+// TargetErrors, and LogScale are used; other Config fields are ignored. The
+// sample is replaced, so set LogScale again to keep it.
+func (g *Gauge) Reconfigure(cfg Config) {
 	g.Lock()
+	g.reconfig = &cfg
+	g.Unlock()
+}
+
+// --------------------------------------------------------------------------
+// Concurrency
+// --------------------------------------------------------------------------
+
+// Concurrency tracks in-flight operations, like active requests. Call Start
+// when an operation starts and Done when it's done, or call Track to do both.
+// Unlike Gauge.Add(1) and Gauge.Add(-1), the peak is tracked per interval, and
+// Track makes it impossible to forget the decrement.
+//
+// In its Snapshot, Last is the current number of in-flight operations, Max is
+// the peak number since the last reset, and N is the number of operations
+// started since the last reset. Reset does not change the current number
+// because those operations are still in flight: it becomes the new peak.
+type Concurrency struct {
+	*sync.Mutex
+	current int64
+	peak    int64
+	n       int64
+}
+
+func NewConcurrency() *Concurrency {
+	return &Concurrency{
+		Mutex: &sync.Mutex{},
+	}
+}
+
+func (c *Concurrency) Start() {
+	c.Lock()
+	c.current++
+	c.n++
+	if c.current > c.peak {
+		c.peak = c.current
+	}
+	c.Unlock()
+}
+
+func (c *Concurrency) Done() {
+	c.Lock()
+	c.current--
+	c.Unlock()
+}
+
+// Track calls Start, fn, and Done, even if fn panics.
+func (c *Concurrency) Track(fn func()) {
+	c.Start()
+	defer c.Done()
+	fn()
+}
+
+// InFlight returns the current number of in-flight operations.
+func (c *Concurrency) InFlight() int64 {
+	c.Lock()
+	defer c.Unlock()
+	return c.current
+}
+
+func (c *Concurrency) Snapshot(reset bool) Snapshot {
+	c.Lock()
 	snapshot := Snapshot{
-		Last: g.last,
+		N:    c.n,
+		Max:  float64(c.peak),
+		Last: float64(c.current),
 	}
-	finalizeSnapshot(&snapshot, g.resv, g.percentiles, reset)
 	if reset {
-		g.last = 0
+		c.n = 0
+		c.peak = c.current
 	}
-	g.Unlock()
+	c.Unlock()
 	return snapshot
 }
 
@@ -188,55 +851,573 @@ func (g *Gauge) Snapshot(reset bool) Snapshot {
 // Histogram summarizes a sample of many values.
 type Histogram struct {
 	percentiles []float64
+	thresholds  []float64 // sorted
 	*sync.Mutex
-	resv *randomSample
+	snapshotMu  sync.Mutex // serializes Snapshot
+	resv        sample
+	counts      []int64             // counts[i] = values in (thresholds[i-1], thresholds[i]]
+	takenCounts []int64             // counts swapped out by Snapshot
+	scores      map[float64]float64 // Config.ReusePercentileMap
+	reconfig    *Config             // Reconfigure, applied on reset
+	filter      *valueFilter        // nil if values are recorded as is
+	down        *downsampler        // nil if all values are recorded
+	primed      *primed             // Prime, until reset
+
+	slow float64 // Config.SlowThreshold
+
+	// RecordExemplar
+	exemplars      [][]keyedExemplar // sample per region
+	exemplarBounds []float64         // region upper bounds, see addExemplar
+	exemplarN      int64
+	maxExemplar    *Exemplar
+
+	// Config.QueueSize > 0
+	queue   *recordQueue
+	dropped int64
+	stop    chan struct{}
+	stopped sync.Once
 }
 
 func NewHistogram(cfg Config) *Histogram {
-	return &Histogram{
+	h := &Histogram{
 		percentiles: cfg.Percentiles,
 		Mutex:       &sync.Mutex{},
-		resv:        newRandomSample(defaultSampleSize),
+		resv:        newSample(cfg),
+		filter:      newValueFilter(cfg),
+		down:        newDownsampler(cfg),
+		slow:        cfg.SlowThreshold,
+	}
+	if len(cfg.Thresholds) > 0 {
+		h.thresholds = make([]float64, len(cfg.Thresholds))
+		copy(h.thresholds, cfg.Thresholds)
+		sort.Float64s(h.thresholds)
+		h.counts = make([]int64, len(h.thresholds))
+		h.takenCounts = make([]int64, len(h.thresholds))
+		h.exemplarBounds = h.thresholds
 	}
+	if cfg.ReusePercentileMap {
+		h.scores = make(map[float64]float64, len(cfg.Percentiles))
+	}
+	if cfg.QueueSize > 0 {
+		h.queue = newRecordQueue(cfg.QueueSize)
+		h.stop = make(chan struct{})
+		go h.drainQueue()
+	}
+	return h
 }
 
 func (h *Histogram) Record(v float64) {
+	if h.down != nil && h.down.skip(v) {
+		return
+	}
+	if h.queue != nil {
+		if !h.queue.push(v) {
+			atomic.AddInt64(&h.dropped, 1)
+		}
+		return
+	}
+	h.Lock()
+	h.record(v)
+	h.Unlock()
+}
+
+// RecordContext records v like Record. If v is greater than or equal to
+// Config.SlowThreshold and tracing is enabled, it logs a runtime/trace event
+// for the context. Call it from the goroutine handling the request so the
+// event is attributed to it.
+func (h *Histogram) RecordContext(ctx context.Context, v float64) {
+	h.Record(v)
+	if h.slow > 0 && v >= h.slow && trace.IsEnabled() {
+		trace.Log(ctx, "metrics.slow", strconv.FormatFloat(v, 'f', -1, 64))
+	}
+}
+
+// RecordExemplar records v like Record and keeps it as an exemplar with the
+// given label, like a trace or request ID. Only a few exemplars are kept for
+// each snapshot: a uniform sample of each Thresholds bucket or, if there are
+// no thresholds, of each region between the percentiles of the last reset
+// snapshot, plus the exemplar with the max value. So there are exemplars near
+// every percentile, including tail percentiles like P999, but not until the
+// second interval if there are no thresholds. It always locks the histogram,
+// even if Config.QueueSize > 0.
+func (h *Histogram) RecordExemplar(v float64, label string) {
+	if h.down != nil && h.down.skip(v) {
+		return
+	}
+	e := Exemplar{Label: label, Time: time.Now()}
+	var ok bool
+	h.Lock()
+	if e.Value, ok = h.record(v); !ok {
+		h.Unlock()
+		return
+	}
+	h.addExemplar(e)
+	h.Unlock()
+}
+
+// keyedExemplar is an exemplar with a random key. The exemplars with the
+// largest keys in a region are a uniform sample of the region, and two samples
+// are merged, weighted by their counts, by keeping the largest keys of both.
+type keyedExemplar struct {
+	Exemplar
+	key float64
+}
+
+// addExemplar adds e to the exemplar sample. The caller must hold the lock.
+func (h *Histogram) addExemplar(e Exemplar) {
+	h.exemplarN++
+	h.keepExemplar(keyedExemplar{Exemplar: e, key: rand.Float64()})
+	if h.maxExemplar == nil || e.Value > h.maxExemplar.Value {
+		h.maxExemplar = &e
+	}
+}
+
+// keepExemplar keeps e if its key is one of the largest in its region. Region
+// i is values in (exemplarBounds[i-1], exemplarBounds[i]], like Threshold
+// counts, and the last region is values greater than the last bound. The
+// caller must hold the lock.
+func (h *Histogram) keepExemplar(e keyedExemplar) {
+	if h.exemplars == nil {
+		h.exemplars = make([][]keyedExemplar, len(h.exemplarBounds)+1)
+	}
+	r := sort.SearchFloat64s(h.exemplarBounds, e.Value)
+	region := h.exemplars[r]
+	if len(region) < exemplarsPerRegion {
+		h.exemplars[r] = append(region, e)
+		return
+	}
+	min := 0
+	for i := range region {
+		if region[i].key < region[min].key {
+			min = i
+		}
+	}
+	if e.key > region[min].key {
+		region[min] = e
+	}
+}
+
+// keyedExemplars returns a copy of the exemplars in all regions. The caller
+// must hold the lock.
+func (h *Histogram) keyedExemplars() []keyedExemplar {
+	var exemplars []keyedExemplar
+	for _, region := range h.exemplars {
+		exemplars = append(exemplars, region...)
+	}
+	return exemplars
+}
+
+// setExemplarPercentiles sets the exemplar regions to the regions between
+// percentile values p, if the histogram has no thresholds. The exemplars
+// already kept are moved to the new regions.
+func (h *Histogram) setExemplarPercentiles(p map[float64]float64) {
+	if h.thresholds != nil || len(p) == 0 {
+		return
+	}
+	bounds := make([]float64, 0, len(p))
+	for _, v := range p {
+		if !math.IsNaN(v) {
+			bounds = append(bounds, v)
+		}
+	}
+	sort.Float64s(bounds)
 	h.Lock()
+	defer h.Unlock()
+	if equalFloat64s(bounds, h.exemplarBounds) {
+		return
+	}
+	exemplars := h.keyedExemplars()
+	h.exemplarBounds = bounds
+	h.exemplars = nil
+	for _, e := range exemplars {
+		h.keepExemplar(e)
+	}
+}
+
+// snapshotExemplars returns the exemplars, sorted by value, and resets them
+// if reset is true. The caller must hold the lock.
+func (h *Histogram) snapshotExemplars(reset bool) []Exemplar {
+	if h.exemplarN == 0 {
+		return nil
+	}
+	exemplars := make([]Exemplar, 0, len(h.exemplars)*exemplarsPerRegion+1)
+	addMax := true
+	for _, region := range h.exemplars {
+		for _, e := range region {
+			exemplars = append(exemplars, e.Exemplar)
+			if e.Exemplar == *h.maxExemplar {
+				addMax = false // already in sample
+			}
+		}
+	}
+	if addMax {
+		exemplars = append(exemplars, *h.maxExemplar)
+	}
+	sort.Slice(exemplars, func(i, j int) bool { return exemplars[i].Value < exemplars[j].Value })
+	if reset {
+		for i := range h.exemplars {
+			h.exemplars[i] = h.exemplars[i][:0]
+		}
+		h.exemplarN = 0
+		h.maxExemplar = nil
+	}
+	return exemplars
+}
+
+// record records v and returns the value recorded, or false if v was dropped
+// by the filter. The caller must hold the lock.
+func (h *Histogram) record(v float64) (float64, bool) {
+	if h.filter != nil {
+		var ok bool
+		if v, ok = h.filter.apply(v); !ok {
+			return v, false
+		}
+	}
 	h.resv.record(v)
+	h.primed.record(v)
+	if h.counts != nil {
+		if i := sort.SearchFloat64s(h.thresholds, v); i < len(h.counts) {
+			h.counts[i]++
+		}
+	}
+	return v, true
+}
+
+// LocalHistogram buffers values for one goroutine and records them into its
+// Histogram in batches. It is not safe for use by multiple goroutines.
+type LocalHistogram struct {
+	h        *Histogram
+	buf      []float64
+	interval time.Duration
+	flushed  time.Time
+}
+
+// Local returns a LocalHistogram that records values into h every size values
+// or every interval (checked on Record), whichever is first. This trades a
+// little staleness for near-zero lock contention: Snapshot does not include
+// buffered values until they are flushed. Each goroutine should have its own
+// LocalHistogram, and call Flush before exiting.
+func (h *Histogram) Local(size int, interval time.Duration) *LocalHistogram {
+	if size < 1 {
+		size = 1
+	}
+	return &LocalHistogram{
+		h:        h,
+		buf:      make([]float64, 0, size),
+		interval: interval,
+		flushed:  time.Now(),
+	}
+}
+
+func (l *LocalHistogram) Record(v float64) {
+	l.buf = append(l.buf, v)
+	if len(l.buf) == cap(l.buf) || (l.interval > 0 && time.Since(l.flushed) >= l.interval) {
+		l.Flush()
+	}
+}
+
+// Flush records all buffered values into the Histogram.
+func (l *LocalHistogram) Flush() {
+	l.flushed = time.Now()
+	if len(l.buf) == 0 {
+		return
+	}
+	l.h.Lock()
+	for _, v := range l.buf {
+		if l.h.down != nil && l.h.down.skip(v) {
+			continue
+		}
+		l.h.record(v)
+	}
+	l.h.Unlock()
+	l.buf = l.buf[:0]
+}
+
+// Close stops the background goroutine started if Config.QueueSize > 0, and
+// records all queued values. Values recorded after Close are queued but not
+// recorded until the next Snapshot. Close does nothing if Config.QueueSize = 0.
+func (h *Histogram) Close() {
+	if h.queue == nil {
+		return
+	}
+	h.stopped.Do(func() { close(h.stop) })
+	h.Lock()
+	h.drain()
 	h.Unlock()
 }
 
+func (h *Histogram) drainQueue() {
+	t := time.NewTicker(10 * time.Millisecond)
+	defer t.Stop()
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-t.C:
+		}
+		h.Lock()
+		h.drain()
+		h.Unlock()
+	}
+}
+
+// drain records all queued values. The caller must hold the lock.
+func (h *Histogram) drain() {
+	if h.queue == nil {
+		return
+	}
+	for {
+		v, ok := h.queue.pop()
+		if !ok {
+			return
+		}
+		h.record(v)
+	}
+}
+
+// Snapshot returns a snapshot of the histogram. If reset is true, the sample
+// is swapped out, so sorting and calculating percentiles do not block Record.
 func (h *Histogram) Snapshot(reset bool) Snapshot {
+	return h.snapshot(reset, false, nil)
+}
+
+// SnapshotCounts returns a snapshot of the histogram without percentiles, like
+// Gauge.SnapshotCounts. Threshold counts and exemplars are included.
+func (h *Histogram) SnapshotCounts(reset bool) Snapshot {
+	return h.snapshot(reset, true, nil)
+}
+
+// snapshot returns a snapshot of the histogram, without percentiles if
+// countsOnly is true. If locked is not nil, it is called while the lock is
+// held, so a caller sharing the lock can snapshot other values consistently
+// with the histogram.
+func (h *Histogram) snapshot(reset, countsOnly bool, locked func()) Snapshot {
+	h.snapshotMu.Lock()
+	defer h.snapshotMu.Unlock()
+
 	h.Lock()
+	h.drain()
+	if locked != nil {
+		locked()
+	}
 	snapshot := Snapshot{}
-	finalizeSnapshot(&snapshot, h.resv, h.percentiles, reset)
+	if h.queue != nil {
+		if reset {
+			snapshot.Dropped = atomic.SwapInt64(&h.dropped, 0)
+		} else {
+			snapshot.Dropped = atomic.LoadInt64(&h.dropped)
+		}
+	}
+	snapshot.Exemplars = h.snapshotExemplars(reset)
+	h.filter.counts(&snapshot, reset)
+	skipped := h.down.take(reset)
+	primed := h.primed
+	percentiles, scores := h.percentiles, h.scores
+	if countsOnly {
+		percentiles, scores = nil, nil
+	} else if percentiles == nil {
+		percentiles = noPercentiles
+	}
+	if !reset {
+		h.resv.snapshot(&snapshot, percentiles, scores, false)
+		primed.counts(&snapshot)
+		h.thresholdCounts(&snapshot, h.counts)
+		h.Unlock()
+		skipped.add(&snapshot)
+		return snapshot
+	}
+	resv := h.resv.take()
+	h.primed = nil
+	h.counts, h.takenCounts = h.takenCounts, h.counts
+	if h.reconfig != nil {
+		h.percentiles = h.reconfig.Percentiles
+		h.resv = newSample(*h.reconfig)
+		h.reconfig = nil
+	}
 	h.Unlock()
+
+	resv.snapshot(&snapshot, percentiles, scores, true)
+	if snapshot.Exemplars != nil {
+		h.setExemplarPercentiles(snapshot.Percentile)
+	}
+	primed.counts(&snapshot)
+	h.thresholdCounts(&snapshot, h.takenCounts)
+	for i := range h.takenCounts {
+		h.takenCounts[i] = 0
+	}
+	skipped.add(&snapshot)
+	h.down.adapt(snapshot.N)
 	return snapshot
 }
 
-func finalizeSnapshot(snapshot *Snapshot, resv *randomSample, p []float64, reset bool) {
-	if len(resv.values) == 0 {
-		return // reset then called again without any new values
+// Reconfigure changes the percentiles and sample at the next reset, so the
+// current interval is not mixed. Only Percentiles, Estimator, SampleSize,
+// TargetErrors, and LogScale are used; other Config fields are ignored. The
+// sample is replaced, so set LogScale again to keep it.
+func (h *Histogram) Reconfigure(cfg Config) {
+	h.Lock()
+	h.reconfig = &cfg
+	h.Unlock()
+}
+
+// thresholdCounts sets snapshot.Threshold from the per-threshold counts.
+func (h *Histogram) thresholdCounts(snapshot *Snapshot, counts []int64) {
+	if snapshot.N == 0 || counts == nil {
+		return
+	}
+	snapshot.Threshold = make(map[float64]int64, len(h.thresholds))
+	var n int64
+	for i, t := range h.thresholds {
+		n += counts[i]
+		snapshot.Threshold[t] = n
 	}
+}
 
-	snapshot.N = resv.n
-	snapshot.Sum = resv.sum
-	snapshot.Max = resv.max
+// Merge adds the values recorded by other to h, including queued values,
+// Threshold counts, and exemplars, which are sampled in proportion to the
+// number of exemplars recorded by each histogram. Both histograms must use the KLL estimator
+// because a random sample is not mergeable, and have the same Thresholds;
+// else, ErrNotMergeable is returned and neither histogram is changed. other
+// is not reset. Counts of values not recorded by other (Dropped, Invalid,
+// Rejected, and values not recorded because of Config.RecordEvery,
+// RecordProbability, or RecordTarget) are not merged, so histograms that
+// drop or downsample values should not be merged.
+//
+// other is copied and unlocked before h is locked, so a.Merge(b) and
+// b.Merge(a) can be called concurrently.
+func (h *Histogram) Merge(other *Histogram) error {
+	if h == other {
+		return ErrMergeSelf
+	}
+	other.Lock()
+	other.drain()
+	src, ok := other.resv.(*kllSketch)
+	if !ok {
+		other.Unlock()
+		return ErrNotMergeable
+	}
+	src = src.clone()
+	thresholds := other.thresholds
+	counts := append([]int64(nil), other.counts...)
+	exemplars := other.keyedExemplars()
+	exemplarN, maxExemplar := other.exemplarN, other.maxExemplar
+	other.Unlock()
 
-	// If reseting we can avoid the copy
-	var values []float64
-	if reset {
-		values = resv.values
-		sort.Float64s(values)
-		snapshot.Min = values[0]
-		resv.reset()
-	} else {
-		values = make([]float64, len(resv.values))
-		copy(values, resv.values)
-		sort.Float64s(values)
-		snapshot.Min = values[0]
+	h.Lock()
+	defer h.Unlock()
+	dst, ok := h.resv.(*kllSketch)
+	if !ok || !equalFloat64s(h.thresholds, thresholds) {
+		return ErrNotMergeable
+	}
+	dst.merge(src)
+	for i, n := range counts {
+		h.counts[i] += n
+	}
+	for _, e := range exemplars {
+		h.keepExemplar(e)
+	}
+	h.exemplarN += exemplarN
+	if maxExemplar != nil && (h.maxExemplar == nil || maxExemplar.Value > h.maxExemplar.Value) {
+		h.maxExemplar = maxExemplar
+	}
+	return nil
+}
+
+func equalFloat64s(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// --------------------------------------------------------------------------
+// Samples
+// --------------------------------------------------------------------------
+
+// sample is implemented by each Estimator. Callers must serialize access.
+// If scores is not nil, snapshot clears and reuses it for snapshot.Percentile.
+// If p is nil, snapshot sets only the counts, not snapshot.Percentile, so it
+// does not allocate; pass noPercentiles for an empty Percentile map.
+type sample interface {
+	record(v float64)
+	snapshot(snapshot *Snapshot, p []float64, scores map[float64]float64, reset bool)
+
+	// take returns the current sample and resets this sample without
+	// allocating a new one, so the returned sample can be sorted and its
+	// percentiles calculated without holding the metric lock.
+	take() sample
+
+	// quantiles returns a copy of the sample for View, so any percentile can
+	// be calculated without holding the metric lock.
+	quantiles() quantiles
+}
+
+// noPercentiles is p for sample.snapshot when there are no percentiles but the
+// snapshot has an empty Percentile map, unlike nil p for counts only.
+var noPercentiles = []float64{}
+
+// resetScores returns scores cleared for reuse, or a new map if scores is nil.
+// It returns nil if p is nil: only counts are requested.
+func resetScores(scores map[float64]float64, p []float64) map[float64]float64 {
+	if p == nil {
+		return nil
+	}
+	if scores == nil {
+		return map[float64]float64{}
+	}
+	for p := range scores {
+		delete(scores, p)
+	}
+	return scores
+}
+
+func newSample(cfg Config) sample {
+	var s sample
+	switch cfg.Estimator {
+	case KLL:
+		s = newKLLSketch(defaultKLLK)
+	case CKMS:
+		s = newCKMSStream(cfg.Percentiles, cfg.TargetErrors)
+	default:
+		if cfg.SampleSize > 0 {
+			s = newRandomSample(cfg.SampleSize)
+		} else {
+			s = newRandomSample(defaultSampleSize)
+		}
 	}
-	snapshot.Percentile = percentiles(p, values, resv.sampleSize)
+	if cfg.LogScale {
+		return newLogSample(s)
+	}
+	return s
+}
+
+// valuesPool reuses the temporary sorted values slices used by Snapshot, so
+// snapshotting many metrics every interval does not allocate a sample-size
+// slice per metric. Stored as *[]float64 to avoid allocating on Put.
+var valuesPool = sync.Pool{
+	New: func() interface{} {
+		v := make([]float64, 0, defaultSampleSize)
+		return &v
+	},
+}
+
+// getValues returns a zero-length slice with capacity >= size from valuesPool.
+func getValues(size int) []float64 {
+	v := *(valuesPool.Get().(*[]float64))
+	if cap(v) < size {
+		return make([]float64, 0, size)
+	}
+	return v[:0]
+}
+
+func putValues(v []float64) {
+	v = v[:0]
+	valuesPool.Put(&v)
 }
 
 // --------------------------------------------------------------------------
@@ -247,6 +1428,8 @@ type randomSample struct {
 	sampleSize int
 	n          int64
 	sum        float64
+	sumSq      float64
+	min        float64
 	max        float64
 	values     []float64
 }
@@ -260,8 +1443,19 @@ func newRandomSample(size int) *randomSample {
 }
 
 func (s *randomSample) record(v float64) {
+	// First value is both min and max, so negative values are handled
+	if s.n == 0 || v < s.min {
+		s.min = v
+	}
+	if s.n == 0 || v > s.max {
+		s.max = v
+	}
 	s.n++
 	s.sum += v
+	s.sumSq += v * v
+	if s.values == nil {
+		s.values = getValues(s.sampleSize) // after reset
+	}
 	if len(s.values) < s.sampleSize {
 		s.values = append(s.values, v)
 	} else {
@@ -270,16 +1464,65 @@ func (s *randomSample) record(v float64) {
 			s.values[int(r)] = v
 		}
 	}
-	if v > s.max {
-		s.max = v
-	}
 }
 
 func (s *randomSample) reset() {
 	s.n = 0
 	s.sum = 0
+	s.sumSq = 0
+	s.min = 0
 	s.max = 0
-	s.values = make([]float64, 0, s.sampleSize)
+	s.values = nil // returned to valuesPool by snapshot
+}
+
+func (s *randomSample) take() sample {
+	t := *s
+	s.reset()
+	return &t
+}
+
+func (s *randomSample) snapshot(snapshot *Snapshot, p []float64, scores map[float64]float64, reset bool) {
+	if len(s.values) == 0 {
+		return // reset then called again without any new values
+	}
+
+	snapshot.N = s.n
+	snapshot.Sum = s.sum
+	snapshot.SumOfSquares = s.sumSq
+	snapshot.Min = s.min
+	snapshot.Max = s.max
+
+	// Min is tracked exactly, so without percentiles there's no need to copy
+	// or sort the values
+	if len(p) == 0 {
+		snapshot.Percentile = resetScores(scores, p)
+		if reset {
+			putValues(s.values)
+			s.reset()
+		}
+		return
+	}
+
+	// If reseting we can avoid the copy: the sample values are sorted and
+	// returned to the pool, and the next record gets new (pooled) values
+	var values []float64
+	if reset {
+		values = s.values
+		sort.Float64s(values)
+		s.reset()
+	} else {
+		values = append(getValues(len(s.values)), s.values...)
+		sort.Float64s(values)
+	}
+	snapshot.Percentile = percentiles(resetScores(scores, p), p, values, s.sampleSize)
+	putValues(values)
+}
+
+func (s *randomSample) quantiles() quantiles {
+	return &sortedValues{
+		values:     append([]float64(nil), s.values...),
+		sampleSize: s.sampleSize,
+	}
 }
 
 // --------------------------------------------------------------------------
@@ -287,33 +1530,37 @@ func (s *randomSample) reset() {
 // https://www.amherst.edu/media/view/129116/original/Sample+Quantiles.pdf
 // --------------------------------------------------------------------------
 
-func percentiles(percentiles, values []float64, sampleSize int) map[float64]float64 {
-	scores := map[float64]float64{}
-	n := float64(len(values))
-	if n == 0 || len(percentiles) == 0 {
+func percentiles(scores map[float64]float64, percentiles, values []float64, sampleSize int) map[float64]float64 {
+	if len(values) == 0 || len(percentiles) == 0 {
 		return scores
 	}
+	for _, p := range percentiles {
+		scores[p] = percentile(p, values, sampleSize)
+	}
+	return scores
+}
+
+// percentile returns percentile p of the sorted values, which must not be
+// empty. If the sample is full, it uses nearest rank; else, it interpolates.
+func percentile(p float64, values []float64, sampleSize int) float64 {
+	n := float64(len(values))
 	if int(n) >= sampleSize {
-		for _, p := range percentiles {
-			i := int(math.Ceil(p * n))
-			scores[p] = values[i-1]
+		i := int(math.Ceil(p * n))
+		if i < 1 {
+			i = 1 // p = 0
 		}
-		return scores
+		return values[i-1]
 	}
-	for _, p := range percentiles {
-		//i := p * (float64(n) + 1) // R6
-		//i := p*(float64(n)-1) + 1 // R7
-		i := p*(n+(1/3.0)) + (1 / 3.0) // R8
-		if i < 1.0 {
-			scores[p] = values[0]
-		} else if i >= n {
-			scores[p] = values[int(n)-1]
-		} else {
-			k, f := math.Modf(i) // 8.53 -> i=8, d=53
-			lower := values[int(k)-1]
-			upper := values[int(k)]
-			scores[p] = lower + f*(upper-lower)
-		}
+	//i := p * (float64(n) + 1) // R6
+	//i := p*(float64(n)-1) + 1 // R7
+	i := p*(n+(1/3.0)) + (1 / 3.0) // R8
+	if i < 1.0 {
+		return values[0]
+	} else if i >= n {
+		return values[int(n)-1]
 	}
-	return scores
+	k, f := math.Modf(i) // 8.53 -> i=8, d=53
+	lower := values[int(k)-1]
+	upper := values[int(k)]
+	return lower + f*(upper-lower)
 }
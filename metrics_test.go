@@ -2,11 +2,24 @@ package metrics_test
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"math"
 	"math/rand"
+	"net"
 	"os"
+	"runtime"
+	"runtime/trace"
+	"sort"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/iotest"
 	"time"
 
 	"github.com/daniel-nichter/go-metrics"
@@ -20,11 +33,12 @@ func init() {
 
 var (
 	// P90: https://www.itl.nist.gov/div898/handbook/prc/section2/prc262.htm
-	control1    = []float64{95.1772, 95.1567, 95.1937, 95.1959, 95.1442, 95.0610, 95.1591, 95.1195, 95.1065, 95.0925, 95.1990, 95.1682}
-	control1P90 = 95.1972
-	control1Sum = 1141.7735
-	control1Min = 95.0610
-	control1Max = 95.1990
+	control1      = []float64{95.1772, 95.1567, 95.1937, 95.1959, 95.1442, 95.0610, 95.1591, 95.1195, 95.1065, 95.0925, 95.1990, 95.1682}
+	control1P90   = 95.1972
+	control1Sum   = 1141.7735
+	control1SumSq = 108637.24874967
+	control1Min   = 95.0610
+	control1Max   = 95.1990
 
 	p90Config  = metrics.Config{Percentiles: []float64{0.90}}
 	p999Config = metrics.Config{Percentiles: []float64{0.999}}
@@ -165,6 +179,160 @@ func TestCounterReset(t *testing.T) {
 	}
 }
 
+// --------------------------------------------------------------------------
+// FloatCounter
+// --------------------------------------------------------------------------
+
+func TestFloatCounter(t *testing.T) {
+	c1 := metrics.NewFloatCounter()
+	gotSnap := c1.Snapshot(true)
+	if diff := deep.Equal(gotSnap, metrics.Snapshot{}); diff != nil {
+		t.Error(diff)
+	}
+
+	c1.Add(0.5)
+	c1.Add(1.25)
+	c1.Add(-0.25)
+	if count := c1.Count(); count != 1.5 {
+		t.Errorf("Count %f, expected 1.5", count)
+	}
+	gotSnap = c1.Snapshot(false) // do not reset
+	expectSnap := metrics.Snapshot{
+		N:   3,
+		Sum: 1.5,
+		// Other fields zero for counters
+	}
+	if diff := deep.Equal(gotSnap, expectSnap); diff != nil {
+		t.Error(diff)
+	}
+	gotSnap = c1.Snapshot(true) // reset
+	if diff := deep.Equal(gotSnap, expectSnap); diff != nil {
+		t.Error(diff)
+	}
+	if count := c1.Count(); count != 0 {
+		t.Errorf("Count %f, expected 0", count)
+	}
+}
+
+func TestConcurrentFloatCount(t *testing.T) {
+	c1 := metrics.NewFloatCounter()
+	var wg sync.WaitGroup
+	wg.Add(4)
+	for i := 0; i < 4; i++ {
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				c1.Add(0.5)
+			}
+		}()
+	}
+	wg.Wait()
+	gotSnap := c1.Snapshot(true)
+	expectSnap := metrics.Snapshot{
+		N:   4000,
+		Sum: 2000,
+	}
+	if diff := deep.Equal(gotSnap, expectSnap); diff != nil {
+		t.Error(diff)
+	}
+}
+
+// --------------------------------------------------------------------------
+// MonotonicCounter
+// --------------------------------------------------------------------------
+
+func TestMonotonicCounter(t *testing.T) {
+	// First reading is the baseline, then deltas
+	c1 := metrics.NewMonotonicCounter(0)
+	c1.Set(100)
+	c1.Set(150)
+	c1.Set(175)
+	gotSnap := c1.Snapshot(true)
+	expectSnap := metrics.Snapshot{
+		N:   2,
+		Sum: 75,
+	}
+	if diff := deep.Equal(gotSnap, expectSnap); diff != nil {
+		t.Error(diff)
+	}
+
+	// Source reset (restarted from zero): delta is new reading
+	c1.Set(10)
+	c1.Set(12)
+	if count := c1.Count(); count != 12 {
+		t.Errorf("Count %d, expected 12", count)
+	}
+
+	// 32-bit source wraps around
+	c2 := metrics.NewMonotonicCounter(math.MaxUint32)
+	c2.Set(math.MaxUint32 - 4)
+	c2.Set(5) // 4 to max, +1 to zero, +5
+	if count := c2.Count(); count != 10 {
+		t.Errorf("Count %d, expected 10", count)
+	}
+
+	// 32-bit source restarts: a wraparound would be more than half of max,
+	// so it is a reset and the delta is the new reading
+	c3 := metrics.NewMonotonicCounter(math.MaxUint32)
+	c3.Set(1000)
+	c3.Set(5)
+	if count := c3.Count(); count != 5 {
+		t.Errorf("Count %d, expected 5", count)
+	}
+}
+
+// --------------------------------------------------------------------------
+// ShardedCounter
+// --------------------------------------------------------------------------
+
+func TestShardedCounter(t *testing.T) {
+	c1 := metrics.NewShardedCounter()
+	if diff := deep.Equal(c1.Snapshot(true), metrics.Snapshot{}); diff != nil {
+		t.Error(diff)
+	}
+	c1.Add(3)
+	c1.Add(5)
+	c1.Add(-1)
+	if count := c1.Count(); count != 7 {
+		t.Errorf("Count %d, expected 7", count)
+	}
+	expectSnap := metrics.Snapshot{
+		N:   3,
+		Sum: 7,
+	}
+	if diff := deep.Equal(c1.Snapshot(false), expectSnap); diff != nil {
+		t.Error(diff)
+	}
+	if diff := deep.Equal(c1.Snapshot(true), expectSnap); diff != nil {
+		t.Error(diff)
+	}
+	if count := c1.Count(); count != 0 {
+		t.Errorf("Count %d, expected 0", count)
+	}
+}
+
+func TestConcurrentShardedCounter(t *testing.T) {
+	c1 := metrics.NewShardedCounter()
+	var wg sync.WaitGroup
+	wg.Add(8)
+	for i := 0; i < 8; i++ {
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				c1.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	expectSnap := metrics.Snapshot{
+		N:   8000,
+		Sum: 8000,
+	}
+	if diff := deep.Equal(c1.Snapshot(true), expectSnap); diff != nil {
+		t.Error(diff)
+	}
+}
+
 // --------------------------------------------------------------------------
 // Gauge
 // --------------------------------------------------------------------------
@@ -193,10 +361,11 @@ func TestGaugeOneValue(t *testing.T) {
 	g1.Record(val)
 	gotSnap := g1.Snapshot(true)
 	expectSnap := metrics.Snapshot{
-		N:   1,
-		Sum: val,
-		Min: val,
-		Max: val,
+		N:            1,
+		Sum:          val,
+		SumOfSquares: val * val,
+		Min:          val,
+		Max:          val,
 		Percentile: map[float64]float64{
 			0.999: val,
 		},
@@ -220,10 +389,11 @@ func TestGaugeRecord(t *testing.T) {
 	}
 	gotSnap := g1.Snapshot(true) // reset
 	expectSnap := metrics.Snapshot{
-		N:   int64(len(control1)),
-		Sum: control1Sum,
-		Min: control1Min,
-		Max: control1Max,
+		N:            int64(len(control1)),
+		Sum:          control1Sum,
+		SumOfSquares: control1SumSq,
+		Min:          control1Min,
+		Max:          control1Max,
 		Percentile: map[float64]float64{
 			0.90: control1P90,
 		},
@@ -255,10 +425,11 @@ func TestGaugeReset(t *testing.T) {
 	}
 	gotSnap := g1.Snapshot(true) // reset
 	expectSnap := metrics.Snapshot{
-		N:   int64(len(control1)),
-		Sum: control1Sum,
-		Min: control1Min,
-		Max: control1Max,
+		N:            int64(len(control1)),
+		Sum:          control1Sum,
+		SumOfSquares: control1SumSq,
+		Min:          control1Min,
+		Max:          control1Max,
 		Percentile: map[float64]float64{
 			0.90: control1P90,
 		},
@@ -275,10 +446,11 @@ func TestGaugeReset(t *testing.T) {
 	}
 	gotSnap2 := g1.Snapshot(true) // new snapshot
 	expectSnap = metrics.Snapshot{
-		N:   int64(len(newVals)),
-		Sum: 80,
-		Min: 0,
-		Max: 10,
+		N:            int64(len(newVals)),
+		Sum:          80,
+		SumOfSquares: 586,
+		Min:          0,
+		Max:          10,
 		Percentile: map[float64]float64{
 			0.90: 9,
 		},
@@ -298,10 +470,11 @@ func TestGaugeRecordNotReset(t *testing.T) {
 	}
 	gotSnap := g1.Snapshot(false) // do not reset
 	expectSnap := metrics.Snapshot{
-		N:   int64(len(control1)),
-		Sum: control1Sum,
-		Min: control1Min,
-		Max: control1Max,
+		N:            int64(len(control1)),
+		Sum:          control1Sum,
+		SumOfSquares: control1SumSq,
+		Min:          control1Min,
+		Max:          control1Max,
 		Percentile: map[float64]float64{
 			0.90: control1P90,
 		},
@@ -322,6 +495,7 @@ func TestGaugeRecordNotReset(t *testing.T) {
 	g1.Record(val)
 	expectSnap.N += 1
 	expectSnap.Sum += val
+	expectSnap.SumOfSquares += val * val
 	expectSnap.Max = val
 	expectSnap.Last = val
 	expectSnap.Percentile[0.90] = 95.5323 // previous: 95.1972
@@ -339,12 +513,13 @@ func TestGaugeNoPercentiles(t *testing.T) {
 	}
 	gotSnap := g1.Snapshot(true)
 	expectSnap := metrics.Snapshot{
-		N:          int64(len(control1)),
-		Sum:        control1Sum,
-		Min:        control1Min,
-		Max:        control1Max,
-		Percentile: map[float64]float64{},
-		Last:       control1[len(control1)-1],
+		N:            int64(len(control1)),
+		Sum:          control1Sum,
+		SumOfSquares: control1SumSq,
+		Min:          control1Min,
+		Max:          control1Max,
+		Percentile:   map[float64]float64{},
+		Last:         control1[len(control1)-1],
 	}
 	if diff := deep.Equal(gotSnap, expectSnap); diff != nil {
 		t.Error(diff)
@@ -373,16 +548,92 @@ func TestGaugeAdd(t *testing.T) {
 	}
 	gotSnap := g1.Snapshot(true)
 	expectSnap := metrics.Snapshot{
-		N:          4,
-		Sum:        17,
-		Min:        3,
-		Max:        5,
-		Percentile: map[float64]float64{},
-		Last:       5,
+		N:            4,
+		Sum:          17,
+		SumOfSquares: 75,
+		Min:          3,
+		Max:          5,
+		Percentile:   map[float64]float64{},
+		Last:         5,
+	}
+	if diff := deep.Equal(gotSnap, expectSnap); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestGaugeLastDelta(t *testing.T) {
+	g1 := metrics.NewGauge(metrics.Config{LastDelta: true})
+	g1.Record(100) // first, so no delta
+	if gotSnap := g1.Snapshot(true); gotSnap.LastDelta != 0 {
+		t.Errorf("LastDelta %f, expected 0", gotSnap.LastDelta)
+	}
+
+	g1.Record(150)
+	if gotSnap := g1.Snapshot(false); gotSnap.LastDelta != 50 {
+		t.Errorf("LastDelta %f, expected 50", gotSnap.LastDelta)
+	}
+	g1.Record(120)
+	if gotSnap := g1.Snapshot(true); gotSnap.LastDelta != 20 {
+		t.Errorf("LastDelta %f, expected 20", gotSnap.LastDelta)
+	}
+
+	// No values, so no delta, and the previous Last is kept
+	if gotSnap := g1.Snapshot(true); gotSnap.LastDelta != 0 {
+		t.Errorf("LastDelta %f, expected 0", gotSnap.LastDelta)
+	}
+	g1.Record(90)
+	if gotSnap := g1.Snapshot(true); gotSnap.LastDelta != -30 {
+		t.Errorf("LastDelta %f, expected -30", gotSnap.LastDelta)
+	}
+}
+
+// --------------------------------------------------------------------------
+// Concurrency
+// --------------------------------------------------------------------------
+
+func TestConcurrency(t *testing.T) {
+	c1 := metrics.NewConcurrency()
+	if diff := deep.Equal(c1.Snapshot(true), metrics.Snapshot{}); diff != nil {
+		t.Error(diff)
+	}
+
+	c1.Start()
+	c1.Start()
+	c1.Track(func() {
+		if n := c1.InFlight(); n != 3 {
+			t.Errorf("InFlight %d, expected 3", n)
+		}
+	})
+	c1.Done()
+	gotSnap := c1.Snapshot(true)
+	expectSnap := metrics.Snapshot{
+		N:    3,
+		Max:  3,
+		Last: 1,
+	}
+	if diff := deep.Equal(gotSnap, expectSnap); diff != nil {
+		t.Error(diff)
+	}
+
+	// After reset, peak is the current in-flight, not zero
+	gotSnap = c1.Snapshot(true)
+	expectSnap = metrics.Snapshot{
+		N:    0,
+		Max:  1,
+		Last: 1,
 	}
 	if diff := deep.Equal(gotSnap, expectSnap); diff != nil {
 		t.Error(diff)
 	}
+
+	// Track calls Done even if fn panics
+	func() {
+		defer func() { recover() }()
+		c1.Track(func() { panic("oops") })
+	}()
+	if n := c1.InFlight(); n != 1 {
+		t.Errorf("InFlight %d after panic, expected 1", n)
+	}
 }
 
 // --------------------------------------------------------------------------
@@ -415,10 +666,11 @@ func TestHistogramOneValue(t *testing.T) {
 	h1.Record(val)
 	gotSnap := h1.Snapshot(true)
 	expectSnap := metrics.Snapshot{
-		N:   1,
-		Sum: val,
-		Min: val,
-		Max: val,
+		N:            1,
+		Sum:          val,
+		SumOfSquares: val * val,
+		Min:          val,
+		Max:          val,
 		Percentile: map[float64]float64{
 			0.999: val,
 		},
@@ -437,10 +689,11 @@ func TestHistogramRecord(t *testing.T) {
 	}
 	gotSnap := h1.Snapshot(true) // reset
 	expectSnap := metrics.Snapshot{
-		N:   int64(len(control1)),
-		Sum: control1Sum,
-		Min: control1Min,
-		Max: control1Max,
+		N:            int64(len(control1)),
+		Sum:          control1Sum,
+		SumOfSquares: control1SumSq,
+		Min:          control1Min,
+		Max:          control1Max,
 		Percentile: map[float64]float64{
 			0.90: control1P90,
 		},
@@ -467,10 +720,11 @@ func TestHistogramLowPercentile(t *testing.T) {
 	}
 	gotSnap := h1.Snapshot(true) // reset
 	expectSnap := metrics.Snapshot{
-		N:   int64(len(control1)),
-		Sum: control1Sum,
-		Min: control1Min,
-		Max: control1Max,
+		N:            int64(len(control1)),
+		Sum:          control1Sum,
+		SumOfSquares: control1SumSq,
+		Min:          control1Min,
+		Max:          control1Max,
 		Percentile: map[float64]float64{
 			0.01:  control1Min, // 1%
 			0.001: control1Min, // 0.1%
@@ -542,10 +796,11 @@ func TestConcurrentGauge(t *testing.T) {
 	wg.Wait()
 	gotSnap := g1.Snapshot(true)
 	expectSnap := metrics.Snapshot{
-		N:   10, // 2 * 5
-		Sum: 20,
-		Min: 0,
-		Max: 4,
+		N:            10, // 2 * 5
+		Sum:          20,
+		SumOfSquares: 60, // 2 * (0 + 1 + 4 + 9 + 16)
+		Min:          0,
+		Max:          4,
 		Percentile: map[float64]float64{
 			0.80: 3.6,
 			0.90: 4,
@@ -557,6 +812,35 @@ func TestConcurrentGauge(t *testing.T) {
 	}
 }
 
+func TestConcurrentGaugeLast(t *testing.T) {
+	// Last does not lock, so run with -race to verify reads don't race writes
+	g1 := metrics.NewGauge(metrics.Config{})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 1; i <= 1000; i++ {
+			g1.Record(float64(i))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		prev := 0.0
+		for i := 0; i < 1000; i++ {
+			last := g1.Last()
+			if last < prev {
+				t.Errorf("Last %f < previous %f", last, prev)
+				return
+			}
+			prev = last
+		}
+	}()
+	wg.Wait()
+	if last := g1.Last(); last != 1000 {
+		t.Errorf("Last %f, expected 1000", last)
+	}
+}
+
 func TestConcurrentHistogram(t *testing.T) {
 	// This produces 10 measurements (sorted): [0, 0, 1, 1, 2, 2, 3, 3, 4, 4]
 	h1 := metrics.NewHistogram(p999Config)
@@ -577,10 +861,11 @@ func TestConcurrentHistogram(t *testing.T) {
 	wg.Wait()
 	gotSnap := h1.Snapshot(true)
 	expectSnap := metrics.Snapshot{
-		N:   10, // 2 * 5
-		Sum: 20,
-		Min: 0,
-		Max: 4,
+		N:            10, // 2 * 5
+		Sum:          20,
+		SumOfSquares: 60, // 2 * (0 + 1 + 4 + 9 + 16)
+		Min:          0,
+		Max:          4,
 		Percentile: map[float64]float64{
 			0.999: 4,
 		},
@@ -590,6 +875,51 @@ func TestConcurrentHistogram(t *testing.T) {
 	}
 }
 
+func TestConcurrentSnapshotReset(t *testing.T) {
+	// Reset snapshots swap out the sample while values are being recorded,
+	// so no values are lost: the sum of all snapshots is all values
+	for _, e := range []metrics.Estimator{metrics.Reservoir, metrics.KLL, metrics.CKMS} {
+		h1 := metrics.NewHistogram(metrics.Config{
+			Percentiles: p999Config.Percentiles,
+			Estimator:   e,
+			Thresholds:  []float64{1},
+		})
+		var wg sync.WaitGroup
+		wg.Add(2)
+		for i := 0; i < 2; i++ {
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 5000; i++ {
+					h1.Record(1)
+				}
+			}()
+		}
+		var n, threshold int64
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+	SNAPSHOTS:
+		for {
+			select {
+			case <-done:
+				break SNAPSHOTS
+			default:
+			}
+			snap := h1.Snapshot(true)
+			n += snap.N
+			threshold += snap.Threshold[1]
+		}
+		snap := h1.Snapshot(true)
+		n += snap.N
+		threshold += snap.Threshold[1]
+		if n != 10000 || threshold != 10000 {
+			t.Errorf("estimator %d: N %d and Threshold %d, expected 10000", e, n, threshold)
+		}
+	}
+}
+
 // --------------------------------------------------------------------------
 // Data files with thousands of real-world values
 // --------------------------------------------------------------------------
@@ -624,10 +954,11 @@ func TestDataFile_4ktrend1to7(t *testing.T) {
 	}
 	gotSnap := h1.Snapshot(true) // reset
 	expectSnap := metrics.Snapshot{
-		N:   4000,
-		Sum: 8016.0053670,
-		Min: 0.000566,
-		Max: 6.989429,
+		N:            4000,
+		Sum:          8016.0053670,
+		SumOfSquares: 27906.4780,
+		Min:          0.000566,
+		Max:          6.989429,
 		Percentile: map[float64]float64{
 			0.999: 6.9546, // real: 6.967
 		},
@@ -645,10 +976,11 @@ func TestDataFile_1k(t *testing.T) {
 	}
 	gotSnap := h1.Snapshot(true) // reset
 	expectSnap := metrics.Snapshot{
-		N:   1000,
-		Sum: 1.53073,
-		Min: 0.000011,
-		Max: 1.089862,
+		N:            1000,
+		Sum:          1.53073,
+		SumOfSquares: 1.224347,
+		Min:          0.000011,
+		Max:          1.089862,
 		Percentile: map[float64]float64{
 			0.999: 0.78721666,
 		},
@@ -666,10 +998,11 @@ func TestDataFile_300(t *testing.T) {
 	}
 	gotSnap := h1.Snapshot(true) // reset
 	expectSnap := metrics.Snapshot{
-		N:   300,
-		Sum: 0.260362,
-		Min: 0.000011,
-		Max: 0.182833,
+		N:            300,
+		Sum:          0.260362,
+		SumOfSquares: 0.033936,
+		Min:          0.000011,
+		Max:          0.182833,
 		Percentile: map[float64]float64{
 			0.999: 0.182833,
 		},
@@ -678,3 +1011,2839 @@ func TestDataFile_300(t *testing.T) {
 		t.Error(diff)
 	}
 }
+
+// --------------------------------------------------------------------------
+// KLL
+// --------------------------------------------------------------------------
+
+func TestKLLRankError(t *testing.T) {
+	// Values 1..100k in random order, so the true percentile p is p*100k.
+	// The normalized rank error must be within the KLL bound (~1.65%).
+	cfg := metrics.Config{
+		Percentiles: []float64{0.5, 0.9, 0.99},
+		Estimator:   metrics.KLL,
+	}
+	h1 := metrics.NewHistogram(cfg)
+	n := 100000
+	for _, v := range rand.Perm(n) {
+		h1.Record(float64(v + 1))
+	}
+	gotSnap := h1.Snapshot(true)
+	if gotSnap.N != int64(n) {
+		t.Errorf("N %d, expected %d", gotSnap.N, n)
+	}
+	if gotSnap.Min != 1 {
+		t.Errorf("Min %f, expected 1", gotSnap.Min)
+	}
+	if gotSnap.Max != float64(n) {
+		t.Errorf("Max %f, expected %d", gotSnap.Max, n)
+	}
+	for _, p := range cfg.Percentiles {
+		rankErr := math.Abs(gotSnap.Percentile[p]-p*float64(n)) / float64(n)
+		if rankErr > 0.0165 {
+			t.Errorf("P%v = %f: rank error %f > 0.0165", p, gotSnap.Percentile[p], rankErr)
+		}
+	}
+
+	// Reset
+	gotSnap = h1.Snapshot(true)
+	if diff := deep.Equal(gotSnap, metrics.Snapshot{}); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestKLLMerge(t *testing.T) {
+	cfg := metrics.Config{
+		Percentiles: []float64{0.5},
+		Estimator:   metrics.KLL,
+	}
+	h1 := metrics.NewHistogram(cfg)
+	h2 := metrics.NewHistogram(cfg)
+	for i := 1; i <= 5000; i++ {
+		h1.Record(float64(i))
+		h2.Record(float64(i + 5000))
+	}
+	if err := h1.Merge(h2); err != nil {
+		t.Fatal(err)
+	}
+	gotSnap := h1.Snapshot(true)
+	if gotSnap.N != 10000 || gotSnap.Min != 1 || gotSnap.Max != 10000 {
+		t.Errorf("got N=%d Min=%f Max=%f, expected N=10000 Min=1 Max=10000", gotSnap.N, gotSnap.Min, gotSnap.Max)
+	}
+	if rankErr := math.Abs(gotSnap.Percentile[0.5]-5000) / 10000; rankErr > 0.0165 {
+		t.Errorf("P50 = %f: rank error %f > 0.0165", gotSnap.Percentile[0.5], rankErr)
+	}
+
+	// Other histogram not reset by merge
+	if n := h2.Snapshot(false).N; n != 5000 {
+		t.Errorf("merged histogram N %d, expected 5000", n)
+	}
+
+	// Reservoir histograms are not mergeable
+	h3 := metrics.NewHistogram(p90Config)
+	if err := h1.Merge(h3); err != metrics.ErrNotMergeable {
+		t.Errorf("got error %v, expected ErrNotMergeable", err)
+	}
+	if err := h1.Merge(h1); err != metrics.ErrMergeSelf {
+		t.Errorf("got error %v, expected ErrMergeSelf", err)
+	}
+}
+
+func TestKLLMergeThresholdsExemplars(t *testing.T) {
+	cfg := metrics.Config{
+		Estimator:  metrics.KLL,
+		Thresholds: []float64{10},
+		QueueSize:  16,
+	}
+	h1 := metrics.NewHistogram(cfg)
+	h2 := metrics.NewHistogram(cfg)
+	defer h1.Close()
+	defer h2.Close()
+	h1.Record(5)
+	h2.Record(8)  // queued
+	h2.Record(20) // queued
+	h2.RecordExemplar(30, "trace-1")
+	if err := h1.Merge(h2); err != nil {
+		t.Fatal(err)
+	}
+	gotSnap := h1.Snapshot(true)
+	if gotSnap.N != 4 {
+		t.Errorf("got N=%d, expected 4", gotSnap.N)
+	}
+	if n, _ := gotSnap.Under(10); n != 2 {
+		t.Errorf("got Under(10)=%d, expected 2", n)
+	}
+	if len(gotSnap.Exemplars) != 1 || gotSnap.Exemplars[0].Label != "trace-1" {
+		t.Errorf("got exemplars %+v, expected trace-1", gotSnap.Exemplars)
+	}
+
+	// Different thresholds are not mergeable
+	h3 := metrics.NewHistogram(metrics.Config{Estimator: metrics.KLL, Thresholds: []float64{1}})
+	if err := h1.Merge(h3); err != metrics.ErrNotMergeable {
+		t.Errorf("got error %v, expected ErrNotMergeable", err)
+	}
+}
+
+func TestKLLMergeConcurrent(t *testing.T) {
+	// a.Merge(b) and b.Merge(a) at the same time must not deadlock
+	cfg := metrics.Config{Estimator: metrics.KLL}
+	a := metrics.NewHistogram(cfg)
+	b := metrics.NewHistogram(cfg)
+	a.Record(1)
+	b.Record(2)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, hs := range [][2]*metrics.Histogram{{a, b}, {b, a}} {
+		wg.Add(1)
+		go func(dst, src *metrics.Histogram) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				dst.Merge(src)
+				dst.Snapshot(true)
+			}
+		}(hs[0], hs[1])
+	}
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("deadlock")
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		cfg    metrics.Config
+		expect error
+	}{
+		{metrics.Config{}, nil},
+		{metrics.Config{Percentiles: []float64{0, 0.5, 0.999, 1}}, nil},
+		{metrics.Config{Percentiles: []float64{0.5, 99}}, metrics.ErrInvalidPercentile},
+		{metrics.Config{Percentiles: []float64{-0.1}}, metrics.ErrInvalidPercentile},
+		{metrics.Config{Percentiles: []float64{math.NaN()}}, metrics.ErrInvalidPercentile},
+		{metrics.Config{TargetErrors: map[float64]float64{99: 0.001}}, metrics.ErrInvalidPercentile},
+		{metrics.Config{TargetErrors: map[float64]float64{0.99: 0}}, metrics.ErrInvalidConfig},
+		{metrics.Config{Estimator: metrics.CKMS + 1}, metrics.ErrInvalidConfig},
+		{metrics.Config{SampleSize: -1}, metrics.ErrInvalidConfig},
+		{metrics.Config{QueueSize: -1}, metrics.ErrInvalidConfig},
+		{metrics.Config{RecordEvery: -1}, metrics.ErrInvalidConfig},
+		{metrics.Config{RecordProbability: 1.5}, metrics.ErrInvalidConfig},
+		{metrics.Config{Thresholds: []float64{math.NaN()}}, metrics.ErrInvalidConfig},
+		{metrics.Config{OutlierStdDevs: -3}, metrics.ErrInvalidConfig},
+	}
+	for _, test := range tests {
+		err := test.cfg.Validate()
+		if !errors.Is(err, test.expect) || (err == nil) != (test.expect == nil) {
+			t.Errorf("%+v: got error %v, expected %v", test.cfg, err, test.expect)
+		}
+	}
+}
+
+// --------------------------------------------------------------------------
+// CKMS
+// --------------------------------------------------------------------------
+
+func TestCKMSTargetErrors(t *testing.T) {
+	// Values 1..100k in random order, so the true percentile p is p*100k
+	cfg := metrics.Config{
+		Percentiles:  []float64{0.5, 0.99, 0.999},
+		Estimator:    metrics.CKMS,
+		TargetErrors: map[float64]float64{0.5: 0.01}, // others default
+	}
+	h1 := metrics.NewHistogram(cfg)
+	n := 100000
+	for _, v := range rand.Perm(n) {
+		h1.Record(float64(v + 1))
+	}
+	gotSnap := h1.Snapshot(true)
+	if gotSnap.N != int64(n) || gotSnap.Min != 1 || gotSnap.Max != float64(n) {
+		t.Errorf("got N=%d Min=%f Max=%f, expected N=%d Min=1 Max=%d", gotSnap.N, gotSnap.Min, gotSnap.Max, n, n)
+	}
+	maxErr := map[float64]float64{
+		0.5:   0.01,
+		0.99:  0.001,
+		0.999: 0.0001,
+	}
+	for p, e := range maxErr {
+		rankErr := math.Abs(gotSnap.Percentile[p]-p*float64(n)) / float64(n)
+		if rankErr > e {
+			t.Errorf("P%v = %f: rank error %f > %f", p, gotSnap.Percentile[p], rankErr, e)
+		}
+	}
+
+	// Reset
+	gotSnap = h1.Snapshot(true)
+	if diff := deep.Equal(gotSnap, metrics.Snapshot{}); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestCKMSControl(t *testing.T) {
+	// With few values, CKMS is exact (nearest rank)
+	h1 := metrics.NewHistogram(metrics.Config{
+		Percentiles: []float64{0, 0.90, 1},
+		Estimator:   metrics.CKMS,
+	})
+	for _, v := range control1 {
+		h1.Record(v)
+	}
+	gotSnap := h1.Snapshot(false)
+	expectSnap := metrics.Snapshot{
+		N:            int64(len(control1)),
+		Sum:          control1Sum,
+		SumOfSquares: control1SumSq,
+		Min:          control1Min,
+		Max:          control1Max,
+		Percentile: map[float64]float64{
+			0:    control1Min,
+			0.90: 95.1959, // nearest rank, not R8
+			1:    control1Max,
+		},
+	}
+	if diff := deep.Equal(gotSnap, expectSnap); diff != nil {
+		t.Error(diff)
+	}
+}
+
+// --------------------------------------------------------------------------
+// Thresholds
+// --------------------------------------------------------------------------
+
+func TestHistogramThresholds(t *testing.T) {
+	// Thresholds are counted from all values, even when the sample is full
+	h1 := metrics.NewHistogram(metrics.Config{
+		Thresholds: []float64{500, 100, 5000}, // unsorted on purpose
+	})
+	for i := 1; i <= 3000; i++ {
+		h1.Record(float64(i))
+	}
+	gotSnap := h1.Snapshot(false)
+	expect := map[float64]int64{
+		100:  100,
+		500:  500,
+		5000: 3000,
+	}
+	if diff := deep.Equal(gotSnap.Threshold, expect); diff != nil {
+		t.Error(diff)
+	}
+
+	// Not reset, so counts accumulate
+	h1.Record(1)
+	gotSnap = h1.Snapshot(true)
+	expect = map[float64]int64{
+		100:  101,
+		500:  501,
+		5000: 3001,
+	}
+	if diff := deep.Equal(gotSnap.Threshold, expect); diff != nil {
+		t.Error(diff)
+	}
+
+	// Reset, so no values and no counts
+	gotSnap = h1.Snapshot(true)
+	if diff := deep.Equal(gotSnap, metrics.Snapshot{}); diff != nil {
+		t.Error(diff)
+	}
+	h1.Record(5001) // greater than all thresholds
+	gotSnap = h1.Snapshot(true)
+	expect = map[float64]int64{
+		100:  0,
+		500:  0,
+		5000: 0,
+	}
+	if diff := deep.Equal(gotSnap.Threshold, expect); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestSLACounts(t *testing.T) {
+	// Exact even when the sample is full and percentiles are estimated
+	h1 := metrics.NewHistogram(metrics.Config{
+		Percentiles: []float64{0.99},
+		Thresholds:  []float64{100, 500},
+	})
+	for i := 1; i <= 10000; i++ {
+		h1.Record(float64(i % 1000))
+	}
+	gotSnap := h1.Snapshot(true)
+	under, ok := gotSnap.Under(500)
+	if !ok || under != 5010 { // 0..500 of each 1,000
+		t.Errorf("Under(500) = %d (%t), expected 5010", under, ok)
+	}
+	over, ok := gotSnap.Over(500)
+	if !ok || over != 4990 {
+		t.Errorf("Over(500) = %d (%t), expected 4990", over, ok)
+	}
+	if _, ok := gotSnap.Over(250); ok {
+		t.Error("Over(250) ok, expected false: not a threshold")
+	}
+}
+
+func TestSpread(t *testing.T) {
+	h := metrics.NewHistogram(metrics.Config{Percentiles: []float64{0.25, 0.50, 0.75, 0.99}})
+	for i := 1; i <= 2000; i++ { // full sample, so nearest rank
+		h.Record(float64(i))
+	}
+	gotSnap := h.Snapshot(true)
+	if iqr, ok := gotSnap.IQR(); !ok || iqr != 1000 {
+		t.Errorf("IQR = %f (%t), expected 1000", iqr, ok)
+	}
+	if tail, ok := gotSnap.TailSpread(); !ok || tail != 980 {
+		t.Errorf("TailSpread = %f (%t), expected 980", tail, ok)
+	}
+	if _, ok := gotSnap.Spread(0.50, 0.999); ok {
+		t.Error("Spread(0.50, 0.999) ok, expected false: P999 not configured")
+	}
+}
+
+func TestCumulativeBuckets(t *testing.T) {
+	h1 := metrics.NewHistogram(metrics.Config{
+		Thresholds: []float64{95.15, 95.1, 95.19},
+	})
+	for _, v := range control1 {
+		h1.Record(v)
+	}
+	got := h1.Snapshot(true).CumulativeBuckets()
+	expect := []metrics.Bucket{
+		{UpperBound: 95.1, Count: 2},
+		{UpperBound: 95.15, Count: 5},
+		{UpperBound: 95.19, Count: 9},
+		{UpperBound: math.Inf(1), Count: int64(len(control1))},
+	}
+	if diff := deep.Equal(got, expect); diff != nil {
+		t.Error(diff)
+	}
+
+	// No thresholds, no buckets
+	if got := (metrics.Snapshot{N: 1}).CumulativeBuckets(); got != nil {
+		t.Errorf("got %v, expected nil", got)
+	}
+}
+
+func TestSubtractBuckets(t *testing.T) {
+	h := metrics.NewHistogram(metrics.Config{
+		Thresholds: []float64{1, 10},
+	})
+	for _, v := range []float64{0.5, 5, 50} {
+		h.Record(v)
+	}
+	prev := h.Snapshot(false)
+	for _, v := range []float64{0.5, 0.5, 50} {
+		h.Record(v)
+	}
+	cur := h.Snapshot(false)
+
+	// Cumulative since the histogram was created
+	expect := []metrics.Bucket{
+		{UpperBound: 1, Count: 3},
+		{UpperBound: 10, Count: 4},
+		{UpperBound: math.Inf(1), Count: 6},
+	}
+	if diff := deep.Equal(cur.CumulativeBuckets(), expect); diff != nil {
+		t.Error(diff)
+	}
+
+	// Only the last 3 values
+	expect = []metrics.Bucket{
+		{UpperBound: 1, Count: 2},
+		{UpperBound: 10, Count: 2},
+		{UpperBound: math.Inf(1), Count: 3},
+	}
+	if diff := deep.Equal(cur.SubtractBuckets(prev), expect); diff != nil {
+		t.Error(diff)
+	}
+
+	// Reset since prev: counts are less than prev, so all of cur
+	h.Snapshot(true)
+	h.Record(0.5)
+	cur = h.Snapshot(false)
+	if diff := deep.Equal(cur.SubtractBuckets(prev), cur.CumulativeBuckets()); diff != nil {
+		t.Error(diff)
+	}
+
+	// No thresholds, no buckets
+	if got := (metrics.Snapshot{N: 1}).SubtractBuckets(prev); got != nil {
+		t.Errorf("got %v, expected nil", got)
+	}
+}
+
+func TestSortedPercentiles(t *testing.T) {
+	g := metrics.NewGauge(metrics.Config{
+		Percentiles: []float64{metrics.P999, metrics.P50, metrics.P95, metrics.P99},
+	})
+	for i := 1; i <= 1000; i++ {
+		g.Record(float64(i))
+	}
+	snap := g.Snapshot(true)
+	got := snap.SortedPercentiles()
+	expect := []metrics.PercentileValue{
+		{Percentile: metrics.P50, Value: snap.Percentile[metrics.P50]},
+		{Percentile: metrics.P95, Value: snap.Percentile[metrics.P95]},
+		{Percentile: metrics.P99, Value: snap.Percentile[metrics.P99]},
+		{Percentile: metrics.P999, Value: snap.Percentile[metrics.P999]},
+	}
+	if diff := deep.Equal(got, expect); diff != nil {
+		t.Error(diff)
+	}
+
+	// No percentiles
+	if got := (metrics.Snapshot{N: 1}).SortedPercentiles(); got != nil {
+		t.Errorf("got %v, expected nil", got)
+	}
+}
+
+// --------------------------------------------------------------------------
+// Snapshot
+// --------------------------------------------------------------------------
+
+func TestSnapshotVariance(t *testing.T) {
+	// https://en.wikipedia.org/wiki/Standard_deviation: population stddev of
+	// 2, 4, 4, 4, 5, 5, 7, 9 is 2
+	h1 := metrics.NewHistogram(metrics.Config{})
+	h2 := metrics.NewHistogram(metrics.Config{})
+	for _, v := range []float64{2, 4, 4, 4} {
+		h1.Record(v)
+	}
+	for _, v := range []float64{5, 5, 7, 9} {
+		h2.Record(v)
+	}
+	snap1 := h1.Snapshot(true)
+	snap2 := h2.Snapshot(true)
+
+	// Merge snapshots from two instances, then variance is exact
+	merged := metrics.Snapshot{
+		N:            snap1.N + snap2.N,
+		Sum:          snap1.Sum + snap2.Sum,
+		SumOfSquares: snap1.SumOfSquares + snap2.SumOfSquares,
+	}
+	if v := merged.Variance(); v != 4 {
+		t.Errorf("Variance %f, expected 4", v)
+	}
+	if sd := merged.StdDev(); sd != 2 {
+		t.Errorf("StdDev %f, expected 2", sd)
+	}
+
+	// No values
+	if v := (metrics.Snapshot{}).Variance(); v != 0 {
+		t.Errorf("Variance %f, expected 0", v)
+	}
+}
+
+func TestSnapshotScale(t *testing.T) {
+	// Nanoseconds to milliseconds
+	snap := metrics.Snapshot{
+		N:            2,
+		Sum:          3000000,
+		SumOfSquares: 5000000000000,
+		Min:          1000000,
+		Max:          2000000,
+		Percentile:   map[float64]float64{0.99: 2000000},
+		Last:         2000000,
+		Threshold:    map[float64]int64{1500000: 1},
+		Exemplars:    []metrics.Exemplar{{Value: 2000000, Label: "trace-1"}},
+	}
+	gotSnap := snap.Scale(1e-6)
+	expectSnap := metrics.Snapshot{
+		N:            2,
+		Sum:          3,
+		SumOfSquares: 5,
+		Min:          1,
+		Max:          2,
+		Percentile:   map[float64]float64{0.99: 2},
+		Last:         2,
+		Threshold:    map[float64]int64{1.5: 1},
+		Exemplars:    []metrics.Exemplar{{Value: 2, Label: "trace-1"}},
+	}
+	if diff := deep.Equal(gotSnap, expectSnap); diff != nil {
+		t.Error(diff)
+	}
+
+	// Original not modified
+	if snap.Percentile[0.99] != 2000000 {
+		t.Errorf("original P99 modified: %f", snap.Percentile[0.99])
+	}
+	if snap.Exemplars[0].Value != 2000000 {
+		t.Errorf("original exemplar modified: %f", snap.Exemplars[0].Value)
+	}
+}
+
+func TestNegativeValues(t *testing.T) {
+	// All negative values: Min and Max must be the true extremes, not zero
+	vals := []float64{-3.5, -1.25, -10, -7}
+	for _, e := range []metrics.Estimator{metrics.Reservoir, metrics.KLL, metrics.CKMS} {
+		h1 := metrics.NewHistogram(metrics.Config{Percentiles: []float64{1}, Estimator: e})
+		for _, v := range vals {
+			h1.Record(v)
+		}
+		gotSnap := h1.Snapshot(true)
+		expectSnap := metrics.Snapshot{
+			N:            4,
+			Sum:          -21.75,
+			SumOfSquares: 162.8125,
+			Min:          -10,
+			Max:          -1.25,
+			Percentile:   map[float64]float64{1: -1.25},
+		}
+		if diff := deep.Equal(gotSnap, expectSnap); diff != nil {
+			t.Errorf("estimator %d: %v", e, diff)
+		}
+	}
+
+	// Gauge like a temperature below zero
+	g1 := metrics.NewGauge(metrics.Config{})
+	g1.Record(-5)
+	g1.Add(-2)
+	gotSnap := g1.Snapshot(true)
+	expectSnap := metrics.Snapshot{
+		N:            2,
+		Sum:          -12,
+		SumOfSquares: 74,
+		Min:          -7,
+		Max:          -5,
+		Percentile:   map[float64]float64{},
+		Last:         -7,
+	}
+	if diff := deep.Equal(gotSnap, expectSnap); diff != nil {
+		t.Error(diff)
+	}
+}
+
+// --------------------------------------------------------------------------
+// Delta
+// --------------------------------------------------------------------------
+
+func TestDelta(t *testing.T) {
+	prev := metrics.Snapshot{N: 10, Sum: 100, Max: 20, Threshold: map[float64]int64{5: 4}}
+	cur := metrics.Snapshot{N: 15, Sum: 160, Max: 25, Threshold: map[float64]int64{5: 6}}
+	gotSnap := metrics.Delta(prev, cur)
+	expectSnap := metrics.Snapshot{N: 5, Sum: 60, Max: 25, Threshold: map[float64]int64{5: 2}}
+	if diff := deep.Equal(gotSnap, expectSnap); diff != nil {
+		t.Error(diff)
+	}
+
+	// Restart: cumulative values dropped
+	restart := metrics.Snapshot{N: 2, Sum: 7}
+	gotSnap = metrics.Delta(cur, restart)
+	if diff := deep.Equal(gotSnap, restart); diff != nil {
+		t.Error(diff)
+	}
+
+	// Negative Counter.Add is not a restart
+	c := metrics.NewCounter()
+	c.Add(10)
+	prev = c.Snapshot(false)
+	c.Add(-3)
+	gotSnap = metrics.Delta(prev, c.Snapshot(false))
+	if diff := deep.Equal(gotSnap, metrics.Snapshot{N: 1, Sum: -3}); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestDeltaStream(t *testing.T) {
+	d := metrics.NewDeltaStream()
+	totals := []float64{100, 130, 130, 5, 20}
+	expect := []float64{0, 30, 0, 5, 15}
+	for i, total := range totals {
+		delta, ok := d.Next(metrics.Snapshot{Sum: total})
+		if ok != (i > 0) {
+			t.Errorf("%d: ok %t, expected %t", i, ok, i > 0)
+		}
+		if delta.Sum != expect[i] {
+			t.Errorf("%d: delta %f, expected %f", i, delta.Sum, expect[i])
+		}
+	}
+}
+
+func TestChangeStream(t *testing.T) {
+	c := metrics.NewCounter()
+	cs := metrics.NewChangeStream()
+
+	c.Add(100)
+	if _, ok := cs.Next(c.Snapshot(true)); ok {
+		t.Error("first Next ok, expected false")
+	}
+
+	c.Add(50)
+	got, ok := cs.Next(c.Snapshot(true))
+	expect := metrics.Change{Prev: 100, Cur: 50, Absolute: -50, Relative: -0.5}
+	if !ok {
+		t.Error("Next not ok")
+	}
+	if diff := deep.Equal(got, expect); diff != nil {
+		t.Error(diff)
+	}
+
+	got, _ = cs.Next(c.Snapshot(true)) // 50 -> 0
+	expect = metrics.Change{Prev: 50, Cur: 0, Absolute: -50, Relative: -1}
+	if diff := deep.Equal(got, expect); diff != nil {
+		t.Error(diff)
+	}
+
+	c.Add(10)
+	got, _ = cs.Next(c.Snapshot(true)) // 0 -> 10
+	if !math.IsInf(got.Relative, 1) {
+		t.Errorf("Relative = %f, expected +Inf", got.Relative)
+	}
+}
+
+// --------------------------------------------------------------------------
+// Async Histogram
+// --------------------------------------------------------------------------
+
+func TestHistogramQueue(t *testing.T) {
+	// Snapshot records queued values first, so it's consistent with sync mode
+	h1 := metrics.NewHistogram(metrics.Config{
+		Percentiles: p90Config.Percentiles,
+		QueueSize:   16,
+	})
+	defer h1.Close()
+	for _, v := range control1 {
+		h1.Record(v)
+	}
+	gotSnap := h1.Snapshot(true)
+	expectSnap := metrics.Snapshot{
+		N:            int64(len(control1)),
+		Sum:          control1Sum,
+		SumOfSquares: control1SumSq,
+		Min:          control1Min,
+		Max:          control1Max,
+		Percentile: map[float64]float64{
+			0.90: control1P90,
+		},
+	}
+	if diff := deep.Equal(gotSnap, expectSnap); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestHistogramQueueFull(t *testing.T) {
+	// After Close, values are queued but not recorded, so the queue fills
+	h1 := metrics.NewHistogram(metrics.Config{QueueSize: 3}) // rounded up to 4
+	h1.Close()
+	for i := 0; i < 10; i++ {
+		h1.Record(1)
+	}
+	gotSnap := h1.Snapshot(true)
+	if gotSnap.N != 4 || gotSnap.Dropped != 6 {
+		t.Errorf("N %d and Dropped %d, expected 4 and 6", gotSnap.N, gotSnap.Dropped)
+	}
+	gotSnap = h1.Snapshot(true)
+	if diff := deep.Equal(gotSnap, metrics.Snapshot{}); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestConcurrentHistogramQueue(t *testing.T) {
+	h1 := metrics.NewHistogram(metrics.Config{QueueSize: 1024})
+	defer h1.Close()
+	var wg sync.WaitGroup
+	wg.Add(4)
+	for i := 0; i < 4; i++ {
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				h1.Record(1)
+				if i%100 == 0 {
+					time.Sleep(20 * time.Millisecond) // let background goroutine drain
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	gotSnap := h1.Snapshot(true)
+	if gotSnap.N+gotSnap.Dropped != 2000 {
+		t.Errorf("N %d + Dropped %d != 2000", gotSnap.N, gotSnap.Dropped)
+	}
+	if gotSnap.Sum != float64(gotSnap.N) {
+		t.Errorf("Sum %f != N %d", gotSnap.Sum, gotSnap.N)
+	}
+}
+
+// --------------------------------------------------------------------------
+// Local Histogram
+// --------------------------------------------------------------------------
+
+func TestLocalHistogram(t *testing.T) {
+	h1 := metrics.NewHistogram(p90Config)
+	l1 := h1.Local(5, 0)
+	for _, v := range control1[:4] {
+		l1.Record(v)
+	}
+	// Not flushed yet
+	gotSnap := h1.Snapshot(false)
+	if diff := deep.Equal(gotSnap, metrics.Snapshot{}); diff != nil {
+		t.Error(diff)
+	}
+	for _, v := range control1[4:] {
+		l1.Record(v)
+	}
+	l1.Flush()
+	gotSnap = h1.Snapshot(true)
+	expectSnap := metrics.Snapshot{
+		N:            int64(len(control1)),
+		Sum:          control1Sum,
+		SumOfSquares: control1SumSq,
+		Min:          control1Min,
+		Max:          control1Max,
+		Percentile: map[float64]float64{
+			0.90: control1P90,
+		},
+	}
+	if diff := deep.Equal(gotSnap, expectSnap); diff != nil {
+		t.Error(diff)
+	}
+
+	// Flush by interval
+	l2 := h1.Local(100, time.Millisecond)
+	l2.Record(1)
+	time.Sleep(2 * time.Millisecond)
+	l2.Record(2)
+	if n := h1.Snapshot(true).N; n != 2 {
+		t.Errorf("N %d, expected 2", n)
+	}
+}
+
+func TestConcurrentLocalHistogram(t *testing.T) {
+	h1 := metrics.NewHistogram(metrics.Config{})
+	var wg sync.WaitGroup
+	wg.Add(4)
+	for i := 0; i < 4; i++ {
+		go func() {
+			defer wg.Done()
+			l := h1.Local(64, 0)
+			defer l.Flush()
+			for i := 0; i < 1000; i++ {
+				l.Record(1)
+			}
+		}()
+	}
+	wg.Wait()
+	gotSnap := h1.Snapshot(true)
+	if gotSnap.N != 4000 || gotSnap.Sum != 4000 {
+		t.Errorf("N %d and Sum %f, expected 4000", gotSnap.N, gotSnap.Sum)
+	}
+}
+
+// --------------------------------------------------------------------------
+// Reuse percentile map
+// --------------------------------------------------------------------------
+
+func TestReusePercentileMap(t *testing.T) {
+	h1 := metrics.NewHistogram(metrics.Config{
+		Percentiles:        []float64{0.5},
+		ReusePercentileMap: true,
+	})
+	h1.Record(1)
+	snap1 := h1.Snapshot(true)
+	if snap1.Percentile[0.5] != 1 {
+		t.Errorf("P50 %f, expected 1", snap1.Percentile[0.5])
+	}
+	h1.Record(2)
+	snap2 := h1.Snapshot(true)
+	if snap2.Percentile[0.5] != 2 {
+		t.Errorf("P50 %f, expected 2", snap2.Percentile[0.5])
+	}
+	// Same map, so the first snapshot was overwritten
+	if snap1.Percentile[0.5] != 2 {
+		t.Errorf("first snapshot P50 %f, expected 2 (overwritten)", snap1.Percentile[0.5])
+	}
+
+	// Empty snapshot is still zero
+	if diff := deep.Equal(h1.Snapshot(true), metrics.Snapshot{}); diff != nil {
+		t.Error(diff)
+	}
+
+	// Without reuse, maps are not shared
+	h2 := metrics.NewHistogram(metrics.Config{Percentiles: []float64{0.5}})
+	h2.Record(1)
+	snap1 = h2.Snapshot(true)
+	h2.Record(2)
+	h2.Snapshot(true)
+	if snap1.Percentile[0.5] != 1 {
+		t.Errorf("first snapshot P50 %f, expected 1", snap1.Percentile[0.5])
+	}
+}
+
+// --------------------------------------------------------------------------
+// RingHistogram
+// --------------------------------------------------------------------------
+
+func TestRingHistogram(t *testing.T) {
+	h1 := metrics.NewRingHistogram(p90Config)
+	gotSnap := h1.Snapshot(true)
+	if diff := deep.Equal(gotSnap, metrics.Snapshot{}); diff != nil {
+		t.Error(diff)
+	}
+
+	// Same as Histogram while the ring isn't full
+	for _, v := range control1 {
+		h1.Record(v)
+	}
+	gotSnap = h1.Snapshot(false)
+	expectSnap := metrics.Snapshot{
+		N:            int64(len(control1)),
+		Sum:          control1Sum,
+		SumOfSquares: control1SumSq,
+		Min:          control1Min,
+		Max:          control1Max,
+		Percentile: map[float64]float64{
+			0.90: control1P90,
+		},
+	}
+	if diff := deep.Equal(gotSnap, expectSnap); diff != nil {
+		t.Error(diff)
+	}
+	gotSnap = h1.Snapshot(true)
+	if diff := deep.Equal(gotSnap, expectSnap); diff != nil {
+		t.Error(diff)
+	}
+	gotSnap = h1.Snapshot(true)
+	if diff := deep.Equal(gotSnap, metrics.Snapshot{}); diff != nil {
+		t.Error(diff)
+	}
+
+	// Sliding window: sample is the last 2,000 values, but N, Sum, Min, and Max are exact
+	h2 := metrics.NewRingHistogram(metrics.Config{Percentiles: []float64{0}})
+	for i := 1; i <= 3000; i++ {
+		h2.Record(float64(i))
+	}
+	gotSnap = h2.Snapshot(true)
+	expectSnap = metrics.Snapshot{
+		N:            3000,
+		Sum:          4501500,
+		SumOfSquares: 9004500500, // 3000 * 3001 * 6001 / 6
+		Min:          1,
+		Max:          3000,
+		Percentile: map[float64]float64{
+			0: 1001, // first value in window
+		},
+	}
+	if diff := deep.Equal(gotSnap, expectSnap); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestConcurrentRingHistogram(t *testing.T) {
+	h1 := metrics.NewRingHistogram(p999Config)
+	var wg sync.WaitGroup
+	wg.Add(4)
+	for i := 0; i < 4; i++ {
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				h1.Record(1)
+			}
+		}()
+	}
+	wg.Wait()
+	gotSnap := h1.Snapshot(true)
+	expectSnap := metrics.Snapshot{
+		N:            4000,
+		Sum:          4000,
+		SumOfSquares: 4000,
+		Min:          1,
+		Max:          1,
+		Percentile:   map[float64]float64{0.999: 1},
+	}
+	if diff := deep.Equal(gotSnap, expectSnap); diff != nil {
+		t.Error(diff)
+	}
+
+	// No counts are lost when Snapshot resets while values are recorded,
+	// even if a snapshot has counts but no values in the ring
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100000; i++ {
+			h1.Record(1)
+		}
+	}()
+	var n int64
+	var sum float64
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		gotSnap = h1.Snapshot(true)
+		n += gotSnap.N
+		sum += gotSnap.Sum
+	}
+	gotSnap = h1.Snapshot(true)
+	n += gotSnap.N
+	sum += gotSnap.Sum
+	if n != 100000 || sum != 100000 {
+		t.Errorf("N %d, Sum %f, expected 100000", n, sum)
+	}
+}
+
+// --------------------------------------------------------------------------
+// Exemplars
+// --------------------------------------------------------------------------
+
+func TestHistogramExemplars(t *testing.T) {
+	h1 := metrics.NewHistogram(p999Config)
+	for i := 1; i <= 1000; i++ {
+		h1.RecordExemplar(float64(i), fmt.Sprintf("trace-%d", i))
+	}
+	h1.Record(2000) // not an exemplar
+	gotSnap := h1.Snapshot(true)
+	if gotSnap.N != 1001 {
+		t.Errorf("N %d, expected 1001", gotSnap.N)
+	}
+	// No percentile regions in the first interval: one region and the max
+	n := len(gotSnap.Exemplars)
+	if n < 2 || n > 3 {
+		t.Fatalf("%d exemplars, expected 2 or 3", n)
+	}
+	if !sort.SliceIsSorted(gotSnap.Exemplars, func(i, j int) bool {
+		return gotSnap.Exemplars[i].Value < gotSnap.Exemplars[j].Value
+	}) {
+		t.Errorf("exemplars not sorted: %v", gotSnap.Exemplars)
+	}
+	max := gotSnap.Exemplars[n-1]
+	if max.Value != 1000 || max.Label != "trace-1000" || max.Time.IsZero() {
+		t.Errorf("max exemplar %+v, expected value 1000 and label trace-1000", max)
+	}
+
+	// P999 is not an exemplar, so the closest exemplar is the max
+	e, ok := gotSnap.Exemplar(0.999)
+	if !ok || e.Label != "trace-1000" {
+		t.Errorf("P999 exemplar %+v (%t), expected trace-1000", e, ok)
+	}
+	if _, ok := gotSnap.Exemplar(0.5); ok {
+		t.Error("exemplar for P50 which is not configured")
+	}
+
+	// Reset
+	h1.Record(1)
+	gotSnap = h1.Snapshot(true)
+	if gotSnap.Exemplars != nil {
+		t.Errorf("exemplars after reset: %v", gotSnap.Exemplars)
+	}
+}
+
+func TestHistogramExemplarRegions(t *testing.T) {
+	// Without thresholds, exemplars are sampled between the percentiles of
+	// the last interval, so there are exemplars near tail percentiles
+	h1 := metrics.NewHistogram(metrics.Config{Percentiles: []float64{0.5, 0.99, 0.999}})
+	for interval := 0; interval < 2; interval++ {
+		for i := 1; i <= 10000; i++ {
+			h1.RecordExemplar(float64(i), "")
+		}
+		gotSnap := h1.Snapshot(true)
+		if interval == 0 {
+			continue
+		}
+		// 4 regions: <= P50, P50-P99, P99-P999, > P999
+		if n := len(gotSnap.Exemplars); n < 8 || n > 9 {
+			t.Errorf("%d exemplars, expected 8 or 9: %v", n, gotSnap.Exemplars)
+		}
+		for _, p := range []float64{0.99, 0.999} {
+			e, _ := gotSnap.Exemplar(p)
+			if d := math.Abs(e.Value - gotSnap.Percentile[p]); d > 200 {
+				t.Errorf("P%g %f exemplar %f, expected within 200", p*100, gotSnap.Percentile[p], e.Value)
+			}
+		}
+	}
+
+	// With thresholds, exemplars are sampled per bucket
+	h2 := metrics.NewHistogram(metrics.Config{Thresholds: []float64{10, 100}})
+	for i := 1; i <= 1000; i++ {
+		h2.RecordExemplar(float64(i), "")
+	}
+	buckets := map[float64]int{}
+	for _, e := range h2.Snapshot(true).Exemplars {
+		switch {
+		case e.Value <= 10:
+			buckets[10]++
+		case e.Value <= 100:
+			buckets[100]++
+		default:
+			buckets[math.Inf(1)]++
+		}
+	}
+	if buckets[10] != 2 || buckets[100] != 2 || buckets[math.Inf(1)] < 2 || buckets[math.Inf(1)] > 3 {
+		t.Errorf("exemplars per bucket %v, expected 2, 2, and 2 or 3", buckets)
+	}
+}
+
+func TestHistogramExemplarMerge(t *testing.T) {
+	// Merged exemplars are weighted by count: merging 1,000 exemplars into a
+	// histogram with 1 rarely keeps the 1
+	kept := 0
+	for i := 0; i < 100; i++ {
+		h1 := metrics.NewHistogram(metrics.Config{Estimator: metrics.KLL})
+		h2 := metrics.NewHistogram(metrics.Config{Estimator: metrics.KLL})
+		h1.RecordExemplar(1, "h1")
+		for j := 0; j < 1000; j++ {
+			h2.RecordExemplar(2, "h2")
+		}
+		if err := h1.Merge(h2); err != nil {
+			t.Fatal(err)
+		}
+		gotSnap := h1.Snapshot(true)
+		for _, e := range gotSnap.Exemplars {
+			if e.Label == "h1" {
+				kept++
+			}
+		}
+		if max := gotSnap.Exemplars[len(gotSnap.Exemplars)-1]; max.Label != "h2" {
+			t.Errorf("max exemplar %+v, expected h2", max)
+		}
+	}
+	if kept > 10 {
+		t.Errorf("h1 exemplar kept %d/100 times, expected about 0.2", kept)
+	}
+}
+
+// --------------------------------------------------------------------------
+// Slow values
+// --------------------------------------------------------------------------
+
+func TestHistogramRecordContext(t *testing.T) {
+	h1 := metrics.NewHistogram(metrics.Config{SlowThreshold: 0.5})
+
+	// Not tracing: values are recorded, nothing else
+	h1.RecordContext(context.Background(), 0.7)
+
+	var buf bytes.Buffer
+	if err := trace.Start(&buf); err != nil {
+		t.Fatal(err)
+	}
+	ctx, task := trace.NewTask(context.Background(), "request")
+	h1.RecordContext(ctx, 0.1)   // fast
+	h1.RecordContext(ctx, 0.625) // slow
+	task.End()
+	trace.Stop()
+
+	if n := h1.Snapshot(true).N; n != 3 {
+		t.Errorf("N %d, expected 3", n)
+	}
+	if !bytes.Contains(buf.Bytes(), []byte("metrics.slow")) {
+		t.Error("trace does not contain metrics.slow event")
+	}
+	if !bytes.Contains(buf.Bytes(), []byte("0.625")) {
+		t.Error("trace does not contain slow value")
+	}
+}
+
+// --------------------------------------------------------------------------
+// Sampler
+// --------------------------------------------------------------------------
+
+func TestSampler(t *testing.T) {
+	g1 := metrics.NewGauge(metrics.Config{})
+	var depth int64
+	s := metrics.NewSampler(g1, time.Millisecond, func() float64 {
+		return float64(atomic.AddInt64(&depth, 1))
+	})
+	s.Start()
+	s.Start() // no-op
+	time.Sleep(50 * time.Millisecond)
+	s.Stop()
+	s.Stop() // no-op
+
+	gotSnap := g1.Snapshot(true)
+	n := atomic.LoadInt64(&depth)
+	if gotSnap.N != n || n < 2 {
+		t.Errorf("N %d, expected %d (>= 2)", gotSnap.N, n)
+	}
+	if gotSnap.Min != 1 || gotSnap.Max != float64(n) || gotSnap.Last != float64(n) {
+		t.Errorf("Min %f, Max %f, Last %f; expected 1, %d, %d", gotSnap.Min, gotSnap.Max, gotSnap.Last, n, n)
+	}
+
+	// Stopped, so no more values
+	time.Sleep(5 * time.Millisecond)
+	if n := g1.Snapshot(true).N; n != 0 {
+		t.Errorf("N %d after Stop, expected 0", n)
+	}
+}
+
+func TestSamplerInvalidInterval(t *testing.T) {
+	for _, interval := range []time.Duration{0, -time.Second} {
+		func() {
+			defer func() {
+				err, _ := recover().(error)
+				if !errors.Is(err, metrics.ErrInvalidConfig) {
+					t.Errorf("interval %v: got panic %v, expected ErrInvalidConfig", interval, err)
+				}
+			}()
+			metrics.NewSampler(metrics.NewGauge(p90Config), interval, func() float64 { return 0 })
+		}()
+	}
+}
+
+// --------------------------------------------------------------------------
+// HealthSignal
+// --------------------------------------------------------------------------
+
+func TestHealthSignal(t *testing.T) {
+	var changes []string
+	h := metrics.NewHealthSignal(metrics.HealthConfig{
+		MaxErrorRatio:     0.05,
+		MaxLatency:        0.5,
+		LatencyPercentile: 0.99,
+		MinRequests:       10,
+		OpenIntervals:     2,
+		OnChange: func(from, to metrics.HealthState) {
+			changes = append(changes, from.String()+"->"+to.String())
+		},
+	})
+	reqs := metrics.Snapshot{Sum: 100}
+	fast := metrics.Snapshot{Percentile: map[float64]float64{0.99: 0.1}}
+	slow := metrics.Snapshot{Percentile: map[float64]float64{0.99: 0.9}}
+	noErrs := metrics.Snapshot{}
+	errs := metrics.Snapshot{Sum: 10} // 10%
+
+	steps := []struct {
+		requests, errors, latency metrics.Snapshot
+		expect                    metrics.HealthState
+	}{
+		{reqs, noErrs, fast, metrics.HealthClosed},
+		{metrics.Snapshot{Sum: 5}, errs, slow, metrics.HealthClosed}, // too few requests
+		{reqs, errs, fast, metrics.HealthOpen},                       // error ratio
+		{reqs, noErrs, fast, metrics.HealthOpen},                     // open interval 1
+		{reqs, noErrs, fast, metrics.HealthHalfOpen},                 // open interval 2
+		{reqs, noErrs, slow, metrics.HealthOpen},                     // latency
+		{reqs, noErrs, fast, metrics.HealthOpen},
+		{reqs, noErrs, fast, metrics.HealthHalfOpen},
+		{reqs, noErrs, fast, metrics.HealthClosed},
+	}
+	for i, s := range steps {
+		if got := h.Observe(s.requests, s.errors, s.latency); got != s.expect {
+			t.Errorf("step %d: state %s, expected %s", i, got, s.expect)
+		}
+	}
+	if h.State() != metrics.HealthClosed {
+		t.Errorf("State %s, expected closed", h.State())
+	}
+	expectChanges := []string{
+		"closed->open",
+		"open->half-open",
+		"half-open->open",
+		"open->half-open",
+		"half-open->closed",
+	}
+	if diff := deep.Equal(changes, expectChanges); diff != nil {
+		t.Error(diff)
+	}
+}
+
+// --------------------------------------------------------------------------
+// Heatmap
+// --------------------------------------------------------------------------
+
+func TestHeatmap(t *testing.T) {
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	h := metrics.NewHeatmap([]float64{0.1, 0.01, 0.05}, 10*time.Second) // sorted
+	metrics.SetHeatmapClock(h, clock)
+
+	// Column 0
+	h.Record(0.005)
+	h.Record(0.01) // <= bound
+	h.Record(0.07)
+	// Column 1 is empty
+	// Column 2
+	now = now.Add(25 * time.Second)
+	h.Record(0.2)
+
+	// Current column (2) is not complete, so only 0 and 1 are returned
+	gotSnap := h.Snapshot(true)
+	expectSnap := metrics.HeatmapSnapshot{
+		Start:    time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
+		Interval: 10 * time.Second,
+		Bounds:   []float64{0.01, 0.05, 0.1},
+		Counts: [][]int64{
+			{2, 0, 1, 0},
+			{0, 0, 0, 0},
+		},
+	}
+	if diff := deep.Equal(gotSnap, expectSnap); diff != nil {
+		t.Error(diff)
+	}
+
+	now = now.Add(10 * time.Second)
+	gotSnap = h.Snapshot(false)
+	expectSnap.Start = time.Date(2021, 1, 1, 0, 0, 20, 0, time.UTC)
+	expectSnap.Counts = [][]int64{
+		{0, 0, 0, 1},
+	}
+	if diff := deep.Equal(gotSnap, expectSnap); diff != nil {
+		t.Error(diff)
+	}
+
+	// No reset, so same again
+	gotSnap = h.Snapshot(true)
+	if diff := deep.Equal(gotSnap, expectSnap); diff != nil {
+		t.Error(diff)
+	}
+
+	// Reset, so nothing complete yet
+	gotSnap = h.Snapshot(true)
+	if len(gotSnap.Counts) != 0 {
+		t.Errorf("got %d columns, expected 0", len(gotSnap.Counts))
+	}
+}
+
+func TestHeatmapInvalidInterval(t *testing.T) {
+	for _, interval := range []time.Duration{0, -time.Second} {
+		func() {
+			defer func() {
+				err, _ := recover().(error)
+				if !errors.Is(err, metrics.ErrInvalidConfig) {
+					t.Errorf("interval %v: got panic %v, expected ErrInvalidConfig", interval, err)
+				}
+			}()
+			metrics.NewHeatmap([]float64{1}, interval)
+		}()
+	}
+}
+
+func TestHeatmapRecordAt(t *testing.T) {
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	clock := func() time.Time { return now }
+	h := metrics.NewHeatmap([]float64{0.01, 0.05, 0.1}, 10*time.Second)
+	metrics.SetHeatmapClock(h, clock)
+
+	now = now.Add(25 * time.Second)
+	h.RecordAt(0.005, start.Add(5*time.Second)) // column 0
+	h.RecordAt(0.07, start.Add(15*time.Second)) // column 1
+	h.RecordAt(0.2, start.Add(-time.Hour))      // before start: column 0
+	h.RecordAt(0.03, start.Add(time.Hour))      // after now: column 2
+	h.Record(0.03)                              // column 2
+
+	gotSnap := h.Snapshot(true)
+	expectSnap := metrics.HeatmapSnapshot{
+		Start:    start,
+		Interval: 10 * time.Second,
+		Bounds:   []float64{0.01, 0.05, 0.1},
+		Counts: [][]int64{
+			{1, 0, 0, 1},
+			{0, 0, 1, 0},
+		},
+	}
+	if diff := deep.Equal(gotSnap, expectSnap); diff != nil {
+		t.Error(diff)
+	}
+
+	now = now.Add(10 * time.Second)
+	gotSnap = h.Snapshot(true)
+	expectSnap.Start = start.Add(20 * time.Second)
+	expectSnap.Counts = [][]int64{
+		{0, 2, 0, 0},
+	}
+	if diff := deep.Equal(gotSnap, expectSnap); diff != nil {
+		t.Error(diff)
+	}
+}
+
+// --------------------------------------------------------------------------
+// History
+// --------------------------------------------------------------------------
+
+func TestHistory(t *testing.T) {
+	c := metrics.NewCounter()
+	h := metrics.NewHistory(c, 3)
+	if got := h.Snapshots(); len(got) != 0 {
+		t.Errorf("got %d snapshots, expected 0", len(got))
+	}
+
+	for i := 1; i <= 4; i++ {
+		c.Add(int64(i))
+		h.Snapshot(false) // not retained
+		h.Snapshot(true)
+	}
+	got := h.Snapshots()
+	expect := []metrics.Snapshot{
+		{N: 1, Sum: 2},
+		{N: 1, Sum: 3},
+		{N: 1, Sum: 4},
+	}
+	if diff := deep.Equal(got, expect); diff != nil {
+		t.Error(diff)
+	}
+
+	// Retained snapshots do not share a reused percentile map
+	hist := metrics.NewHistogram(metrics.Config{Percentiles: []float64{0.5}, ReusePercentileMap: true})
+	h = metrics.NewHistory(hist, 2)
+	for _, v := range []float64{1, 2} {
+		hist.Record(v)
+		h.Snapshot(true)
+	}
+	got = h.Snapshots()
+	if got[0].Percentile[0.5] != 1 || got[1].Percentile[0.5] != 2 {
+		t.Errorf("got P50 %f and %f, expected 1 and 2", got[0].Percentile[0.5], got[1].Percentile[0.5])
+	}
+}
+
+// --------------------------------------------------------------------------
+// Group
+// --------------------------------------------------------------------------
+
+func TestGroup(t *testing.T) {
+	g := metrics.NewGroup(p90Config)
+	for i, v := range control1 {
+		var err error
+		if i%4 == 0 {
+			err = fmt.Errorf("error %d", i)
+		}
+		g.Record(v, err)
+	}
+	gotSnap := g.Snapshot(true)
+	expectSnap := metrics.GroupSnapshot{
+		Requests: metrics.Snapshot{N: 12, Sum: 12},
+		Errors:   metrics.Snapshot{N: 3, Sum: 3},
+		Latency: metrics.Snapshot{
+			N:            int64(len(control1)),
+			Sum:          control1Sum,
+			SumOfSquares: control1SumSq,
+			Min:          control1Min,
+			Max:          control1Max,
+			Percentile: map[float64]float64{
+				0.90: control1P90,
+			},
+		},
+	}
+	if diff := deep.Equal(gotSnap, expectSnap); diff != nil {
+		t.Error(diff)
+	}
+
+	// Reset
+	gotSnap = g.Snapshot(true)
+	expectSnap = metrics.GroupSnapshot{}
+	if diff := deep.Equal(gotSnap, expectSnap); diff != nil {
+		t.Error(diff)
+	}
+
+	// Requests are counted even if their latency is dropped by the filter
+	g = metrics.NewGroup(metrics.Config{MinValue: 0, MaxValue: 10})
+	g.Record(5, nil)
+	g.Record(50, fmt.Errorf("timeout"))
+	gotSnap = g.Snapshot(true)
+	if gotSnap.Requests.N != 2 || gotSnap.Errors.N != 1 || gotSnap.Latency.N != 1 || gotSnap.DroppedLatency != 1 {
+		t.Errorf("got %d requests, %d errors, %d latency, %d dropped; expected 2, 1, 1, 1",
+			gotSnap.Requests.N, gotSnap.Errors.N, gotSnap.Latency.N, gotSnap.DroppedLatency)
+	}
+	if gotSnap = g.Snapshot(true); gotSnap.DroppedLatency != 0 {
+		t.Errorf("got %d dropped after reset, expected 0", gotSnap.DroppedLatency)
+	}
+}
+
+// --------------------------------------------------------------------------
+// Reconfigure
+// --------------------------------------------------------------------------
+
+func TestReconfigure(t *testing.T) {
+	type recorder interface {
+		Record(float64)
+		Snapshot(bool) metrics.Snapshot
+		Reconfigure(metrics.Config)
+	}
+	for _, m := range []recorder{metrics.NewGauge(p90Config), metrics.NewHistogram(p90Config)} {
+		for _, v := range control1 {
+			m.Record(v)
+		}
+		m.Reconfigure(metrics.Config{
+			Percentiles: []float64{0.5, 0.999},
+			SampleSize:  10,
+		})
+
+		// Not applied until reset, and the reset snapshot uses the old config
+		expect := map[float64]float64{0.90: control1P90}
+		if diff := deep.Equal(m.Snapshot(false).Percentile, expect); diff != nil {
+			t.Error(diff)
+		}
+		if diff := deep.Equal(m.Snapshot(true).Percentile, expect); diff != nil {
+			t.Error(diff)
+		}
+
+		// Applied: new percentiles from a sample of 10 values
+		for i := 1; i <= 100; i++ {
+			m.Record(float64(i))
+		}
+		gotSnap := m.Snapshot(true)
+		if gotSnap.N != 100 || gotSnap.Min != 1 || gotSnap.Max != 100 {
+			t.Errorf("got N=%d, Min=%f, Max=%f; expected 100, 1, 100", gotSnap.N, gotSnap.Min, gotSnap.Max)
+		}
+		if len(gotSnap.Percentile) != 2 {
+			t.Errorf("got percentiles %v, expected P50 and P999", gotSnap.Percentile)
+		}
+	}
+}
+
+func TestReconfigureLogScale(t *testing.T) {
+	// P50 of decades 1..1e5 interpolates between 100 and 1000: linearly 550,
+	// or geometrically 317 with LogScale
+	decades := []float64{1, 10, 100, 1000, 1e4, 1e5}
+	linear := metrics.Config{Percentiles: []float64{0.5}}
+	logScale := metrics.Config{Percentiles: []float64{0.5}, LogScale: true}
+	for _, m := range []metrics.Metric{metrics.NewGauge(linear), metrics.NewHistogram(linear)} {
+		r := m.(interface {
+			Record(float64)
+			Reconfigure(metrics.Config)
+		})
+		tests := []struct {
+			cfg    metrics.Config
+			expect float64
+		}{
+			{logScale, 317},
+			{logScale, 317},
+			{linear, 550}, // LogScale is not kept
+		}
+		for _, test := range tests {
+			r.Reconfigure(test.cfg)
+			m.Snapshot(true)
+			for _, v := range decades {
+				r.Record(v)
+			}
+			if p50 := m.Snapshot(false).Percentile[0.5]; math.Abs(p50-test.expect) > 0.1 {
+				t.Errorf("LogScale %v: got P50 %f, expected %f", test.cfg.LogScale, p50, test.expect)
+			}
+		}
+	}
+}
+
+// --------------------------------------------------------------------------
+// Transform
+// --------------------------------------------------------------------------
+
+func TestTransform(t *testing.T) {
+	// Convert milliseconds to seconds and drop negative values
+	cfg := metrics.Config{
+		Percentiles: []float64{0.5},
+		Thresholds:  []float64{0.1},
+		Transform: func(v float64) (float64, bool) {
+			return v / 1000, v >= 0
+		},
+	}
+	h := metrics.NewHistogram(cfg)
+	g := metrics.NewGauge(cfg)
+	for _, v := range []float64{-1, 50, 100, 200} {
+		h.Record(v)
+		g.Record(v)
+	}
+	h.RecordExemplar(-1, "dropped")
+	h.RecordExemplar(400, "trace-1")
+
+	gotSnap := h.Snapshot(true)
+	expectSnap := metrics.Snapshot{
+		N:            4,
+		Sum:          0.75,
+		SumOfSquares: 0.2125,
+		Min:          0.05,
+		Max:          0.4,
+		Percentile:   map[float64]float64{0.5: 0.15},
+		Threshold:    map[float64]int64{0.1: 2},
+		Exemplars:    []metrics.Exemplar{{Value: 0.4, Label: "trace-1"}},
+	}
+	gotSnap.Exemplars[0].Time = time.Time{}
+	if diff := deep.Equal(gotSnap, expectSnap); diff != nil {
+		t.Error(diff)
+	}
+
+	gotSnap = g.Snapshot(true)
+	if gotSnap.N != 3 || gotSnap.Last != 0.2 {
+		t.Errorf("got N=%d, Last=%f; expected 3, 0.2", gotSnap.N, gotSnap.Last)
+	}
+}
+
+func TestInvalidValues(t *testing.T) {
+	// Drop values outside [0, 10]
+	cfg := metrics.Config{
+		MinValue: 0,
+		MaxValue: 10,
+	}
+	h := metrics.NewHistogram(cfg)
+	for _, v := range []float64{-1, 0, 5, 10, math.MaxFloat64, math.NaN()} {
+		h.Record(v)
+	}
+	gotSnap := h.Snapshot(true)
+	expectSnap := metrics.Snapshot{
+		N:            3,
+		Sum:          15,
+		SumOfSquares: 125,
+		Min:          0,
+		Max:          10,
+		Percentile:   map[float64]float64{},
+		Invalid:      3,
+	}
+	if diff := deep.Equal(gotSnap, expectSnap); diff != nil {
+		t.Error(diff)
+	}
+
+	// Reset
+	gotSnap = h.Snapshot(true)
+	if diff := deep.Equal(gotSnap, metrics.Snapshot{}); diff != nil {
+		t.Error(diff)
+	}
+
+	// Clamp, but NaN is still dropped
+	cfg.ClampInvalid = true
+	g := metrics.NewGauge(cfg)
+	for _, v := range []float64{-1, 5, math.NaN(), math.MaxFloat64} {
+		g.Record(v)
+	}
+	gotSnap = g.Snapshot(true)
+	expectSnap = metrics.Snapshot{
+		N:            3,
+		Sum:          15,
+		SumOfSquares: 125,
+		Min:          0,
+		Max:          10,
+		Percentile:   map[float64]float64{},
+		Last:         10,
+		Invalid:      3,
+	}
+	if diff := deep.Equal(gotSnap, expectSnap); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestOutliers(t *testing.T) {
+	h := metrics.NewHistogram(metrics.Config{OutlierStdDevs: 5})
+	g := metrics.NewGauge(metrics.Config{OutlierMaxDeviation: 20})
+	for i := 0; i < 200; i++ {
+		v := float64(9 + 2*(i%2)) // 9, 11, ... so mean 10 and stddev 1
+		h.Record(v)
+		g.Record(v)
+	}
+	h.Snapshot(true)
+	g.Snapshot(true)
+
+	for _, v := range []float64{1000, 12, 10, 31, 29} {
+		h.Record(v)
+		g.Record(v)
+	}
+
+	// 1000 does not skew the running mean or stddev, so 31 and 29 are more
+	// than 5 stddevs from 10, but only 31 is more than 20 from 10
+	gotSnap := h.Snapshot(true)
+	if gotSnap.N != 2 || gotSnap.Max != 12 || gotSnap.Rejected != 3 {
+		t.Errorf("got N=%d, Max=%f, Rejected=%d; expected 2, 12, 3", gotSnap.N, gotSnap.Max, gotSnap.Rejected)
+	}
+	gotSnap = g.Snapshot(true)
+	if gotSnap.N != 3 || gotSnap.Max != 29 || gotSnap.Rejected != 2 {
+		t.Errorf("got N=%d, Max=%f, Rejected=%d; expected 3, 29, 2", gotSnap.N, gotSnap.Max, gotSnap.Rejected)
+	}
+}
+
+func TestLogScale(t *testing.T) {
+	values := []float64{1, 100, 10000, 1000000}
+	linear := metrics.NewHistogram(metrics.Config{Percentiles: []float64{0.5}})
+	logScale := metrics.NewHistogram(metrics.Config{Percentiles: []float64{0.5}, LogScale: true})
+	for _, v := range values {
+		linear.Record(v)
+		logScale.Record(v)
+	}
+
+	// Interpolated between 100 and 10,000: arithmetic vs. geometric
+	gotSnap := linear.Snapshot(true)
+	if p50 := gotSnap.Percentile[0.5]; p50 < 5000 {
+		t.Errorf("linear P50 = %f, expected > 5000", p50)
+	}
+	gotSnap = logScale.Snapshot(true)
+	if p50 := gotSnap.Percentile[0.5]; p50 < 900 || p50 > 1100 {
+		t.Errorf("log scale P50 = %f, expected about 1000", p50)
+	}
+
+	// Not log scale
+	expectSnap := metrics.Snapshot{
+		N:            4,
+		Sum:          1010101,
+		SumOfSquares: 1000100010001,
+		Min:          1,
+		Max:          1000000,
+		Percentile:   gotSnap.Percentile,
+	}
+	if diff := deep.Equal(gotSnap, expectSnap); diff != nil {
+		t.Error(diff)
+	}
+
+	// Reset
+	gotSnap = logScale.Snapshot(true)
+	if diff := deep.Equal(gotSnap, metrics.Snapshot{}); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestCountPanics(t *testing.T) {
+	c := metrics.NewErrorCounter(nil)
+	recovered := func(fn func()) (v interface{}) {
+		defer func() { v = recover() }()
+		metrics.CountPanics(c, fn)
+		return nil
+	}
+	if v := recovered(func() {}); v != nil {
+		t.Errorf("recovered %v, expected nil", v)
+	}
+	if v := recovered(func() { panic("oops") }); v != "oops" {
+		t.Errorf("recovered %v, expected oops", v)
+	}
+	recovered(func() {
+		var m map[string]int
+		m["x"] = 1 // nil map
+	})
+	recovered(func() { panic(fmt.Errorf("error")) })
+
+	got := map[string]int64{}
+	for class, counter := range c.Counters() {
+		got[class] = counter.Count()
+	}
+	expect := map[string]int64{
+		"string":              1,
+		"runtime.Error":       1,
+		"*errors.errorString": 1,
+	}
+	if diff := deep.Equal(got, expect); diff != nil {
+		t.Error(diff)
+	}
+}
+
+// --------------------------------------------------------------------------
+// Info
+// --------------------------------------------------------------------------
+
+func TestInfo(t *testing.T) {
+	labels := map[string]string{"version": "v1.0.0"}
+	i := metrics.NewInfo(labels)
+	labels["version"] = "v2.0.0" // copied, so not changed
+	i.Labels()["version"] = "v3.0.0"
+	if diff := deep.Equal(i.Labels(), map[string]string{"version": "v1.0.0"}); diff != nil {
+		t.Error(diff)
+	}
+	if diff := deep.Equal(i.Snapshot(true), metrics.Snapshot{N: 1, Sum: 1}); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestInfoGauge(t *testing.T) {
+	labels := map[string]string{"config": "abc123"}
+	i := metrics.NewInfoGauge(labels)
+	labels["config"] = "def456" // copied, so not changed
+	i.Labels()["config"] = "def456"
+	if diff := deep.Equal(i.Labels(), map[string]string{"config": "abc123"}); diff != nil {
+		t.Error(diff)
+	}
+
+	i.Set("config", "def456")
+	i.Set("flags", "a,b")
+	if diff := deep.Equal(i.Labels(), map[string]string{"config": "def456", "flags": "a,b"}); diff != nil {
+		t.Error(diff)
+	}
+	i.Delete("flags")
+	if diff := deep.Equal(i.Labels(), map[string]string{"config": "def456"}); diff != nil {
+		t.Error(diff)
+	}
+
+	labels = map[string]string{"flags": "c"}
+	i.SetLabels(labels)
+	labels["flags"] = "d" // copied, so not changed
+	if diff := deep.Equal(i.Labels(), map[string]string{"flags": "c"}); diff != nil {
+		t.Error(diff)
+	}
+	if diff := deep.Equal(i.Snapshot(true), metrics.Snapshot{N: 1, Sum: 1}); diff != nil {
+		t.Error(diff)
+	}
+}
+
+// --------------------------------------------------------------------------
+// ErrorCounter
+// --------------------------------------------------------------------------
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string { return "i/o timeout" }
+func (timeoutError) Timeout() bool { return true }
+
+func TestErrorCounter(t *testing.T) {
+	c := metrics.NewErrorCounter(nil)
+	c.Record(nil)
+	c.Record(context.DeadlineExceeded)
+	c.Record(fmt.Errorf("read: %w", timeoutError{}))
+	c.Record(fmt.Errorf("query: %w", context.Canceled))
+	c.Record(fmt.Errorf("other"))
+
+	got := map[string]int64{}
+	for class, counter := range c.Counters() {
+		got[class] = counter.Count()
+	}
+	expect := map[string]int64{
+		metrics.ErrorTimeout:  2,
+		metrics.ErrorCanceled: 1,
+		metrics.ErrorOther:    1,
+	}
+	if diff := deep.Equal(got, expect); diff != nil {
+		t.Error(diff)
+	}
+
+	// Custom classifier that extends the default
+	errServer := fmt.Errorf("500 Internal Server Error")
+	c = metrics.NewErrorCounter(func(err error) string {
+		if err == errServer {
+			return "5xx"
+		}
+		return metrics.ClassifyError(err)
+	})
+	c.Record(errServer)
+	c.Record(context.Canceled)
+	if n := c.Counter("5xx").Count(); n != 1 {
+		t.Errorf("5xx count %d, expected 1", n)
+	}
+	if n := c.Counter(metrics.ErrorCanceled).Count(); n != 1 {
+		t.Errorf("canceled count %d, expected 1", n)
+	}
+}
+
+// --------------------------------------------------------------------------
+// RuntimeMetric
+// --------------------------------------------------------------------------
+
+func TestRuntimeMetric(t *testing.T) {
+	if _, err := metrics.NewRuntimeMetric("/no/such:metric", metrics.Config{}); err != metrics.ErrUnknownRuntimeMetric {
+		t.Errorf("got error %v, expected ErrUnknownRuntimeMetric", err)
+	}
+
+	// Gauge
+	goroutines, err := metrics.NewRuntimeMetric("/sched/goroutines:goroutines", metrics.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotSnap := goroutines.Snapshot(true); gotSnap.N != 1 || gotSnap.Last < 1 {
+		t.Errorf("got N=%d, Last=%f; expected 1, >= 1", gotSnap.N, gotSnap.Last)
+	}
+
+	// Counter
+	gcs, err := metrics.NewRuntimeMetric("/gc/cycles/total:gc-cycles", metrics.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcs.Snapshot(true)
+	runtime.GC()
+	runtime.GC()
+	if gotSnap := gcs.Snapshot(true); gotSnap.Sum < 2 {
+		t.Errorf("got Sum=%f, expected >= 2 GC cycles", gotSnap.Sum)
+	}
+
+	// Histogram
+	latencies, err := metrics.NewRuntimeMetric("/sched/latencies:seconds", p999Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotSnap := latencies.Snapshot(false)
+	if gotSnap.N < 1 {
+		t.Fatalf("got N=%d, expected > 0 scheduling latencies since start", gotSnap.N)
+	}
+	if p := gotSnap.Percentile[0.999]; p < gotSnap.Min || p > gotSnap.Max {
+		t.Errorf("P999 %f not between Min %f and Max %f", p, gotSnap.Min, gotSnap.Max)
+	}
+}
+
+func TestGCPauseCollector(t *testing.T) {
+	c := metrics.NewGCPauseCollector(metrics.Config{Percentiles: []float64{0.99}})
+	runtime.GC()
+	runtime.GC()
+	runtime.GC()
+	c.Collect()
+	gotSnap := c.Pauses.Snapshot(true)
+	if gotSnap.N < 3 { // more if the runtime started a GC too
+		t.Errorf("got N=%d, expected >= 3 GC pauses", gotSnap.N)
+	}
+	if gotSnap.Max <= 0 || gotSnap.Percentile[0.99] <= 0 {
+		t.Errorf("got Max=%f, P99=%f; expected > 0", gotSnap.Max, gotSnap.Percentile[0.99])
+	}
+
+	c.Collect() // no GCs since last Collect
+	if gotSnap := c.Pauses.Snapshot(true); gotSnap.N != 0 {
+		t.Errorf("got N=%d, expected 0", gotSnap.N)
+	}
+}
+
+func TestGoroutineWatchdog(t *testing.T) {
+	w := metrics.NewGoroutineWatchdog(3)
+	for i, n := range []int{10, 12, 11, 13, 15, 20, 20} {
+		metrics.CollectGoroutines(w, n)
+		expectLeak := i == 5 // 11 -> 13 -> 15 -> 20
+		if w.Leak() != expectLeak {
+			t.Errorf("%d goroutines: Leak() = %t, expected %t", n, w.Leak(), expectLeak)
+		}
+	}
+	if got := w.Growth.Last(); got != 0 {
+		t.Errorf("Growth %f, expected 0", got)
+	}
+	gotSnap := w.Growth.Snapshot(true)
+	if gotSnap.N != 6 || gotSnap.Sum != 10 || gotSnap.Max != 5 {
+		t.Errorf("got Growth N=%d, Sum=%f, Max=%f; expected 6, 10, 5", gotSnap.N, gotSnap.Sum, gotSnap.Max)
+	}
+
+	w.Collect()
+	if got := w.Goroutines.Last(); got < 1 {
+		t.Errorf("Goroutines %f, expected >= 1", got)
+	}
+
+	// Reporting Suspected (reset) does not clear Leak
+	w = metrics.NewGoroutineWatchdog(1)
+	metrics.CollectGoroutines(w, 10)
+	metrics.CollectGoroutines(w, 11)
+	w.Suspected.Snapshot(true)
+	if !w.Leak() {
+		t.Error("Leak() = false after Suspected snapshot, expected true")
+	}
+
+	// Less than 1 interval is invalid
+	defer func() {
+		err, _ := recover().(error)
+		if !errors.Is(err, metrics.ErrInvalidConfig) {
+			t.Errorf("got panic %v, expected ErrInvalidConfig", err)
+		}
+	}()
+	metrics.NewGoroutineWatchdog(0)
+}
+
+// --------------------------------------------------------------------------
+// Resolver
+// --------------------------------------------------------------------------
+
+func TestResolver(t *testing.T) {
+	// Go resolver that cannot reach a DNS server, so only /etc/hosts works
+	r := metrics.NewResolver(&net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return nil, fmt.Errorf("no DNS in test")
+		},
+	}, metrics.Config{})
+
+	if _, err := r.LookupMX(context.Background(), "example.invalid"); err == nil {
+		t.Error("LookupMX: no error, expected error")
+	}
+	if n := r.Errors(metrics.LookupMX).Count(); n != 1 {
+		t.Errorf("LookupMX errors %d, expected 1", n)
+	}
+	if gotSnap := r.Latency(metrics.LookupMX).Snapshot(true); gotSnap.N != 1 {
+		t.Errorf("LookupMX latency N=%d, expected 1", gotSnap.N)
+	}
+
+	r.LookupPort(context.Background(), "tcp", "80") // numeric, no lookup
+	if n := r.Errors(metrics.LookupPort).Count(); n != 0 {
+		t.Errorf("LookupPort errors %d, expected 0", n)
+	}
+	if gotSnap := r.Latency(metrics.LookupPort).Snapshot(true); gotSnap.N != 1 {
+		t.Errorf("LookupPort latency N=%d, expected 1", gotSnap.N)
+	}
+
+	if r.Latency("bad") != nil || r.Errors("bad") != nil {
+		t.Error("metrics for invalid lookup type, expected nil")
+	}
+}
+
+// --------------------------------------------------------------------------
+// ConnMetrics
+// --------------------------------------------------------------------------
+
+func TestConnMetrics(t *testing.T) {
+	m := metrics.NewConnMetrics(metrics.Config{})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln = m.Listener(ln)
+	defer ln.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c, err := ln.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		buf := make([]byte, 5)
+		if _, err := c.Read(buf); err != nil {
+			t.Error(err)
+		}
+		// ReadFrom and half-close of the *net.TCPConn are not hidden
+		if _, ok := c.(io.ReaderFrom); !ok {
+			t.Error("conn does not implement io.ReaderFrom")
+		}
+		io.Copy(c, bytes.NewReader([]byte("world!")))
+		if cw, ok := c.(interface{ CloseWrite() error }); !ok {
+			t.Error("conn does not implement CloseWrite")
+		} else if err := cw.CloseWrite(); err != nil {
+			t.Error(err)
+		}
+		c.Close()
+		c.Close() // counted once
+	}()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Write([]byte("hello"))
+	if got, err := io.ReadAll(client); string(got) != "world!" || err != nil {
+		t.Errorf("client read %q, %v; expected world! and EOF from CloseWrite", got, err)
+	}
+	<-done
+	client.Close()
+
+	got := map[string]int64{
+		"Accepted":     m.Accepted.Count(),
+		"Closed":       m.Closed.Count(),
+		"Open":         m.Open.InFlight(),
+		"BytesRead":    m.BytesRead.Count(),
+		"BytesWritten": m.BytesWritten.Count(),
+		"Lifetime":     m.Lifetime.Snapshot(true).N,
+	}
+	expect := map[string]int64{
+		"Accepted":     1,
+		"Closed":       1,
+		"Open":         0,
+		"BytesRead":    5,
+		"BytesWritten": 6,
+		"Lifetime":     1,
+	}
+	if diff := deep.Equal(got, expect); diff != nil {
+		t.Error(diff)
+	}
+	if gotSnap := m.Open.Snapshot(true); gotSnap.Max != 1 {
+		t.Errorf("Open Max %f, expected 1", gotSnap.Max)
+	}
+
+	// Supply only some metrics
+	m = &metrics.ConnMetrics{Closed: metrics.NewCounter()}
+	c1, c2 := net.Pipe()
+	c := m.Conn(c1)
+	if _, ok := c.(interface{ CloseWrite() error }); ok {
+		t.Error("net.Pipe conn implements CloseWrite")
+	}
+	c.Close()
+	c2.Close()
+	if n := m.Closed.Count(); n != 1 {
+		t.Errorf("Closed %d, expected 1", n)
+	}
+}
+
+// --------------------------------------------------------------------------
+// CountingReader and CountingWriter
+// --------------------------------------------------------------------------
+
+func TestCountingReaderWriter(t *testing.T) {
+	readBytes := metrics.NewCounter()
+	readLatency := metrics.NewHistogram(metrics.Config{})
+	writeBytes := metrics.NewCounter()
+
+	var buf bytes.Buffer
+	w := metrics.NewCountingWriter(&buf, writeBytes, nil)
+	r := metrics.NewCountingReader(bytes.NewReader([]byte("hello, world")), readBytes, readLatency)
+	n, err := io.CopyBuffer(w, r, make([]byte, 5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 12 || buf.String() != "hello, world" {
+		t.Errorf("copied %d bytes %q, expected 12 bytes \"hello, world\"", n, buf.String())
+	}
+	if n := readBytes.Count(); n != 12 {
+		t.Errorf("read bytes %d, expected 12", n)
+	}
+	if n := writeBytes.Count(); n != 12 {
+		t.Errorf("written bytes %d, expected 12", n)
+	}
+	// 3 reads of data, then 1 read returns io.EOF
+	if gotSnap := readLatency.Snapshot(true); gotSnap.N != 4 {
+		t.Errorf("read latency N=%d, expected 4", gotSnap.N)
+	}
+}
+
+// --------------------------------------------------------------------------
+// Hook
+// --------------------------------------------------------------------------
+
+func TestCallMetrics(t *testing.T) {
+	m := metrics.NewCallMetrics(metrics.Config{})
+	var h metrics.Hook = m
+
+	errPublish := fmt.Errorf("broker down")
+	metrics.Call(h, "get", func() error {
+		if n := m.InFlight("get").InFlight(); n != 1 {
+			t.Errorf("in flight %d, expected 1", n)
+		}
+		return nil
+	})
+	if err := metrics.Call(h, "publish", func() error { return errPublish }); err != errPublish {
+		t.Errorf("got error %v, expected %v", err, errPublish)
+	}
+	h.BeforeCall("get")
+	h.AfterCall("get", 5*time.Millisecond, nil)
+
+	names := m.Names()
+	sort.Strings(names)
+	if diff := deep.Equal(names, []string{"get", "publish"}); diff != nil {
+		t.Error(diff)
+	}
+	gotSnap := m.Latency("get").Snapshot(true)
+	if gotSnap.N != 2 || gotSnap.Max < 0.005 {
+		t.Errorf("get latency N=%d, Max=%f; expected 2, >= 0.005", gotSnap.N, gotSnap.Max)
+	}
+	if n := m.Errors("get").Count(); n != 0 {
+		t.Errorf("get errors %d, expected 0", n)
+	}
+	if n := m.Errors("publish").Count(); n != 1 {
+		t.Errorf("publish errors %d, expected 1", n)
+	}
+	if n := m.InFlight("get").InFlight(); n != 0 {
+		t.Errorf("get in flight %d, expected 0", n)
+	}
+}
+
+// --------------------------------------------------------------------------
+// Encoding
+// --------------------------------------------------------------------------
+
+// testBatch returns a Batch with one of each type of snapshot.
+func testBatch() metrics.Batch {
+	h := metrics.NewHistogram(metrics.Config{
+		Percentiles: []float64{0.5, 0.9},
+		Thresholds:  []float64{95.15},
+	})
+	for _, v := range control1 {
+		h.Record(v)
+	}
+	h.RecordExemplar(95.3, "trace-1")
+	c := metrics.NewCounter()
+	c.Add(3)
+	g := metrics.NewGauge(metrics.Config{})
+	g.Record(-1.5)
+	sampled := metrics.NewHistogram(metrics.Config{RecordEvery: 4})
+	for i := 1; i <= 10; i++ {
+		sampled.Record(float64(i))
+	}
+	return metrics.Batch{
+		Version: metrics.BatchVersion,
+		Time:    time.Date(2021, 1, 2, 3, 4, 5, 6, time.UTC),
+		Snapshots: map[string]metrics.Snapshot{
+			"latency": h.Snapshot(true),
+			"queries": c.Snapshot(true),
+			"temp":    g.Snapshot(true),
+			"sampled": sampled.Snapshot(true),
+			"empty":   {},
+		},
+	}
+}
+
+func TestGob(t *testing.T) {
+	expect := testBatch()
+	var buf bytes.Buffer
+	if err := metrics.EncodeGob(&buf, expect); err != nil {
+		t.Fatal(err)
+	}
+	got, err := metrics.DecodeGob(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(got, expect); diff != nil {
+		t.Error(diff)
+	}
+
+	// A batch from a newer version with an unknown field
+	type newerBatch struct {
+		Version   int
+		Time      time.Time
+		Snapshots map[string]metrics.Snapshot
+		Labels    map[string]string
+	}
+	buf.Reset()
+	err = gob.NewEncoder(&buf).Encode(newerBatch{
+		Version:   metrics.BatchVersion + 1,
+		Time:      expect.Time,
+		Snapshots: expect.Snapshots,
+		Labels:    map[string]string{"host": "db1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = metrics.DecodeGob(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect.Version = metrics.BatchVersion + 1
+	if diff := deep.Equal(got, expect); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestGobStream(t *testing.T) {
+	// Many batches on one stream that is not an io.ByteReader, so a decoder
+	// per batch would lose data that it buffered
+	expect := make([]metrics.Batch, 3)
+	for i := range expect {
+		expect[i] = testBatch()
+		expect[i].Time = expect[i].Time.Add(time.Duration(i) * time.Second)
+	}
+	r, w := io.Pipe()
+	go func() {
+		enc := metrics.NewGobEncoder(w)
+		for _, b := range expect {
+			if err := enc.Encode(b); err != nil {
+				t.Error(err)
+			}
+		}
+		w.Close()
+	}()
+	dec := metrics.NewGobDecoder(r)
+	for i := range expect {
+		got, err := dec.Decode()
+		if err != nil {
+			t.Fatalf("batch %d: %s", i, err)
+		}
+		if diff := deep.Equal(got, expect[i]); diff != nil {
+			t.Errorf("batch %d: %v", i, diff)
+		}
+	}
+	if _, err := dec.Decode(); err != io.EOF {
+		t.Errorf("got error %v after the last batch, expected io.EOF", err)
+	}
+}
+
+func TestMsgPack(t *testing.T) {
+	expect := testBatch()
+	var buf bytes.Buffer
+	if err := metrics.EncodeMsgPack(&buf, expect); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	got, err := metrics.DecodeMsgPack(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(got, expect); diff != nil {
+		t.Error(diff)
+	}
+
+	// Truncated: the data ends, or if the bytes left are known, a length is
+	// more than the bytes left
+	_, err = metrics.DecodeMsgPack(iotest.OneByteReader(bytes.NewReader(data[:len(data)/2])))
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("got err %v, expected io.ErrUnexpectedEOF", err)
+	}
+	_, err = metrics.DecodeMsgPack(bytes.NewReader(data[:len(data)/2]))
+	if err != io.ErrUnexpectedEOF && err != metrics.ErrMsgPack {
+		t.Errorf("got err %v, expected io.ErrUnexpectedEOF or ErrMsgPack", err)
+	}
+
+	// Unknown keys are skipped: {"x": [1, "a", {}], "s": {}}
+	data = []byte{0x82, 0xa1, 'x', 0x93, 0x01, 0xa1, 'a', 0x80, 0xa1, 's', 0x80}
+	got, err = metrics.DecodeMsgPack(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(got, metrics.Batch{Snapshots: map[string]metrics.Snapshot{}}); diff != nil {
+		t.Error(diff)
+	}
+
+	// Not a map
+	if _, err = metrics.DecodeMsgPack(bytes.NewReader([]byte{0x01})); err != metrics.ErrMsgPack {
+		t.Errorf("got err %v, expected ErrMsgPack", err)
+	}
+
+	// Corrupt lengths: a map32 of 4 billion items, a str32 of 2 GB, a map32
+	// of percentiles, and arrays nested too deep
+	corrupt := [][]byte{
+		{0xdf, 0xff, 0xff, 0xff, 0xff, 0xa1, 's', 0x80},
+		{0x81, 0xdb, 0x7f, 0xff, 0xff, 0xff, 's'},
+		{0x81, 0xa1, 's', 0x81, 0xa1, 'a', 0x81, 0xa1, 'p', 0xdf, 0xff, 0xff, 0xff, 0xff},
+		append([]byte{0x81, 0xa1, 'x'}, bytes.Repeat([]byte{0x91}, 100)...),
+	}
+	testCorrupt(t, corrupt, metrics.ErrMsgPack, metrics.DecodeMsgPack)
+}
+
+// testCorrupt tests that decode returns errInvalid for each corrupt data if
+// the bytes left are known (bytes.Reader), and an error if not. It also tests
+// that every prefix of the data, which is truncated, returns an error.
+func testCorrupt(t *testing.T, corrupt [][]byte, errInvalid error, decode func(io.Reader) (metrics.Batch, error)) {
+	t.Helper()
+	for i, data := range corrupt {
+		if _, err := decode(bytes.NewReader(data)); err != errInvalid {
+			t.Errorf("corrupt %d: got err %v, expected %v", i, err, errInvalid)
+		}
+		if _, err := decode(iotest.OneByteReader(bytes.NewReader(data))); err == nil {
+			t.Errorf("corrupt %d: got nil err from io.Reader", i)
+		}
+		for n := range data {
+			if _, err := decode(bytes.NewReader(data[:n])); err == nil {
+				t.Errorf("corrupt %d: got nil err for %d bytes", i, n)
+			}
+		}
+	}
+}
+
+func TestCBOR(t *testing.T) {
+	expect := testBatch()
+	var buf bytes.Buffer
+	if err := metrics.EncodeCBOR(&buf, expect); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	got, err := metrics.DecodeCBOR(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(got, expect); diff != nil {
+		t.Error(diff)
+	}
+
+	// Deterministic: same bytes despite random map order
+	for i := 0; i < 10; i++ {
+		buf.Reset()
+		metrics.EncodeCBOR(&buf, expect)
+		if !bytes.Equal(buf.Bytes(), data) {
+			t.Fatal("encoding is not deterministic")
+		}
+	}
+
+	// Sorted keys and shortest floats: 1.5 is the half 0x3e00
+	buf.Reset()
+	metrics.EncodeCBOR(&buf, metrics.Batch{
+		Time:      time.Unix(0, 0),
+		Snapshots: map[string]metrics.Snapshot{"c": {N: 1, Sum: 1.5}},
+	})
+	expectBytes := []byte{
+		0xa3, 0x61, 's', 0xa1, 0x61, 'c',
+		0xa2, 0x61, 'n', 0x01, 0x63, 's', 'u', 'm', 0xf9, 0x3e, 0x00,
+		0x61, 't', 0xc0, 0x74,
+	}
+	expectBytes = append(expectBytes, "1970-01-01T00:00:00Z"...)
+	expectBytes = append(expectBytes, 0x61, 'v', metrics.BatchVersion)
+	if !bytes.Equal(buf.Bytes(), expectBytes) {
+		t.Errorf("got % x, expected % x", buf.Bytes(), expectBytes)
+	}
+
+	// Floats round trip exactly as half, single, or double
+	floats := []float64{65504, -5.960464477539063e-08, 6.103515625e-05, 0.1, 1e300, math.Inf(-1)}
+	for _, f := range floats {
+		buf.Reset()
+		metrics.EncodeCBOR(&buf, metrics.Batch{Snapshots: map[string]metrics.Snapshot{"f": {Last: f}}})
+		got, err := metrics.DecodeCBOR(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Snapshots["f"].Last != f {
+			t.Errorf("got %v, expected %v", got.Snapshots["f"].Last, f)
+		}
+	}
+
+	// Unknown keys are skipped: {"x": [1, "a", {}], "s": {}}
+	data = []byte{0xa2, 0x61, 'x', 0x83, 0x01, 0x61, 'a', 0xa0, 0x61, 's', 0xa0}
+	got, err = metrics.DecodeCBOR(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(got, metrics.Batch{Snapshots: map[string]metrics.Snapshot{}}); diff != nil {
+		t.Error(diff)
+	}
+
+	// Not a map
+	if _, err = metrics.DecodeCBOR(bytes.NewReader([]byte{0x01})); err != metrics.ErrCBOR {
+		t.Errorf("got err %v, expected ErrCBOR", err)
+	}
+
+	// Corrupt lengths: maps of 4 billion and 2^64-1 items, a text of 2 GB, a
+	// map of percentiles, and arrays and tags nested too deep
+	corrupt := [][]byte{
+		{0xba, 0xff, 0xff, 0xff, 0xff, 0x61, 's', 0xa0},
+		{0xbb, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x61, 's', 0xa0},
+		{0xa1, 0x7a, 0x7f, 0xff, 0xff, 0xff, 's'},
+		{0xa1, 0x61, 's', 0xa1, 0x61, 'a', 0xa1, 0x61, 'p', 0xba, 0xff, 0xff, 0xff, 0xff},
+		append([]byte{0xa1, 0x61, 'x'}, bytes.Repeat([]byte{0x81}, 100)...),
+		append([]byte{0xa1, 0x61, 'x'}, bytes.Repeat([]byte{0xc0}, 100)...),
+	}
+	testCorrupt(t, corrupt, metrics.ErrCBOR, metrics.DecodeCBOR)
+}
+
+// --------------------------------------------------------------------------
+// Downsampling
+// --------------------------------------------------------------------------
+
+func TestRecordEvery(t *testing.T) {
+	h := metrics.NewHistogram(metrics.Config{
+		Percentiles: []float64{0.5},
+		Thresholds:  []float64{500},
+		RecordEvery: 10,
+	})
+	var sumSq float64
+	for i := 1; i <= 1000; i++ {
+		h.Record(float64(i))
+		sumSq += float64(i * i)
+	}
+	// N, Sum, and SumOfSquares are exact; the rest are from 10, 20, ..., 1000,
+	// and the Threshold count (50) is scaled by 10
+	expect := metrics.Snapshot{
+		N:            1000,
+		Sum:          500500,
+		SumOfSquares: sumSq,
+		Min:          10,
+		Max:          1000,
+		Percentile:   map[float64]float64{0.5: 505},
+		Threshold:    map[float64]int64{500: 500},
+		SampleRate:   0.1,
+	}
+	gotSnap := h.Snapshot(false)
+	if diff := deep.Equal(gotSnap, expect); diff != nil {
+		t.Error(diff)
+	}
+	if diff := deep.Equal(h.Snapshot(true), expect); diff != nil {
+		t.Error(diff)
+	}
+	if n := h.Snapshot(true).N; n != 0 {
+		t.Errorf("got N %d after reset, expected 0", n)
+	}
+}
+
+func TestRecordEveryThresholds(t *testing.T) {
+	// Values not recorded are not counted as over the threshold
+	h := metrics.NewHistogram(metrics.Config{
+		Thresholds:  []float64{1},
+		RecordEvery: 10,
+	})
+	for i := 0; i < 1000; i++ {
+		h.Record(0.5)
+	}
+	gotSnap := h.Snapshot(true)
+	if n, _ := gotSnap.Under(1); n != 1000 {
+		t.Errorf("got Under %d, expected 1000", n)
+	}
+	if n, _ := gotSnap.Over(1); n != 0 {
+		t.Errorf("got Over %d, expected 0", n)
+	}
+	buckets := gotSnap.CumulativeBuckets()
+	if buckets[0].Count != buckets[1].Count {
+		t.Errorf("got buckets %+v, expected +Inf count = le 1 count", buckets)
+	}
+}
+
+func TestRecordProbability(t *testing.T) {
+	h := metrics.NewHistogram(metrics.Config{
+		Percentiles:       []float64{0.5},
+		Thresholds:        []float64{500},
+		RecordProbability: 0.1,
+	})
+	// 100k values 1..1000: mean 500.5, variance (1000²-1)/12, half <= 500
+	for i := 0; i < 100000; i++ {
+		h.Record(float64(i%1000 + 1))
+	}
+	gotSnap := h.Snapshot(true)
+	if gotSnap.N < 95000 || gotSnap.N > 105000 {
+		t.Errorf("got N %d, expected about 100000", gotSnap.N)
+	}
+	if mean := gotSnap.Sum / float64(gotSnap.N); math.Abs(mean-500.5) > 15 {
+		t.Errorf("got mean %f, expected about 500.5", mean)
+	}
+	if v := gotSnap.Variance(); math.Abs(v-83333.25)/83333.25 > 0.05 {
+		t.Errorf("got variance %f, expected about 83333.25", v)
+	}
+	if n := gotSnap.Threshold[500]; math.Abs(float64(n)/float64(gotSnap.N)-0.5) > 0.02 {
+		t.Errorf("got %d values <= 500 of N %d, expected about half", n, gotSnap.N)
+	}
+	if p50 := gotSnap.Percentile[0.5]; math.Abs(p50-500) > 50 {
+		t.Errorf("got P50 %f, expected about 500", p50)
+	}
+}
+
+func TestDownsampleRecordPaths(t *testing.T) {
+	// Group ignores downsampling: latency N equals requests
+	g := metrics.NewGroup(metrics.Config{RecordProbability: 0.01})
+	for i := 0; i < 1000; i++ {
+		g.Record(1, nil)
+	}
+	gs := g.Snapshot(true)
+	if gs.Latency.N != 1000 || gs.Requests.N != 1000 || gs.Latency.SampleRate != 0 {
+		t.Errorf("got latency N %d, requests N %d, rate %v; expected 1000, 1000, 0",
+			gs.Latency.N, gs.Requests.N, gs.Latency.SampleRate)
+	}
+
+	// RecordExemplar and LocalHistogram are downsampled like Record, so N is
+	// not scaled for values that were not sampled
+	cfg := metrics.Config{RecordEvery: 10}
+	h := metrics.NewHistogram(cfg)
+	for i := 0; i < 100; i++ {
+		h.RecordExemplar(1, "a")
+	}
+	if n := h.Snapshot(true).N; n != 100 {
+		t.Errorf("RecordExemplar: got N %d, expected 100", n)
+	}
+	l := h.Local(10, 0)
+	for i := 0; i < 100; i++ {
+		l.Record(1)
+	}
+	l.Flush()
+	if n := h.Snapshot(true).N; n != 100 {
+		t.Errorf("LocalHistogram: got N %d, expected 100", n)
+	}
+
+	h = metrics.NewHistogram(metrics.Config{RecordProbability: 0.5})
+	for i := 0; i < 10000; i++ {
+		h.RecordExemplar(1, "a")
+	}
+	if n := h.Snapshot(true).N; n < 9000 || n > 11000 {
+		t.Errorf("RecordExemplar: got N %d, expected about 10000", n)
+	}
+}
+
+func TestRecordTarget(t *testing.T) {
+	h := metrics.NewHistogram(metrics.Config{RecordTarget: 1000})
+	record := func(n int) {
+		for i := 0; i < n; i++ {
+			h.Record(1)
+		}
+	}
+
+	// First interval: all values recorded
+	record(10000)
+	if gotSnap := h.Snapshot(true); gotSnap.N != 10000 || gotSnap.SampleRate != 1 {
+		t.Errorf("got N %d, rate %f; expected 10000, 1", gotSnap.N, gotSnap.SampleRate)
+	}
+
+	// 10x the target, so 1 in 10 values recorded and counts scaled
+	record(10000)
+	gotSnap := h.Snapshot(true)
+	if gotSnap.SampleRate != 0.1 {
+		t.Errorf("got rate %f, expected 0.1", gotSnap.SampleRate)
+	}
+	if gotSnap.N < 8000 || gotSnap.N > 12000 || gotSnap.Sum != float64(gotSnap.N) {
+		t.Errorf("got N %d, Sum %f; expected about 10000", gotSnap.N, gotSnap.Sum)
+	}
+
+	// Volume drops: rate is still about 0.1 (from the estimated N) for this
+	// interval, then back to 1
+	record(500)
+	if gotSnap := h.Snapshot(true); math.Abs(gotSnap.SampleRate-0.1) > 0.02 {
+		t.Errorf("got rate %f, expected about 0.1", gotSnap.SampleRate)
+	}
+	record(500)
+	if gotSnap := h.Snapshot(true); gotSnap.N != 500 || gotSnap.SampleRate != 1 {
+		t.Errorf("got N %d, rate %f; expected 500, 1", gotSnap.N, gotSnap.SampleRate)
+	}
+}
+
+// --------------------------------------------------------------------------
+// Priming
+// --------------------------------------------------------------------------
+
+func TestPrime(t *testing.T) {
+	h := metrics.NewHistogram(metrics.Config{
+		Percentiles: []float64{0.5},
+		Thresholds:  []float64{500},
+	})
+	primeValues := make([]float64, 100)
+	for i := range primeValues {
+		primeValues[i] = float64(i + 1)
+	}
+	h.Prime(primeValues)
+	for i := 0; i < 3; i++ {
+		h.Record(1000)
+	}
+
+	// Primed values are only in the percentiles
+	gotSnap := h.Snapshot(true)
+	if p50 := gotSnap.Percentile[0.5]; p50 < 45 || p50 > 55 {
+		t.Errorf("got P50 %f, expected about 52 from primed values", p50)
+	}
+	gotSnap.Percentile = nil
+	expect := metrics.Snapshot{
+		N:            3,
+		Sum:          3000,
+		SumOfSquares: 3e6,
+		Min:          1000,
+		Max:          1000,
+		Threshold:    map[float64]int64{500: 0},
+	}
+	if diff := deep.Equal(gotSnap, expect); diff != nil {
+		t.Error(diff)
+	}
+
+	// Priming ends at reset
+	h.Record(1000)
+	if p50 := h.Snapshot(true).Percentile[0.5]; p50 != 1000 {
+		t.Errorf("got P50 %f, expected 1000", p50)
+	}
+
+	// Values recorded before Prime are counted, and Last is not changed
+	g := metrics.NewGauge(metrics.Config{Percentiles: []float64{0.5}})
+	g.Record(7)
+	g.Prime([]float64{1, 2, 3})
+	expect = metrics.Snapshot{
+		N:            1,
+		Sum:          7,
+		SumOfSquares: 49,
+		Min:          7,
+		Max:          7,
+		Last:         7,
+		Percentile:   map[float64]float64{0.5: 2.5},
+	}
+	if diff := deep.Equal(g.Snapshot(true), expect); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestPrimeValues(t *testing.T) {
+	s := metrics.Snapshot{
+		N:          10,
+		Min:        0,
+		Max:        100,
+		Percentile: map[float64]float64{0.5: 10},
+	}
+	got := metrics.PrimeValues(s, 4)
+	expect := []float64{2.5, 7.5, 32.5, 77.5}
+	if diff := deep.Equal(got, expect); diff != nil {
+		t.Error(diff)
+	}
+	if got := metrics.PrimeValues(metrics.Snapshot{}, 4); got != nil {
+		t.Errorf("got %v for empty snapshot, expected nil", got)
+	}
+}
+
+// --------------------------------------------------------------------------
+// SnapshotCounts
+// --------------------------------------------------------------------------
+
+func TestSnapshotCounts(t *testing.T) {
+	h := metrics.NewHistogram(metrics.Config{Percentiles: []float64{0.5}, Thresholds: []float64{50}})
+	g := metrics.NewGauge(metrics.Config{Percentiles: []float64{0.5}})
+	var sumSq float64
+	for i := 1; i <= 100; i++ {
+		h.Record(float64(i))
+		g.Record(float64(i))
+		sumSq += float64(i * i)
+	}
+	expect := metrics.Snapshot{
+		N:            100,
+		Sum:          5050,
+		SumOfSquares: sumSq,
+		Min:          1,
+		Max:          100,
+		Threshold:    map[float64]int64{50: 50},
+	}
+	if diff := deep.Equal(h.SnapshotCounts(false), expect); diff != nil {
+		t.Error(diff)
+	}
+	if p50 := h.Snapshot(false).Percentile[0.5]; p50 != 50.5 {
+		t.Errorf("got P50 %f after SnapshotCounts, expected 50.5", p50)
+	}
+	if diff := deep.Equal(h.SnapshotCounts(true), expect); diff != nil {
+		t.Error(diff)
+	}
+	if n := h.Snapshot(true).N; n != 0 {
+		t.Errorf("got N %d after reset, expected 0", n)
+	}
+
+	expect.Threshold = nil
+	expect.Last = 100
+	if diff := deep.Equal(g.SnapshotCounts(true), expect); diff != nil {
+		t.Error(diff)
+	}
+	if n := g.Snapshot(true).N; n != 0 {
+		t.Errorf("got N %d after reset, expected 0", n)
+	}
+}
+
+// --------------------------------------------------------------------------
+// View
+// --------------------------------------------------------------------------
+
+func TestView(t *testing.T) {
+	values := rand.Perm(1000)
+	configs := map[string]metrics.Config{
+		"Reservoir": {Percentiles: []float64{0.5, 0.99}},
+		"KLL":       {Percentiles: []float64{0.5, 0.99}, Estimator: metrics.KLL},
+		"CKMS":      {Percentiles: []float64{0.25, 0.5, 0.99}, Estimator: metrics.CKMS}, // P25 is only bounded if configured
+		"LogScale":  {Percentiles: []float64{0.5, 0.99}, LogScale: true},
+	}
+	for name, cfg := range configs {
+		h := metrics.NewHistogram(cfg)
+		if p := h.View().Percentile(0.5); p != 0 {
+			t.Errorf("%s: got P50 %f with no values, expected 0", name, p)
+		}
+		for _, v := range values {
+			h.Record(float64(v + 1))
+		}
+		view := h.View()
+		gotSnap := h.Snapshot(false)
+		if view.N() != 1000 || view.Sum() != 500500 || view.Min() != 1 || view.Max() != 1000 || view.Mean() != 500.5 {
+			t.Errorf("%s: got N %d, Sum %f, Min %f, Max %f, Mean %f", name, view.N(), view.Sum(), view.Min(), view.Max(), view.Mean())
+		}
+		for _, p := range cfg.Percentiles {
+			if got, expect := view.Percentile(p), gotSnap.Percentile[p]; got != expect {
+				t.Errorf("%s: got P%v %f, expected %f", name, p*100, got, expect)
+			}
+		}
+		if p25 := view.Percentile(0.25); math.Abs(p25-250) > 50 {
+			t.Errorf("%s: got P25 %f, expected about 250", name, p25)
+		}
+	}
+
+	g := metrics.NewGauge(metrics.Config{})
+	g.Record(3)
+	g.Record(1)
+	view := g.View()
+	if view.Last() != 1 || view.Percentile(1) != 3 {
+		t.Errorf("got Last %f, P100 %f; expected 1, 3", view.Last(), view.Percentile(1))
+	}
+
+	// p is clamped, even if the sample is full
+	g = metrics.NewGauge(metrics.Config{SampleSize: 2})
+	g.Record(3)
+	g.Record(1)
+	view = g.View()
+	if p := view.Percentile(1.5); p != 3 {
+		t.Errorf("got P150 %f, expected 3", p)
+	}
+	if p := view.Percentile(-1); p != 1 {
+		t.Errorf("got P-100 %f, expected 1", p)
+	}
+	if p := view.Percentile(math.NaN()); p != 1 {
+		t.Errorf("got NaN percentile %f, expected 1", p)
+	}
+}
+
+// --------------------------------------------------------------------------
+// Percentile names
+// --------------------------------------------------------------------------
+
+func TestFormatPercentile(t *testing.T) {
+	tests := []struct {
+		p       float64
+		decimal string
+		digits  string
+	}{
+		{metrics.P50, "p50", "p50"},
+		{metrics.P90, "p90", "p90"},
+		{metrics.P95, "p95", "p95"},
+		{metrics.P99, "p99", "p99"},
+		{metrics.P999, "p99.9", "p999"},
+		{0.9999, "p99.99", "p9999"},
+		{0.995, "p99.5", "p995"},
+		{0.05, "p5", "p5"},
+		{0.001, "p0.1", "p01"},
+		{0, "p0", "p0"},
+		{1, "p100", "p100"},
+	}
+	for _, test := range tests {
+		if got := metrics.FormatPercentile(test.p, metrics.PercentileDecimal); got != test.decimal {
+			t.Errorf("%v: got %s, expected %s", test.p, got, test.decimal)
+		}
+		if got := metrics.FormatPercentile(test.p, metrics.PercentileDigits); got != test.digits {
+			t.Errorf("%v: got %s, expected %s", test.p, got, test.digits)
+		}
+	}
+}
+
+// --------------------------------------------------------------------------
+// Status
+// --------------------------------------------------------------------------
+
+func TestStatus(t *testing.T) {
+	s := metrics.NewStatus("maintenance", metrics.StatusDown)
+	if diff := deep.Equal(s.States(), []string{"ok", "degraded", "down", "maintenance"}); diff != nil {
+		t.Error(diff)
+	}
+	if got := s.State(); got != metrics.StatusOK {
+		t.Errorf("got %s, expected ok", got)
+	}
+	if diff := deep.Equal(s.Snapshot(true), metrics.Snapshot{N: 1}); diff != nil {
+		t.Error(diff)
+	}
+
+	if err := s.Set("maintenance"); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.State(); got != "maintenance" {
+		t.Errorf("got %s, expected maintenance", got)
+	}
+	if diff := deep.Equal(s.Snapshot(true), metrics.Snapshot{N: 1, Sum: 3, Last: 3}); diff != nil {
+		t.Error(diff)
+	}
+	expect := map[string]float64{"ok": 0, "degraded": 0, "down": 0, "maintenance": 1}
+	if diff := deep.Equal(s.StateValues(), expect); diff != nil {
+		t.Error(diff)
+	}
+
+	// Unknown state does not change the state
+	if err := s.Set("unknown"); err != metrics.ErrUnknownStatus {
+		t.Errorf("got error %v, expected ErrUnknownStatus", err)
+	}
+	if got := s.State(); got != "maintenance" {
+		t.Errorf("got %s, expected maintenance", got)
+	}
+}
+
+// --------------------------------------------------------------------------
+// Benchmarks
+// --------------------------------------------------------------------------
+
+func BenchmarkHistogramSnapshot(b *testing.B) {
+	h1 := metrics.NewHistogram(metrics.Config{Percentiles: []float64{0.5, 0.99, 0.999}})
+	for i := 0; i < 5000; i++ {
+		h1.Record(rand.Float64())
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h1.Snapshot(false)
+	}
+}
+
+func BenchmarkHistogramSnapshotCounts(b *testing.B) {
+	h1 := metrics.NewHistogram(metrics.Config{Percentiles: []float64{0.5, 0.99, 0.999}})
+	for i := 0; i < 5000; i++ {
+		h1.Record(rand.Float64())
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h1.SnapshotCounts(false)
+	}
+}
+
+// Compare one percentile from a View, which copies the sample, with a Snapshot.
+func BenchmarkHistogramViewPercentile(b *testing.B) {
+	h1 := metrics.NewHistogram(metrics.Config{Percentiles: []float64{0.99}})
+	for i := 0; i < 5000; i++ {
+		h1.Record(rand.Float64())
+	}
+	b.Run("View", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			h1.View().Percentile(0.99)
+		}
+	})
+	b.Run("Snapshot", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_ = h1.Snapshot(false).Percentile[0.99]
+		}
+	})
+}
+
+func BenchmarkHistogramSnapshotReusePercentileMap(b *testing.B) {
+	h1 := metrics.NewHistogram(metrics.Config{
+		Percentiles:        []float64{0.5, 0.99, 0.999},
+		ReusePercentileMap: true,
+	})
+	for i := 0; i < 5000; i++ {
+		h1.Record(rand.Float64())
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h1.Snapshot(false)
+	}
+}
+
+func BenchmarkHistogramRecordParallel(b *testing.B) {
+	h1 := metrics.NewHistogram(p999Config)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			h1.Record(1)
+		}
+	})
+}
+
+func BenchmarkRingHistogramRecordParallel(b *testing.B) {
+	h1 := metrics.NewRingHistogram(p999Config)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			h1.Record(1)
+		}
+	})
+}
+
+func BenchmarkHistogramRecordEveryParallel(b *testing.B) {
+	h1 := metrics.NewHistogram(metrics.Config{Percentiles: []float64{0.999}, RecordEvery: 100})
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			h1.Record(1)
+		}
+	})
+}
+
+func BenchmarkHistogramSnapshotNoPercentiles(b *testing.B) {
+	h1 := metrics.NewHistogram(metrics.Config{})
+	for i := 0; i < 5000; i++ {
+		h1.Record(rand.Float64())
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h1.Snapshot(false)
+	}
+}
+
+// Compare Counter and ShardedCounter with 1 to 64 goroutines per CPU. Run with
+// -cpu to vary CPUs; ShardedCounter ns/op should stay flat as CPUs increase.
+func BenchmarkCounterAddParallel(b *testing.B) {
+	for _, g := range []int{1, 4, 16, 64} {
+		b.Run(fmt.Sprintf("Counter/goroutines=%d", g), func(b *testing.B) {
+			c1 := metrics.NewCounter()
+			b.SetParallelism(g)
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					c1.Add(1)
+				}
+			})
+		})
+		b.Run(fmt.Sprintf("ShardedCounter/goroutines=%d", g), func(b *testing.B) {
+			c1 := metrics.NewShardedCounter()
+			b.SetParallelism(g)
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					c1.Add(1)
+				}
+			})
+		})
+	}
+}
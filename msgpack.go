@@ -0,0 +1,475 @@
+package metrics
+
+import (
+	"errors"
+	"io"
+	"math"
+	"time"
+)
+
+// --------------------------------------------------------------------------
+// MessagePack
+// --------------------------------------------------------------------------
+
+// A Batch is encoded in MessagePack (https://msgpack.org) as a map:
+//
+//	"v": Version (BatchVersion)
+//	"t": Time as a timestamp extension (type -1)
+//	"s": Snapshots as a map of name to snapshot map
+//
+// A snapshot map has only the non-zero Snapshot fields, with short keys to
+// keep the encoding compact:
+//
+//	"n": N                  "last":     Last
+//	"sum": Sum              "lastd":    LastDelta
+//	"sumsq": SumOfSquares   "th":       Threshold (map of float to int)
+//	"min": Min              "dropped":  Dropped
+//	"max": Max              "invalid":  Invalid
+//	"p": Percentile         "rejected": Rejected
+//	"rate": SampleRate      "ex":       Exemplars (array of maps: "v", "l", "t")
+//
+// Floats are encoded as float32 if that is exact, else float64. Decoders skip
+// unknown keys, so new fields can be added.
+
+// ErrMsgPack is returned by DecodeMsgPack if the data is not a valid Batch.
+var ErrMsgPack = errors.New("metrics: invalid MessagePack batch")
+
+// EncodeMsgPack writes b to w in MessagePack.
+func EncodeMsgPack(w io.Writer, b Batch) error {
+	e := &msgpackEncoder{}
+	e.mapHeader(3)
+	e.str("v")
+	e.int(BatchVersion)
+	e.str("t")
+	e.time(b.Time)
+	e.str("s")
+	e.mapHeader(len(b.Snapshots))
+	for name, s := range b.Snapshots {
+		e.str(name)
+		e.snapshot(s)
+	}
+	_, err := w.Write(e.buf)
+	return err
+}
+
+type msgpackEncoder struct {
+	buf []byte
+}
+
+func (e *msgpackEncoder) snapshot(s Snapshot) {
+	n := 0
+	for _, nonzero := range []bool{
+		s.N != 0, s.Sum != 0, s.SumOfSquares != 0, s.Min != 0, s.Max != 0,
+		s.Percentile != nil, s.Last != 0, s.LastDelta != 0, s.Threshold != nil,
+		s.Dropped != 0, s.Invalid != 0, s.Rejected != 0, s.SampleRate != 0,
+		s.Exemplars != nil,
+	} {
+		if nonzero {
+			n++
+		}
+	}
+	e.mapHeader(n)
+	e.intField("n", s.N)
+	e.floatField("sum", s.Sum)
+	e.floatField("sumsq", s.SumOfSquares)
+	e.floatField("min", s.Min)
+	e.floatField("max", s.Max)
+	if s.Percentile != nil {
+		e.str("p")
+		e.mapHeader(len(s.Percentile))
+		for _, pv := range s.SortedPercentiles() {
+			e.float(pv.Percentile)
+			e.float(pv.Value)
+		}
+	}
+	e.floatField("last", s.Last)
+	e.floatField("lastd", s.LastDelta)
+	if s.Threshold != nil {
+		e.str("th")
+		e.mapHeader(len(s.Threshold))
+		for t, n := range s.Threshold {
+			e.float(t)
+			e.int(n)
+		}
+	}
+	e.intField("dropped", s.Dropped)
+	e.intField("invalid", s.Invalid)
+	e.intField("rejected", s.Rejected)
+	e.floatField("rate", s.SampleRate)
+	if s.Exemplars != nil {
+		e.str("ex")
+		e.arrayHeader(len(s.Exemplars))
+		for _, ex := range s.Exemplars {
+			e.mapHeader(3)
+			e.str("v")
+			e.float(ex.Value)
+			e.str("l")
+			e.str(ex.Label)
+			e.str("t")
+			e.time(ex.Time)
+		}
+	}
+}
+
+func (e *msgpackEncoder) intField(key string, v int64) {
+	if v != 0 {
+		e.str(key)
+		e.int(v)
+	}
+}
+
+func (e *msgpackEncoder) floatField(key string, v float64) {
+	if v != 0 {
+		e.str(key)
+		e.float(v)
+	}
+}
+
+func (e *msgpackEncoder) header(n int, fix, fixMax byte, code16, code32 byte) {
+	switch {
+	case n <= int(fixMax):
+		e.buf = append(e.buf, fix|byte(n))
+	case n <= math.MaxUint16:
+		e.buf = append(e.buf, code16, byte(n>>8), byte(n))
+	default:
+		e.buf = append(e.buf, code32)
+		e.buf = appendUint32(e.buf, uint32(n))
+	}
+}
+
+func (e *msgpackEncoder) mapHeader(n int)   { e.header(n, 0x80, 15, 0xde, 0xdf) }
+func (e *msgpackEncoder) arrayHeader(n int) { e.header(n, 0x90, 15, 0xdc, 0xdd) }
+
+func (e *msgpackEncoder) str(s string) {
+	if len(s) <= 31 {
+		e.buf = append(e.buf, 0xa0|byte(len(s)))
+	} else if len(s) <= math.MaxUint8 {
+		e.buf = append(e.buf, 0xd9, byte(len(s)))
+	} else if len(s) <= math.MaxUint16 {
+		e.buf = append(e.buf, 0xda, byte(len(s)>>8), byte(len(s)))
+	} else {
+		e.buf = append(e.buf, 0xdb)
+		e.buf = appendUint32(e.buf, uint32(len(s)))
+	}
+	e.buf = append(e.buf, s...)
+}
+
+func (e *msgpackEncoder) int(v int64) {
+	switch {
+	case v >= 0 && v <= 127:
+		e.buf = append(e.buf, byte(v)) // positive fixint
+	case v < 0 && v >= -32:
+		e.buf = append(e.buf, byte(v)) // negative fixint
+	case v >= math.MinInt32 && v <= math.MaxInt32:
+		e.buf = append(e.buf, 0xd2)
+		e.buf = appendUint32(e.buf, uint32(v))
+	default:
+		e.buf = append(e.buf, 0xd3)
+		e.buf = appendUint64(e.buf, uint64(v))
+	}
+}
+
+func (e *msgpackEncoder) float(v float64) {
+	if f := float32(v); float64(f) == v {
+		e.buf = append(e.buf, 0xca)
+		e.buf = appendUint32(e.buf, math.Float32bits(f))
+		return
+	}
+	e.buf = append(e.buf, 0xcb)
+	e.buf = appendUint64(e.buf, math.Float64bits(v))
+}
+
+// time encodes t as timestamp 96: ext 8, length 12, type -1, nanoseconds
+// uint32, seconds int64.
+func (e *msgpackEncoder) time(t time.Time) {
+	e.buf = append(e.buf, 0xc7, 12, 0xff)
+	e.buf = appendUint32(e.buf, uint32(t.Nanosecond()))
+	e.buf = appendUint64(e.buf, uint64(t.Unix()))
+}
+
+// DecodeMsgPack reads a Batch written by EncodeMsgPack from r. If r is not an
+// io.ByteReader, it is buffered, so it can read past the end of the batch.
+// It is safe to decode untrusted data: if r has a Len method, like
+// bytes.Reader, lengths more than the bytes left return ErrMsgPack; else,
+// they return io.ErrUnexpectedEOF when the data ends, without allocating
+// the length first.
+func DecodeMsgPack(r io.Reader) (Batch, error) {
+	d := &msgpackDecoder{newByteDecoder(r, ErrMsgPack)}
+	b := d.batch()
+	return b, d.error()
+}
+
+type msgpackDecoder struct {
+	byteDecoder
+}
+
+func (d *msgpackDecoder) batch() Batch {
+	var b Batch
+	n := d.mapHeader()
+	for i := 0; i < n && d.err == nil; i++ {
+		switch d.str() {
+		case "v":
+			b.Version = int(d.int())
+		case "t":
+			b.Time = d.time()
+		case "s":
+			m := d.mapHeader()
+			b.Snapshots = make(map[string]Snapshot, prealloc(m))
+			for j := 0; j < m && d.err == nil; j++ {
+				name := d.str()
+				b.Snapshots[name] = d.snapshot()
+			}
+		default:
+			d.skip()
+		}
+	}
+	return b
+}
+
+func (d *msgpackDecoder) snapshot() Snapshot {
+	var s Snapshot
+	n := d.mapHeader()
+	for i := 0; i < n && d.err == nil; i++ {
+		switch d.str() {
+		case "n":
+			s.N = d.int()
+		case "sum":
+			s.Sum = d.float()
+		case "sumsq":
+			s.SumOfSquares = d.float()
+		case "min":
+			s.Min = d.float()
+		case "max":
+			s.Max = d.float()
+		case "p":
+			m := d.mapHeader()
+			s.Percentile = make(map[float64]float64, prealloc(m))
+			for j := 0; j < m && d.err == nil; j++ {
+				p := d.float()
+				s.Percentile[p] = d.float()
+			}
+		case "last":
+			s.Last = d.float()
+		case "lastd":
+			s.LastDelta = d.float()
+		case "th":
+			m := d.mapHeader()
+			s.Threshold = make(map[float64]int64, prealloc(m))
+			for j := 0; j < m && d.err == nil; j++ {
+				t := d.float()
+				s.Threshold[t] = d.int()
+			}
+		case "dropped":
+			s.Dropped = d.int()
+		case "invalid":
+			s.Invalid = d.int()
+		case "rejected":
+			s.Rejected = d.int()
+		case "rate":
+			s.SampleRate = d.float()
+		case "ex":
+			m := d.arrayHeader()
+			s.Exemplars = make([]Exemplar, 0, prealloc(m))
+			for j := 0; j < m && d.err == nil; j++ {
+				var ex Exemplar
+				fields := d.mapHeader()
+				for k := 0; k < fields && d.err == nil; k++ {
+					switch d.str() {
+					case "v":
+						ex.Value = d.float()
+					case "l":
+						ex.Label = d.str()
+					case "t":
+						ex.Time = d.time()
+					default:
+						d.skip()
+					}
+				}
+				s.Exemplars = append(s.Exemplars, ex)
+			}
+		default:
+			d.skip()
+		}
+	}
+	return s
+}
+
+func (d *msgpackDecoder) mapHeader() int {
+	c := d.byte()
+	switch {
+	case c&0xf0 == 0x80:
+		return d.length(uint64(c&0x0f), 2)
+	case c == 0xde:
+		return d.length(d.uint(2), 2)
+	case c == 0xdf:
+		return d.length(d.uint(4), 2)
+	}
+	d.fail()
+	return 0
+}
+
+func (d *msgpackDecoder) arrayHeader() int {
+	c := d.byte()
+	switch {
+	case c&0xf0 == 0x90:
+		return d.length(uint64(c&0x0f), 1)
+	case c == 0xdc:
+		return d.length(d.uint(2), 1)
+	case c == 0xdd:
+		return d.length(d.uint(4), 1)
+	}
+	d.fail()
+	return 0
+}
+
+func (d *msgpackDecoder) str() string {
+	c := d.byte()
+	var n int
+	switch {
+	case c&0xe0 == 0xa0:
+		n = d.length(uint64(c&0x1f), 1)
+	case c == 0xd9:
+		n = d.length(d.uint(1), 1)
+	case c == 0xda:
+		n = d.length(d.uint(2), 1)
+	case c == 0xdb:
+		n = d.length(d.uint(4), 1)
+	default:
+		d.fail()
+		return ""
+	}
+	return string(d.bytes(n))
+}
+
+// number decodes any MessagePack int or float.
+func (d *msgpackDecoder) number() (int64, float64, bool) {
+	c := d.byte()
+	switch {
+	case c <= 0x7f:
+		return int64(c), 0, true
+	case c >= 0xe0:
+		return int64(int8(c)), 0, true
+	case c == 0xcc, c == 0xcd, c == 0xce, c == 0xcf: // uint 8-64
+		return int64(d.uint(1 << (c - 0xcc))), 0, true
+	case c == 0xd0:
+		return int64(int8(d.uint(1))), 0, true
+	case c == 0xd1:
+		return int64(int16(d.uint(2))), 0, true
+	case c == 0xd2:
+		return int64(int32(d.uint(4))), 0, true
+	case c == 0xd3:
+		return int64(d.uint(8)), 0, true
+	case c == 0xca:
+		return 0, float64(math.Float32frombits(uint32(d.uint(4)))), false
+	case c == 0xcb:
+		return 0, math.Float64frombits(d.uint(8)), false
+	}
+	d.fail()
+	return 0, 0, true
+}
+
+func (d *msgpackDecoder) int() int64 {
+	i, f, isInt := d.number()
+	if !isInt {
+		return int64(f)
+	}
+	return i
+}
+
+func (d *msgpackDecoder) float() float64 {
+	i, f, isInt := d.number()
+	if isInt {
+		return float64(i)
+	}
+	return f
+}
+
+// time decodes a timestamp extension (type -1) of 32, 64, or 96 bits.
+func (d *msgpackDecoder) time() time.Time {
+	c := d.byte()
+	var n int
+	switch c {
+	case 0xd6:
+		n = 4
+	case 0xd7:
+		n = 8
+	case 0xc7:
+		n = int(d.uint(1))
+	default:
+		d.fail()
+		return time.Time{}
+	}
+	if d.byte() != 0xff {
+		d.fail()
+		return time.Time{}
+	}
+	var t time.Time
+	switch n {
+	case 4:
+		t = time.Unix(int64(d.uint(4)), 0)
+	case 8:
+		v := d.uint(8)
+		t = time.Unix(int64(v&(1<<34-1)), int64(v>>34))
+	case 12:
+		nsec := d.uint(4)
+		t = time.Unix(int64(d.uint(8)), int64(nsec))
+	default:
+		d.fail()
+		return time.Time{}
+	}
+	return t.UTC()
+}
+
+// skip skips one value of any type.
+func (d *msgpackDecoder) skip() {
+	defer d.unnest()
+	if !d.nest() {
+		return
+	}
+	c := d.byte()
+	switch {
+	case d.err != nil:
+	case c <= 0x7f, c >= 0xe0, c == 0xc0, c == 0xc2, c == 0xc3: // fixint, nil, bool
+	case c&0xf0 == 0x80: // fixmap
+		d.skipN(2 * int(c&0x0f))
+	case c&0xf0 == 0x90: // fixarray
+		d.skipN(int(c & 0x0f))
+	case c&0xe0 == 0xa0: // fixstr
+		d.bytes(int(c & 0x1f))
+	case c == 0xc4, c == 0xd9: // bin 8, str 8
+		d.bytes(d.length(d.uint(1), 1))
+	case c == 0xc5, c == 0xda: // bin 16, str 16
+		d.bytes(d.length(d.uint(2), 1))
+	case c == 0xc6, c == 0xdb: // bin 32, str 32
+		d.bytes(d.length(d.uint(4), 1))
+	case c == 0xc7, c == 0xc8, c == 0xc9: // ext 8-32
+		n := d.length(d.uint(1<<(c-0xc7)), 1)
+		d.bytes(1 + n)
+	case c == 0xca, c == 0xce, c == 0xd2: // 32-bit numbers
+		d.bytes(4)
+	case c == 0xcb, c == 0xcf, c == 0xd3: // 64-bit numbers
+		d.bytes(8)
+	case c == 0xcc, c == 0xd0:
+		d.bytes(1)
+	case c == 0xcd, c == 0xd1:
+		d.bytes(2)
+	case c >= 0xd4 && c <= 0xd8: // fixext 1-16
+		d.bytes(1 + 1<<(c-0xd4))
+	case c == 0xdc:
+		d.skipN(d.length(d.uint(2), 1))
+	case c == 0xdd:
+		d.skipN(d.length(d.uint(4), 1))
+	case c == 0xde:
+		d.skipN(2 * d.length(d.uint(2), 2))
+	case c == 0xdf:
+		d.skipN(2 * d.length(d.uint(4), 2))
+	default:
+		d.fail()
+	}
+}
+
+func (d *msgpackDecoder) skipN(n int) {
+	for i := 0; i < n && d.err == nil; i++ {
+		d.skip()
+	}
+}
@@ -0,0 +1,62 @@
+package metrics
+
+import (
+	"strconv"
+	"strings"
+)
+
+// --------------------------------------------------------------------------
+// Percentile names
+// --------------------------------------------------------------------------
+
+// Common percentiles for Config.Percentiles and Snapshot.Percentile keys.
+const (
+	P50  = 0.5
+	P90  = 0.9
+	P95  = 0.95
+	P99  = 0.99
+	P999 = 0.999
+)
+
+// PercentileFormat is the format of percentile names returned by
+// FormatPercentile.
+type PercentileFormat int
+
+const (
+	// PercentileDecimal formats percentiles with a decimal point: "p50",
+	// "p99", "p99.9". This is the default.
+	PercentileDecimal PercentileFormat = iota
+
+	// PercentileDigits formats percentiles with only digits: "p50", "p99",
+	// "p999". Use it for backends that do not allow "." in names.
+	PercentileDigits
+)
+
+// FormatPercentile returns the canonical name of percentile p, like "p99.9"
+// for 0.999, so that programs naming metrics or labels from the same
+// Snapshot.Percentile keys agree. The name is formatted from the shortest
+// decimal representation of p, so 0.999 is never "p99.89999999999999".
+func FormatPercentile(p float64, f PercentileFormat) string {
+	s := strconv.FormatFloat(p, 'f', -1, 64)
+	whole, frac := s, ""
+	if dot := strings.IndexByte(s, '.'); dot >= 0 {
+		whole, frac = s[:dot], s[dot+1:]
+	}
+	for len(frac) < 2 {
+		frac += "0"
+	}
+	// Move the decimal point two digits right: 0.999 -> 99.9
+	whole = strings.TrimLeft(whole+frac[:2], "0")
+	if whole == "" {
+		whole = "0"
+	}
+	frac = frac[2:]
+	switch {
+	case frac == "":
+		return "p" + whole
+	case f == PercentileDigits:
+		return "p" + whole + frac
+	default:
+		return "p" + whole + "." + frac
+	}
+}
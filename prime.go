@@ -0,0 +1,125 @@
+package metrics
+
+import (
+	"sort"
+)
+
+// --------------------------------------------------------------------------
+// Priming
+// --------------------------------------------------------------------------
+
+// primed counts the values recorded while the sample has primed values, so
+// snapshots report N, Sum, SumOfSquares, Min, and Max of only the values
+// recorded. The sample counts the primed values too.
+type primed struct {
+	n          int64
+	sum, sumSq float64
+	min, max   float64
+}
+
+// newPrimed returns a primed with the counts of the values already in s.
+func newPrimed(s sample) *primed {
+	var snapshot Snapshot
+	s.snapshot(&snapshot, nil, nil, false)
+	return &primed{
+		n:     snapshot.N,
+		sum:   snapshot.Sum,
+		sumSq: snapshot.SumOfSquares,
+		min:   snapshot.Min,
+		max:   snapshot.Max,
+	}
+}
+
+// record counts v. It is safe to call on a nil primed.
+func (p *primed) record(v float64) {
+	if p == nil {
+		return
+	}
+	if p.n == 0 || v < p.min {
+		p.min = v
+	}
+	if p.n == 0 || v > p.max {
+		p.max = v
+	}
+	p.n++
+	p.sum += v
+	p.sumSq += v * v
+}
+
+// counts sets the snapshot counts. It is safe to call on a nil primed.
+func (p *primed) counts(snapshot *Snapshot) {
+	if p == nil {
+		return
+	}
+	snapshot.N = p.n
+	snapshot.Sum = p.sum
+	snapshot.SumOfSquares = p.sumSq
+	snapshot.Min = p.min
+	snapshot.Max = p.max
+}
+
+// Prime adds values to the sample of the current interval only to estimate
+// percentiles: they are not counted in N, Sum, SumOfSquares, Min, or Max, and
+// they do not change Last. Use it at startup with values from a persisted
+// snapshot (see PrimeValues) or another instance, so percentiles of the first
+// interval are representative instead of being calculated from only a few
+// values. Each primed value weighs as much as a value recorded, so as values
+// are recorded, they displace the primed values. Priming ends at the next
+// reset. If no values are recorded, the snapshot has N = 0 and the primed
+// percentiles.
+func (g *Gauge) Prime(values []float64) {
+	g.Lock()
+	if g.primed == nil {
+		g.primed = newPrimed(g.resv)
+	}
+	for _, v := range values {
+		g.resv.record(v)
+	}
+	g.Unlock()
+}
+
+// Prime adds values to the sample of the current interval only to estimate
+// percentiles, like Gauge.Prime. Primed values are not filtered or counted in
+// Threshold counts.
+func (h *Histogram) Prime(values []float64) {
+	h.Lock()
+	h.drain()
+	if h.primed == nil {
+		h.primed = newPrimed(h.resv)
+	}
+	for _, v := range values {
+		h.resv.record(v)
+	}
+	h.Unlock()
+}
+
+// PrimeValues returns n values distributed like the snapshot, to prime a Gauge
+// or Histogram. The values are interpolated linearly between Min, the
+// percentiles, and Max. It returns nil if the snapshot has no values.
+func PrimeValues(s Snapshot, n int) []float64 {
+	if s.N == 0 || n <= 0 {
+		return nil
+	}
+	type point struct{ q, v float64 }
+	points := make([]point, 0, len(s.Percentile)+2)
+	points = append(points, point{0, s.Min})
+	for q, v := range s.Percentile {
+		if q > 0 && q < 1 {
+			points = append(points, point{q, v})
+		}
+	}
+	points = append(points, point{1, s.Max})
+	sort.Slice(points, func(i, j int) bool { return points[i].q < points[j].q })
+
+	values := make([]float64, n)
+	j := 1
+	for i := range values {
+		q := (float64(i) + 0.5) / float64(n)
+		for points[j].q < q {
+			j++
+		}
+		lo, hi := points[j-1], points[j]
+		values[i] = lo.v + (hi.v-lo.v)*(q-lo.q)/(hi.q-lo.q)
+	}
+	return values
+}
@@ -0,0 +1,76 @@
+package metrics
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// --------------------------------------------------------------------------
+// IOCollector
+// --------------------------------------------------------------------------
+
+// IOCollector reports the disk and network I/O of the process from /proc on
+// Linux. Call Collect every interval before reporting the metrics. The counters
+// are cumulative in /proc, so they are MonotonicCounter: the first Collect is
+// the baseline, and each snapshot is the increase since the last reset.
+type IOCollector struct {
+	ReadBytes  *MonotonicCounter // bytes read from storage (read_bytes)
+	WriteBytes *MonotonicCounter // bytes written to storage (write_bytes)
+	ReadOps    *MonotonicCounter // read syscalls, including sockets (syscr)
+	WriteOps   *MonotonicCounter // write syscalls, including sockets (syscw)
+	Sockets    *Gauge            // open socket file descriptors
+
+	dir string
+}
+
+// NewIOCollector returns an IOCollector for the process with the given pid,
+// or the current process if pid is zero, reading from /proc.
+func NewIOCollector(pid int) *IOCollector {
+	return newIOCollector("/proc", pid)
+}
+
+func newIOCollector(proc string, pid int) *IOCollector {
+	dir := filepath.Join(proc, "self")
+	if pid > 0 {
+		dir = filepath.Join(proc, strconv.Itoa(pid))
+	}
+	return &IOCollector{
+		ReadBytes:  NewMonotonicCounter(0),
+		WriteBytes: NewMonotonicCounter(0),
+		ReadOps:    NewMonotonicCounter(0),
+		WriteOps:   NewMonotonicCounter(0),
+		Sockets:    NewGauge(Config{}),
+		dir:        dir,
+	}
+}
+
+// Collect reads /proc/<pid>/io and /proc/<pid>/fd and records the values. It
+// returns the first error, if any; values read before the error are recorded.
+// Reading another process requires permission (ptrace access).
+func (c *IOCollector) Collect() error {
+	stat, err := readStatFile(filepath.Join(c.dir, "io"))
+	if err != nil {
+		return err
+	}
+	c.ReadBytes.Set(stat["read_bytes"])
+	c.WriteBytes.Set(stat["write_bytes"])
+	c.ReadOps.Set(stat["syscr"])
+	c.WriteOps.Set(stat["syscw"])
+
+	fds, err := os.ReadDir(filepath.Join(c.dir, "fd"))
+	if err != nil {
+		return err
+	}
+	sockets := 0
+	for _, fd := range fds {
+		// Link target is like "socket:[12345]"; the fd can be closed already
+		target, err := os.Readlink(filepath.Join(c.dir, "fd", fd.Name()))
+		if err == nil && strings.HasPrefix(target, "socket:") {
+			sockets++
+		}
+	}
+	c.Sockets.Record(float64(sockets))
+	return nil
+}
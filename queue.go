@@ -0,0 +1,84 @@
+package metrics
+
+import (
+	"sync/atomic"
+)
+
+// --------------------------------------------------------------------------
+// Bounded lock-free MPMC queue by Dmitry Vyukov:
+// https://www.1024cores.net/home/lock-free-algorithms/queues/bounded-mpmc-queue
+// --------------------------------------------------------------------------
+
+type queueCell struct {
+	seq uint64
+	v   float64
+}
+
+type recordQueue struct {
+	mask   uint64
+	cells  []queueCell
+	_      [56]byte // keep enqPos and deqPos on separate cache lines
+	enqPos uint64
+	_      [56]byte
+	deqPos uint64
+}
+
+// newRecordQueue returns a queue with size rounded up to a power of two.
+func newRecordQueue(size int) *recordQueue {
+	n := 1
+	for n < size {
+		n <<= 1
+	}
+	q := &recordQueue{
+		mask:  uint64(n - 1),
+		cells: make([]queueCell, n),
+	}
+	for i := range q.cells {
+		q.cells[i].seq = uint64(i)
+	}
+	return q
+}
+
+// push adds v to the queue. It returns false if the queue is full.
+func (q *recordQueue) push(v float64) bool {
+	pos := atomic.LoadUint64(&q.enqPos)
+	for {
+		cell := &q.cells[pos&q.mask]
+		seq := atomic.LoadUint64(&cell.seq)
+		switch dif := int64(seq) - int64(pos); {
+		case dif == 0:
+			if atomic.CompareAndSwapUint64(&q.enqPos, pos, pos+1) {
+				cell.v = v
+				atomic.StoreUint64(&cell.seq, pos+1)
+				return true
+			}
+			pos = atomic.LoadUint64(&q.enqPos)
+		case dif < 0:
+			return false // full
+		default:
+			pos = atomic.LoadUint64(&q.enqPos)
+		}
+	}
+}
+
+// pop removes and returns the oldest value. It returns false if the queue is empty.
+func (q *recordQueue) pop() (float64, bool) {
+	pos := atomic.LoadUint64(&q.deqPos)
+	for {
+		cell := &q.cells[pos&q.mask]
+		seq := atomic.LoadUint64(&cell.seq)
+		switch dif := int64(seq) - int64(pos+1); {
+		case dif == 0:
+			if atomic.CompareAndSwapUint64(&q.deqPos, pos, pos+1) {
+				v := cell.v
+				atomic.StoreUint64(&cell.seq, pos+q.mask+1)
+				return v, true
+			}
+			pos = atomic.LoadUint64(&q.deqPos)
+		case dif < 0:
+			return 0, false // empty
+		default:
+			pos = atomic.LoadUint64(&q.deqPos)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package metrics
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// --------------------------------------------------------------------------
+// Resolver
+// --------------------------------------------------------------------------
+
+// Lookup types for Resolver metrics, one per net.Resolver lookup method.
+const (
+	LookupAddr   = "addr"
+	LookupCNAME  = "cname"
+	LookupHost   = "host"
+	LookupIP     = "ip"
+	LookupIPAddr = "ipaddr"
+	LookupMX     = "mx"
+	LookupNS     = "ns"
+	LookupPort   = "port"
+	LookupSRV    = "srv"
+	LookupTXT    = "txt"
+)
+
+var lookupTypes = []string{
+	LookupAddr, LookupCNAME, LookupHost, LookupIP, LookupIPAddr,
+	LookupMX, LookupNS, LookupPort, LookupSRV, LookupTXT,
+}
+
+// Resolver is a net.Resolver that records DNS lookup latency, in seconds, and
+// errors per lookup type, because DNS is a frequent hidden cause of tail
+// latency. It has the same lookup methods as net.Resolver. The metrics are
+// created when the Resolver is created, so they can be reported before any
+// lookups.
+type Resolver struct {
+	r       *net.Resolver
+	latency map[string]*Histogram // read-only after NewResolver
+	errors  map[string]*Counter   // read-only after NewResolver
+}
+
+// NewResolver returns a Resolver that uses r, or net.DefaultResolver if r is
+// nil. The latency histograms are configured by cfg.
+func NewResolver(r *net.Resolver, cfg Config) *Resolver {
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	res := &Resolver{
+		r:       r,
+		latency: make(map[string]*Histogram, len(lookupTypes)),
+		errors:  make(map[string]*Counter, len(lookupTypes)),
+	}
+	for _, t := range lookupTypes {
+		res.latency[t] = NewHistogram(cfg)
+		res.errors[t] = NewCounter()
+	}
+	return res
+}
+
+// Latency returns the latency histogram for the lookup type, like LookupHost,
+// or nil if the type is not valid.
+func (r *Resolver) Latency(lookup string) *Histogram {
+	return r.latency[lookup]
+}
+
+// Errors returns the error counter for the lookup type, like LookupHost, or nil
+// if the type is not valid.
+func (r *Resolver) Errors(lookup string) *Counter {
+	return r.errors[lookup]
+}
+
+func (r *Resolver) record(lookup string, t0 time.Time, err error) {
+	r.latency[lookup].Record(time.Since(t0).Seconds())
+	if err != nil {
+		r.errors[lookup].Add(1)
+	}
+}
+
+func (r *Resolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	t0 := time.Now()
+	names, err := r.r.LookupAddr(ctx, addr)
+	r.record(LookupAddr, t0, err)
+	return names, err
+}
+
+func (r *Resolver) LookupCNAME(ctx context.Context, host string) (string, error) {
+	t0 := time.Now()
+	cname, err := r.r.LookupCNAME(ctx, host)
+	r.record(LookupCNAME, t0, err)
+	return cname, err
+}
+
+func (r *Resolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	t0 := time.Now()
+	addrs, err := r.r.LookupHost(ctx, host)
+	r.record(LookupHost, t0, err)
+	return addrs, err
+}
+
+func (r *Resolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	t0 := time.Now()
+	ips, err := r.r.LookupIP(ctx, network, host)
+	r.record(LookupIP, t0, err)
+	return ips, err
+}
+
+func (r *Resolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	t0 := time.Now()
+	addrs, err := r.r.LookupIPAddr(ctx, host)
+	r.record(LookupIPAddr, t0, err)
+	return addrs, err
+}
+
+func (r *Resolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	t0 := time.Now()
+	mx, err := r.r.LookupMX(ctx, name)
+	r.record(LookupMX, t0, err)
+	return mx, err
+}
+
+func (r *Resolver) LookupNS(ctx context.Context, name string) ([]*net.NS, error) {
+	t0 := time.Now()
+	ns, err := r.r.LookupNS(ctx, name)
+	r.record(LookupNS, t0, err)
+	return ns, err
+}
+
+func (r *Resolver) LookupPort(ctx context.Context, network, service string) (int, error) {
+	t0 := time.Now()
+	port, err := r.r.LookupPort(ctx, network, service)
+	r.record(LookupPort, t0, err)
+	return port, err
+}
+
+func (r *Resolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	t0 := time.Now()
+	cname, srv, err := r.r.LookupSRV(ctx, service, proto, name)
+	r.record(LookupSRV, t0, err)
+	return cname, srv, err
+}
+
+func (r *Resolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	t0 := time.Now()
+	txt, err := r.r.LookupTXT(ctx, name)
+	r.record(LookupTXT, t0, err)
+	return txt, err
+}
@@ -0,0 +1,134 @@
+package metrics
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// --------------------------------------------------------------------------
+// RingHistogram
+// --------------------------------------------------------------------------
+
+// RingHistogram is a Histogram that never locks on Record. Values are stored
+// in a lock-free ring buffer of 2,000 values, so the sample is the last 2,000
+// values recorded (a sliding window) rather than a random sample. Use it only
+// when mutex contention in Histogram.Record is the bottleneck and a sliding
+// window of recent values is acceptable.
+//
+// N, Sum, Min, and Max are exact, but without a lock, a value recorded while
+// Snapshot is running can be counted in either the current or the next snapshot.
+// So a snapshot can have counts but no values in the sample, in which case
+// Percentile is nil.
+// Only Config.Percentiles is used; other Config fields are ignored.
+type RingHistogram struct {
+	percentiles []float64
+	*sync.Mutex          // serializes Snapshot, not Record
+	values      []uint64 // math.Float64bits
+	pos         uint64   // next position to write; total values ever recorded
+	start       uint64   // pos at last reset
+	n           int64
+	sum         uint64 // math.Float64bits
+	sumSq       uint64 // math.Float64bits
+	min         uint64 // math.Float64bits, +Inf if no values
+	max         uint64 // math.Float64bits, -Inf if no values
+}
+
+var (
+	posInf = math.Float64bits(math.Inf(1))
+	negInf = math.Float64bits(math.Inf(-1))
+)
+
+func NewRingHistogram(cfg Config) *RingHistogram {
+	return &RingHistogram{
+		percentiles: cfg.Percentiles,
+		Mutex:       &sync.Mutex{},
+		values:      make([]uint64, defaultSampleSize),
+		min:         posInf,
+		max:         negInf,
+	}
+}
+
+func (h *RingHistogram) Record(v float64) {
+	pos := atomic.AddUint64(&h.pos, 1) - 1
+	atomic.StoreUint64(&h.values[pos%uint64(len(h.values))], math.Float64bits(v))
+	atomic.AddInt64(&h.n, 1)
+	addFloat64(&h.sum, v)
+	addFloat64(&h.sumSq, v*v)
+	for {
+		old := atomic.LoadUint64(&h.min)
+		if v >= math.Float64frombits(old) || atomic.CompareAndSwapUint64(&h.min, old, math.Float64bits(v)) {
+			break
+		}
+	}
+	for {
+		old := atomic.LoadUint64(&h.max)
+		if v <= math.Float64frombits(old) || atomic.CompareAndSwapUint64(&h.max, old, math.Float64bits(v)) {
+			break
+		}
+	}
+}
+
+func (h *RingHistogram) Snapshot(reset bool) Snapshot {
+	h.Lock()
+	defer h.Unlock()
+
+	end := atomic.LoadUint64(&h.pos)
+	begin := h.start
+	if size := uint64(len(h.values)); end-begin > size {
+		begin = end - size
+	}
+
+	var snapshot Snapshot
+	if reset {
+		// Swap N first and nothing else if it is zero, so the counts of
+		// values being recorded are not reset and lost with an empty
+		// snapshot: they are in the next snapshot
+		if snapshot.N = atomic.SwapInt64(&h.n, 0); snapshot.N == 0 {
+			return Snapshot{} // reset then called again without any new values
+		}
+		h.start = end
+		snapshot.Sum = math.Float64frombits(atomic.SwapUint64(&h.sum, 0))
+		snapshot.SumOfSquares = math.Float64frombits(atomic.SwapUint64(&h.sumSq, 0))
+		snapshot.Min = math.Float64frombits(atomic.SwapUint64(&h.min, posInf))
+		snapshot.Max = math.Float64frombits(atomic.SwapUint64(&h.max, negInf))
+	} else {
+		if snapshot.N = atomic.LoadInt64(&h.n); snapshot.N == 0 {
+			return Snapshot{}
+		}
+		snapshot.Sum = math.Float64frombits(atomic.LoadUint64(&h.sum))
+		snapshot.SumOfSquares = math.Float64frombits(atomic.LoadUint64(&h.sumSq))
+		snapshot.Min = math.Float64frombits(atomic.LoadUint64(&h.min))
+		snapshot.Max = math.Float64frombits(atomic.LoadUint64(&h.max))
+	}
+	if begin == end {
+		// Values recorded after end was read but counted in N: return
+		// the counts so they are not lost; the values are in the next sample
+		return snapshot
+	}
+	if len(h.percentiles) == 0 {
+		snapshot.Percentile = map[float64]float64{}
+		return snapshot
+	}
+
+	values := getValues(int(end - begin))
+	for pos := begin; pos < end; pos++ {
+		values = append(values, math.Float64frombits(atomic.LoadUint64(&h.values[pos%uint64(len(h.values))])))
+	}
+	sort.Float64s(values)
+	snapshot.Percentile = percentiles(map[float64]float64{}, h.percentiles, values, len(h.values))
+	putValues(values)
+	return snapshot
+}
+
+// addFloat64 atomically adds delta to the float64 stored as bits in addr.
+func addFloat64(addr *uint64, delta float64) {
+	for {
+		old := atomic.LoadUint64(addr)
+		sum := math.Float64bits(math.Float64frombits(old) + delta)
+		if atomic.CompareAndSwapUint64(addr, old, sum) {
+			return
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package metrics
+
+import (
+	"errors"
+	"math"
+	rtmetrics "runtime/metrics"
+	"sync"
+)
+
+// --------------------------------------------------------------------------
+// RuntimeMetric
+// --------------------------------------------------------------------------
+
+// RuntimeMetric is a Metric for one runtime/metrics metric, like
+// "/sched/latencies:seconds" (scheduler latency) or
+// "/sched/goroutines:goroutines". It reads the runtime metric on Snapshot:
+//
+//   - Cumulative values, like "/gc/cycles/total:gc-cycles", are reported
+//     like a Counter: Sum is the increase since the last reset.
+//   - Other values are reported like a Gauge with one value: N = 1, and Sum,
+//     Min, Max, and Last are the value.
+//   - Histograms are reported like a Histogram of the values recorded since
+//     the last reset, computed from the runtime histogram buckets: N is exact,
+//     but Sum, Min, Max, and Config.Percentiles are estimated from bucket
+//     boundaries, so their accuracy is the bucket width.
+//
+// Only Config.Percentiles is used; other Config fields are ignored.
+type RuntimeMetric struct {
+	percentiles []float64
+	*sync.Mutex
+	sample     []rtmetrics.Sample
+	cumulative bool
+	prev       float64  // cumulative value at last reset
+	prevCounts []uint64 // histogram counts at last reset
+}
+
+// ErrUnknownRuntimeMetric is returned by NewRuntimeMetric if the name is not
+// supported by the Go runtime.
+var ErrUnknownRuntimeMetric = errors.New("metrics: unknown runtime/metrics name")
+
+// NewRuntimeMetric returns a RuntimeMetric for the runtime/metrics name, or
+// ErrUnknownRuntimeMetric if the name is not supported by the Go runtime, or
+// the error from cfg.Validate.
+// Names vary by Go version; see runtime/metrics.All. The first snapshot is
+// since the program started.
+func NewRuntimeMetric(name string, cfg Config) (*RuntimeMetric, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	for _, d := range rtmetrics.All() {
+		if d.Name != name {
+			continue
+		}
+		return &RuntimeMetric{
+			percentiles: cfg.Percentiles,
+			Mutex:       &sync.Mutex{},
+			sample:      []rtmetrics.Sample{{Name: name}},
+			cumulative:  d.Cumulative,
+		}, nil
+	}
+	return nil, ErrUnknownRuntimeMetric
+}
+
+func (m *RuntimeMetric) Snapshot(reset bool) Snapshot {
+	m.Lock()
+	defer m.Unlock()
+	rtmetrics.Read(m.sample)
+	v := m.sample[0].Value
+	switch v.Kind() {
+	case rtmetrics.KindUint64:
+		return m.scalar(float64(v.Uint64()), reset)
+	case rtmetrics.KindFloat64:
+		return m.scalar(v.Float64(), reset)
+	case rtmetrics.KindFloat64Histogram:
+		return m.histogram(v.Float64Histogram(), reset)
+	default:
+		return Snapshot{}
+	}
+}
+
+func (m *RuntimeMetric) scalar(v float64, reset bool) Snapshot {
+	if !m.cumulative {
+		return Snapshot{N: 1, Sum: v, Min: v, Max: v, Last: v}
+	}
+	snapshot := Snapshot{N: 1, Sum: v - m.prev}
+	if reset {
+		m.prev = v
+	}
+	return snapshot
+}
+
+// histogram returns a snapshot of the values in h since the last reset. Bucket
+// i is [h.Buckets[i], h.Buckets[i+1]), and the first and last boundaries can
+// be -Inf and +Inf, so the finite boundary is used for those buckets.
+func (m *RuntimeMetric) histogram(h *rtmetrics.Float64Histogram, reset bool) Snapshot {
+	if len(m.prevCounts) != len(h.Counts) {
+		m.prevCounts = make([]uint64, len(h.Counts))
+	}
+	counts := make([]uint64, len(h.Counts))
+	var n uint64
+	for i, c := range h.Counts {
+		counts[i] = c - m.prevCounts[i]
+		n += counts[i]
+	}
+	if reset {
+		copy(m.prevCounts, h.Counts)
+	}
+	if n == 0 {
+		return Snapshot{}
+	}
+
+	lower := func(i int) float64 {
+		if math.IsInf(h.Buckets[i], -1) {
+			return h.Buckets[i+1]
+		}
+		return h.Buckets[i]
+	}
+	upper := func(i int) float64 {
+		if math.IsInf(h.Buckets[i+1], 1) {
+			return h.Buckets[i]
+		}
+		return h.Buckets[i+1]
+	}
+
+	snapshot := Snapshot{
+		N:          int64(n),
+		Percentile: make(map[float64]float64, len(m.percentiles)),
+	}
+	first := true
+	for i, c := range counts {
+		if c == 0 {
+			continue
+		}
+		if first {
+			snapshot.Min = lower(i)
+			first = false
+		}
+		snapshot.Max = upper(i)
+		mid := (lower(i) + upper(i)) / 2
+		snapshot.Sum += float64(c) * mid
+		snapshot.SumOfSquares += float64(c) * mid * mid
+	}
+
+	// Nearest rank: the upper boundary of the bucket with the rank
+	for _, p := range m.percentiles {
+		rank := uint64(math.Ceil(p * float64(n)))
+		if rank < 1 {
+			rank = 1
+		}
+		var cum uint64
+		for i, c := range counts {
+			cum += c
+			if cum >= rank {
+				snapshot.Percentile[p] = upper(i)
+				break
+			}
+		}
+	}
+	return snapshot
+}
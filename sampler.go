@@ -0,0 +1,79 @@
+package metrics
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// --------------------------------------------------------------------------
+// Sampler
+// --------------------------------------------------------------------------
+
+// Sampler records the value returned by a function into a Gauge at a fixed
+// interval, like the length of a queue every 100ms. Between snapshots, the
+// gauge records many values, so its percentiles reflect the whole reporting
+// interval rather than the single moment the gauge is snapshot.
+type Sampler struct {
+	g        *Gauge
+	interval time.Duration
+	fn       func() float64
+	*sync.Mutex
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewSampler returns a Sampler that records fn into g every interval once
+// started. It panics with an error wrapping ErrInvalidConfig if interval is
+// not positive.
+func NewSampler(g *Gauge, interval time.Duration, fn func() float64) *Sampler {
+	if interval <= 0 {
+		panic(fmt.Errorf("%w: Sampler interval %v is not positive", ErrInvalidConfig, interval))
+	}
+	return &Sampler{
+		g:        g,
+		interval: interval,
+		fn:       fn,
+		Mutex:    &sync.Mutex{},
+	}
+}
+
+// Start starts sampling in a goroutine. It does nothing if already started.
+func (s *Sampler) Start() {
+	s.Lock()
+	defer s.Unlock()
+	if s.stop != nil {
+		return
+	}
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	go s.run(s.stop, s.done)
+}
+
+// Stop stops sampling and waits for the goroutine to return. It does nothing
+// if not started. The Sampler can be started again.
+func (s *Sampler) Stop() {
+	s.Lock()
+	defer s.Unlock()
+	if s.stop == nil {
+		return
+	}
+	close(s.stop)
+	<-s.done
+	s.stop = nil
+	s.done = nil
+}
+
+func (s *Sampler) run(stop, done chan struct{}) {
+	defer close(done)
+	t := time.NewTicker(s.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			s.g.Record(s.fn())
+		}
+	}
+}
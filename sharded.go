@@ -0,0 +1,98 @@
+package metrics
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// --------------------------------------------------------------------------
+// ShardedCounter
+// --------------------------------------------------------------------------
+
+const cacheLineSize = 64
+
+// shardCell is one cache line so that goroutines adding to different shards
+// do not contend on the same line (false sharing).
+type shardCell struct {
+	n   int64
+	sum int64
+	_   [cacheLineSize - 16]byte
+}
+
+// shardHints is a per-P hint for which shard to use. sync.Pool caches items
+// per P, so goroutines running on the same P usually get the same hint, and
+// goroutines on different Ps usually get different hints. It's only a hint:
+// any shard is correct.
+var (
+	shardHints = sync.Pool{
+		New: func() interface{} {
+			hint := atomic.AddUint32(&nextShardHint, 1)
+			return &hint
+		},
+	}
+	nextShardHint uint32
+)
+
+// ShardedCounter is a Counter for very high rates of Add from many goroutines.
+// Values are added to one of many cache-line padded shards, so Add scales with
+// the number of CPUs instead of contending on one memory location. Count and
+// Snapshot are slower because they sum all shards, and they are not atomic
+// with respect to concurrent Add: a value added during Snapshot can be counted
+// in either the current or the next snapshot. Use Counter unless Add is a
+// measured bottleneck.
+type ShardedCounter struct {
+	*sync.Mutex // serializes Snapshot
+	cells       []shardCell
+	mask        uint32
+}
+
+// NewShardedCounter returns a ShardedCounter with one shard per CPU
+// (GOMAXPROCS), rounded up to a power of two.
+func NewShardedCounter() *ShardedCounter {
+	n := 1
+	for n < runtime.GOMAXPROCS(0) {
+		n <<= 1
+	}
+	return &ShardedCounter{
+		Mutex: &sync.Mutex{},
+		cells: make([]shardCell, n),
+		mask:  uint32(n - 1),
+	}
+}
+
+func (c *ShardedCounter) Add(delta int64) {
+	hint := shardHints.Get().(*uint32)
+	cell := &c.cells[*hint&c.mask]
+	shardHints.Put(hint)
+	atomic.AddInt64(&cell.n, 1)
+	atomic.AddInt64(&cell.sum, delta)
+}
+
+func (c *ShardedCounter) Count() int64 {
+	var sum int64
+	for i := range c.cells {
+		sum += atomic.LoadInt64(&c.cells[i].sum)
+	}
+	return sum
+}
+
+func (c *ShardedCounter) Snapshot(reset bool) Snapshot {
+	c.Lock()
+	var n, sum int64
+	for i := range c.cells {
+		cell := &c.cells[i]
+		if reset {
+			n += atomic.SwapInt64(&cell.n, 0)
+			sum += atomic.SwapInt64(&cell.sum, 0)
+		} else {
+			n += atomic.LoadInt64(&cell.n)
+			sum += atomic.LoadInt64(&cell.sum)
+		}
+	}
+	c.Unlock()
+	return Snapshot{
+		N:   n,
+		Sum: float64(sum),
+	}
+}
@@ -0,0 +1,106 @@
+//go:build go1.21
+
+package metrics
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+)
+
+// --------------------------------------------------------------------------
+// LogCounter
+// --------------------------------------------------------------------------
+
+// LogKey identifies the records counted by a LogCounter: the logger name, if
+// any, and the record level.
+type LogKey struct {
+	Name  string
+	Level slog.Level
+}
+
+// LogCounter is a slog.Handler that counts log records by level, then passes
+// them to the next handler. This makes the error log rate a metric that can be
+// alerted on without a log pipeline. Only records enabled by the next handler
+// are counted.
+//
+// If nameKey is not empty, records are also counted by logger name: the value
+// of the nameKey attribute added with Logger.With (for example,
+// logger.With("logger", "db")). Records from loggers without a name have an
+// empty LogKey.Name.
+type LogCounter struct {
+	next    slog.Handler
+	nameKey string
+	name    string
+	counts  *logCounts // shared by all handlers derived from the same LogCounter
+}
+
+type logCounts struct {
+	*sync.Mutex
+	counters map[LogKey]*Counter
+}
+
+func NewLogCounter(next slog.Handler, nameKey string) *LogCounter {
+	return &LogCounter{
+		next:    next,
+		nameKey: nameKey,
+		counts: &logCounts{
+			Mutex:    &sync.Mutex{},
+			counters: map[LogKey]*Counter{},
+		},
+	}
+}
+
+// Counter returns the counter for the logger name and level. The counter is
+// created if it does not exist, so it can be reported before any records are
+// logged.
+func (h *LogCounter) Counter(name string, level slog.Level) *Counter {
+	k := LogKey{Name: name, Level: level}
+	h.counts.Lock()
+	c, ok := h.counts.counters[k]
+	if !ok {
+		c = NewCounter()
+		h.counts.counters[k] = c
+	}
+	h.counts.Unlock()
+	return c
+}
+
+// Counters returns a copy of all counters by logger name and level.
+func (h *LogCounter) Counters() map[LogKey]*Counter {
+	h.counts.Lock()
+	counters := make(map[LogKey]*Counter, len(h.counts.counters))
+	for k, c := range h.counts.counters {
+		counters[k] = c
+	}
+	h.counts.Unlock()
+	return counters
+}
+
+func (h *LogCounter) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *LogCounter) Handle(ctx context.Context, r slog.Record) error {
+	h.Counter(h.name, r.Level).Add(1)
+	return h.next.Handle(ctx, r)
+}
+
+func (h *LogCounter) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.next = h.next.WithAttrs(attrs)
+	if h.nameKey != "" {
+		for _, a := range attrs {
+			if a.Key == h.nameKey {
+				h2.name = a.Value.String()
+			}
+		}
+	}
+	return &h2
+}
+
+func (h *LogCounter) WithGroup(name string) slog.Handler {
+	h2 := *h
+	h2.next = h.next.WithGroup(name)
+	return &h2
+}
@@ -0,0 +1,50 @@
+//go:build go1.21
+
+package metrics_test
+
+import (
+	"bytes"
+	"log/slog"
+	"testing"
+
+	"github.com/daniel-nichter/go-metrics"
+)
+
+func TestLogCounter(t *testing.T) {
+	var buf bytes.Buffer
+	h := metrics.NewLogCounter(slog.NewTextHandler(&buf, nil), "logger")
+	logger := slog.New(h)
+	logger.Debug("not enabled") // text handler default level is Info
+	logger.Info("one")
+	logger.Error("two")
+	logger.Error("three")
+	db := logger.With("logger", "db")
+	db.Error("four")
+	db.WithGroup("g").Warn("five")
+
+	expect := map[metrics.LogKey]int64{
+		{Name: "", Level: slog.LevelInfo}:    1,
+		{Name: "", Level: slog.LevelError}:   2,
+		{Name: "db", Level: slog.LevelError}: 1,
+		{Name: "db", Level: slog.LevelWarn}:  1,
+	}
+	counters := h.Counters()
+	if len(counters) != len(expect) {
+		t.Errorf("got %d counters, expected %d: %v", len(counters), len(expect), counters)
+	}
+	for k, n := range expect {
+		c, ok := counters[k]
+		if !ok {
+			t.Errorf("no counter for %+v", k)
+			continue
+		}
+		if c.Count() != n {
+			t.Errorf("%+v count %d, expected %d", k, c.Count(), n)
+		}
+	}
+
+	// Records are passed to next handler
+	if n := bytes.Count(buf.Bytes(), []byte("\n")); n != 5 {
+		t.Errorf("next handler logged %d records, expected 5", n)
+	}
+}
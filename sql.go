@@ -0,0 +1,459 @@
+package metrics
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// --------------------------------------------------------------------------
+// SQLMetrics
+// --------------------------------------------------------------------------
+
+// SQL operations for SQLMetrics.
+const (
+	SQLQuery    = "query"
+	SQLExec     = "exec"
+	SQLPrepare  = "prepare"
+	SQLBegin    = "begin"
+	SQLCommit   = "commit"
+	SQLRollback = "rollback"
+)
+
+// SQLKey identifies the metrics of a SQL operation, like SQLQuery, and the
+// query name returned by the query name function, if any.
+type SQLKey struct {
+	Op   string
+	Name string
+}
+
+// SQLMetrics records the latency, in seconds, and errors of database/sql
+// driver operations: queries, execs, prepares, and transactions. It
+// complements sql.DBStats, which has only connection pool stats. Wrap a driver
+// with Driver and register the wrapped driver with sql.Register, or wrap a
+// driver.Connector with Connector and open it with sql.OpenDB.
+//
+// Query latency is the time until the driver returns the rows, not the time to
+// read them. If the driver does not support queries or execs without a
+// prepared statement, database/sql prepares one, so the prepare is recorded
+// too.
+type SQLMetrics struct {
+	cfg  Config
+	name func(query string) string
+	*sync.Mutex
+	latency map[SQLKey]*Histogram
+	errors  map[SQLKey]*Counter
+}
+
+// NewSQLMetrics returns a SQLMetrics with latency histograms configured by cfg.
+// If name is not nil, query, exec, and prepare metrics are also keyed by the
+// name it returns for the query, like "get_user" from a "-- name: get_user"
+// comment. The name must have low cardinality: never return the query itself.
+func NewSQLMetrics(cfg Config, name func(query string) string) *SQLMetrics {
+	return &SQLMetrics{
+		cfg:     cfg,
+		name:    name,
+		Mutex:   &sync.Mutex{},
+		latency: map[SQLKey]*Histogram{},
+		errors:  map[SQLKey]*Counter{},
+	}
+}
+
+// Latency returns the latency histogram for the key. The histogram is created
+// if it does not exist, so it can be reported before any operations.
+func (m *SQLMetrics) Latency(k SQLKey) *Histogram {
+	m.Lock()
+	h, ok := m.latency[k]
+	if !ok {
+		h = NewHistogram(m.cfg)
+		m.latency[k] = h
+	}
+	m.Unlock()
+	return h
+}
+
+// Errors returns the error counter for the key. The counter is created if it
+// does not exist, so it can be reported before any operations.
+func (m *SQLMetrics) Errors(k SQLKey) *Counter {
+	m.Lock()
+	c, ok := m.errors[k]
+	if !ok {
+		c = NewCounter()
+		m.errors[k] = c
+	}
+	m.Unlock()
+	return c
+}
+
+// Keys returns the keys of all metrics.
+func (m *SQLMetrics) Keys() []SQLKey {
+	m.Lock()
+	keys := make([]SQLKey, 0, len(m.latency))
+	for k := range m.latency {
+		keys = append(keys, k)
+	}
+	m.Unlock()
+	return keys
+}
+
+// record records an operation. driver.ErrSkip is not recorded because it is
+// not an error: it makes database/sql use another method, which is recorded.
+func (m *SQLMetrics) record(op, query string, t0 time.Time, err error) {
+	if err == driver.ErrSkip {
+		return
+	}
+	k := SQLKey{Op: op}
+	if m.name != nil && query != "" {
+		k.Name = m.name(query)
+	}
+	m.Latency(k).Record(time.Since(t0).Seconds())
+	if err != nil {
+		m.Errors(k).Add(1)
+	}
+}
+
+// Driver returns d wrapped to record the metrics. The wrapped driver is a
+// driver.DriverContext, so its connections are wrapped whether or not d uses
+// connectors.
+func (m *SQLMetrics) Driver(d driver.Driver) driver.Driver {
+	return &sqlDriver{d: d, m: m}
+}
+
+// Connector returns c wrapped to record the metrics, for sql.OpenDB.
+func (m *SQLMetrics) Connector(c driver.Connector) driver.Connector {
+	return &sqlConnector{c: c, d: &sqlDriver{d: c.Driver(), m: m}}
+}
+
+type sqlDriver struct {
+	d driver.Driver
+	m *SQLMetrics
+}
+
+func (d *sqlDriver) Open(name string) (driver.Conn, error) {
+	c, err := d.d.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &sqlConn{c: c, m: d.m}, nil
+}
+
+// OpenConnector returns the connector of the wrapped driver, wrapped, or a
+// connector that calls Open with name, like database/sql does for a driver
+// that is not a driver.DriverContext.
+func (d *sqlDriver) OpenConnector(name string) (driver.Connector, error) {
+	dc, ok := d.d.(driver.DriverContext)
+	if !ok {
+		return &sqlConnector{c: sqlDSNConnector{name: name, d: d.d}, d: d}, nil
+	}
+	c, err := dc.OpenConnector(name)
+	if err != nil {
+		return nil, err
+	}
+	return &sqlConnector{c: c, d: d}, nil
+}
+
+type sqlConnector struct {
+	c driver.Connector
+	d *sqlDriver
+}
+
+func (c *sqlConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.c.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &sqlConn{c: conn, m: c.d.m}, nil
+}
+
+func (c *sqlConnector) Driver() driver.Driver {
+	return c.d
+}
+
+// Close closes the wrapped connector if it is an io.Closer, which sql.DB.Close
+// does for connectors.
+func (c *sqlConnector) Close() error {
+	if cl, ok := c.c.(io.Closer); ok {
+		return cl.Close()
+	}
+	return nil
+}
+
+// sqlDSNConnector is the connector of a driver that is not a
+// driver.DriverContext.
+type sqlDSNConnector struct {
+	name string
+	d    driver.Driver
+}
+
+func (c sqlDSNConnector) Connect(context.Context) (driver.Conn, error) {
+	return c.d.Open(c.name)
+}
+
+func (c sqlDSNConnector) Driver() driver.Driver {
+	return c.d
+}
+
+// sqlConn implements the optional driver.Conn interfaces, falling back to what
+// database/sql does if the wrapped connection does not implement them.
+type sqlConn struct {
+	c driver.Conn
+	m *SQLMetrics
+}
+
+func (c *sqlConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *sqlConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	t0 := time.Now()
+	var s driver.Stmt
+	var err error
+	if pc, ok := c.c.(driver.ConnPrepareContext); ok {
+		s, err = pc.PrepareContext(ctx, query)
+	} else {
+		s, err = c.c.Prepare(query)
+	}
+	c.m.record(SQLPrepare, query, t0, err)
+	if err != nil {
+		return nil, err
+	}
+	stmt := &sqlStmt{s: s, c: c, m: c.m, query: query}
+	if _, ok := s.(driver.ColumnConverter); ok {
+		return sqlConverterStmt{stmt}, nil
+	}
+	return stmt, nil
+}
+
+func (c *sqlConn) Close() error {
+	return c.c.Close()
+}
+
+func (c *sqlConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *sqlConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	t0 := time.Now()
+	var tx driver.Tx
+	var err error
+	if bc, ok := c.c.(driver.ConnBeginTx); ok {
+		tx, err = bc.BeginTx(ctx, opts)
+	} else if opts.Isolation != driver.IsolationLevel(0) || opts.ReadOnly {
+		err = errors.New("metrics: driver does not support transaction options")
+	} else {
+		tx, err = c.c.Begin()
+	}
+	c.m.record(SQLBegin, "", t0, err)
+	if err != nil {
+		return nil, err
+	}
+	return &sqlTx{tx: tx, m: c.m}, nil
+}
+
+// ExecContext uses the driver.ExecerContext or, like database/sql, the
+// driver.Execer of the connection. If it has neither, database/sql prepares a
+// statement.
+func (c *sqlConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	var res driver.Result
+	var err error
+	var t0 time.Time
+	switch ec := c.c.(type) {
+	case driver.ExecerContext:
+		t0 = time.Now()
+		res, err = ec.ExecContext(ctx, query, args)
+	case driver.Execer:
+		var values []driver.Value
+		if values, err = legacyArgs(ctx, args); err != nil {
+			return nil, err
+		}
+		t0 = time.Now()
+		res, err = ec.Exec(query, values)
+	default:
+		return nil, driver.ErrSkip
+	}
+	c.m.record(SQLExec, query, t0, err)
+	return res, err
+}
+
+// QueryContext uses the driver.QueryerContext or driver.Queryer of the
+// connection, like ExecContext.
+func (c *sqlConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	var rows driver.Rows
+	var err error
+	var t0 time.Time
+	switch qc := c.c.(type) {
+	case driver.QueryerContext:
+		t0 = time.Now()
+		rows, err = qc.QueryContext(ctx, query, args)
+	case driver.Queryer:
+		var values []driver.Value
+		if values, err = legacyArgs(ctx, args); err != nil {
+			return nil, err
+		}
+		t0 = time.Now()
+		rows, err = qc.Query(query, values)
+	default:
+		return nil, driver.ErrSkip
+	}
+	c.m.record(SQLQuery, query, t0, err)
+	return rows, err
+}
+
+// legacyArgs returns the args for a driver method without a context, or the
+// context error if it is done, like database/sql does.
+func legacyArgs(ctx context.Context, args []driver.NamedValue) ([]driver.Value, error) {
+	values, err := namedValues(args)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+	return values, nil
+}
+
+func (c *sqlConn) Ping(ctx context.Context) error {
+	if p, ok := c.c.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *sqlConn) ResetSession(ctx context.Context) error {
+	if r, ok := c.c.(driver.SessionResetter); ok {
+		return r.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *sqlConn) IsValid() bool {
+	if v, ok := c.c.(driver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
+
+func (c *sqlConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if nc, ok := c.c.(driver.NamedValueChecker); ok {
+		return nc.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip // database/sql default conversion
+}
+
+type sqlStmt struct {
+	s     driver.Stmt
+	c     *sqlConn
+	m     *SQLMetrics
+	query string
+}
+
+// CheckNamedValue uses the statement NamedValueChecker, if any, else the
+// connection one, because database/sql does not check the connection if the
+// statement is a NamedValueChecker.
+func (s *sqlStmt) CheckNamedValue(nv *driver.NamedValue) error {
+	if nc, ok := s.s.(driver.NamedValueChecker); ok {
+		return nc.CheckNamedValue(nv)
+	}
+	return s.c.CheckNamedValue(nv)
+}
+
+// sqlConverterStmt is a sqlStmt of a statement that is a
+// driver.ColumnConverter. It is a separate type because database/sql does not
+// use its default conversion for a ColumnConverter, so sqlStmt cannot
+// implement it for statements that do not.
+type sqlConverterStmt struct {
+	*sqlStmt
+}
+
+func (s sqlConverterStmt) ColumnConverter(idx int) driver.ValueConverter {
+	return s.s.(driver.ColumnConverter).ColumnConverter(idx)
+}
+
+func (s *sqlStmt) Close() error {
+	return s.s.Close()
+}
+
+func (s *sqlStmt) NumInput() int {
+	return s.s.NumInput()
+}
+
+func (s *sqlStmt) Exec(args []driver.Value) (driver.Result, error) {
+	t0 := time.Now()
+	res, err := s.s.Exec(args)
+	s.m.record(SQLExec, s.query, t0, err)
+	return res, err
+}
+
+func (s *sqlStmt) Query(args []driver.Value) (driver.Rows, error) {
+	t0 := time.Now()
+	rows, err := s.s.Query(args)
+	s.m.record(SQLQuery, s.query, t0, err)
+	return rows, err
+}
+
+func (s *sqlStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	sc, ok := s.s.(driver.StmtExecContext)
+	if !ok {
+		values, err := namedValues(args)
+		if err != nil {
+			return nil, err
+		}
+		return s.Exec(values)
+	}
+	t0 := time.Now()
+	res, err := sc.ExecContext(ctx, args)
+	s.m.record(SQLExec, s.query, t0, err)
+	return res, err
+}
+
+func (s *sqlStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	sc, ok := s.s.(driver.StmtQueryContext)
+	if !ok {
+		values, err := namedValues(args)
+		if err != nil {
+			return nil, err
+		}
+		return s.Query(values)
+	}
+	t0 := time.Now()
+	rows, err := sc.QueryContext(ctx, args)
+	s.m.record(SQLQuery, s.query, t0, err)
+	return rows, err
+}
+
+// namedValues converts args for a driver that does not support named values,
+// like database/sql does.
+func namedValues(args []driver.NamedValue) ([]driver.Value, error) {
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		if arg.Name != "" {
+			return nil, errors.New("metrics: driver does not support named values")
+		}
+		values[i] = arg.Value
+	}
+	return values, nil
+}
+
+type sqlTx struct {
+	tx driver.Tx
+	m  *SQLMetrics
+}
+
+func (tx *sqlTx) Commit() error {
+	t0 := time.Now()
+	err := tx.tx.Commit()
+	tx.m.record(SQLCommit, "", t0, err)
+	return err
+}
+
+func (tx *sqlTx) Rollback() error {
+	t0 := time.Now()
+	err := tx.tx.Rollback()
+	tx.m.record(SQLRollback, "", t0, err)
+	return err
+}
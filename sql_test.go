@@ -0,0 +1,223 @@
+package metrics_test
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/daniel-nichter/go-metrics"
+	"github.com/go-test/deep"
+)
+
+// fakeDriver is a minimal driver without any optional interfaces. Queries
+// that contain "fail" return an error.
+type fakeDriver struct{}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) { return fakeConn{}, nil }
+
+type fakeConn struct{}
+
+func (fakeConn) Prepare(query string) (driver.Stmt, error) { return fakeStmt{query: query}, nil }
+func (fakeConn) Close() error                              { return nil }
+func (fakeConn) Begin() (driver.Tx, error)                 { return fakeTx{}, nil }
+
+type fakeStmt struct{ query string }
+
+func (fakeStmt) Close() error  { return nil }
+func (fakeStmt) NumInput() int { return -1 }
+
+func (s fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if strings.Contains(s.query, "fail") {
+		return nil, errors.New("exec failed")
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (s fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	if strings.Contains(s.query, "fail") {
+		return nil, errors.New("query failed")
+	}
+	return &fakeRows{}, nil
+}
+
+type fakeRows struct{ n int }
+
+func (*fakeRows) Columns() []string { return []string{"n"} }
+func (*fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.n > 0 {
+		return io.EOF
+	}
+	r.n++
+	dest[0] = int64(1)
+	return nil
+}
+
+// fakeConnector opens the driver without registering it, which panics if
+// done twice, like with go test -count=2.
+type fakeConnector struct{ d driver.Driver }
+
+func (c fakeConnector) Connect(context.Context) (driver.Conn, error) { return c.d.Open("") }
+func (c fakeConnector) Driver() driver.Driver                        { return c.d }
+
+// convertDriver has statements that convert args with a ColumnConverter and
+// reject the arg "reject" with a NamedValueChecker. Exec saves the args.
+type convertDriver struct{ args *[]driver.Value }
+
+func (d convertDriver) Open(name string) (driver.Conn, error) { return convertConn{d.args}, nil }
+
+type convertConn struct{ args *[]driver.Value }
+
+func (c convertConn) Prepare(query string) (driver.Stmt, error) { return convertStmt{c.args}, nil }
+func (convertConn) Close() error                                { return nil }
+func (convertConn) Begin() (driver.Tx, error)                   { return fakeTx{}, nil }
+
+type convertStmt struct{ args *[]driver.Value }
+
+func (convertStmt) Close() error  { return nil }
+func (convertStmt) NumInput() int { return 1 }
+
+func (s convertStmt) Exec(args []driver.Value) (driver.Result, error) {
+	*s.args = args
+	return driver.RowsAffected(1), nil
+}
+
+func (convertStmt) Query(args []driver.Value) (driver.Rows, error) { return &fakeRows{}, nil }
+
+func (convertStmt) ColumnConverter(idx int) driver.ValueConverter { return driver.Int32 }
+
+func (convertStmt) CheckNamedValue(nv *driver.NamedValue) error {
+	if nv.Value == "reject" {
+		return errors.New("rejected")
+	}
+	return driver.ErrSkip
+}
+
+// legacyDriver has connections with the deprecated driver.Execer and
+// driver.Queryer, so database/sql does not prepare statements.
+type legacyDriver struct{}
+
+func (legacyDriver) Open(name string) (driver.Conn, error) { return legacyConn{}, nil }
+
+type legacyConn struct{ fakeConn }
+
+func (legacyConn) Exec(query string, args []driver.Value) (driver.Result, error) {
+	return fakeStmt{query: query}.Exec(args)
+}
+
+func (legacyConn) Query(query string, args []driver.Value) (driver.Rows, error) {
+	return fakeStmt{query: query}.Query(args)
+}
+
+type fakeTx struct{}
+
+func (fakeTx) Commit() error   { return nil }
+func (fakeTx) Rollback() error { return nil }
+
+func TestSQLMetrics(t *testing.T) {
+	// Name from a "-- name: x" comment
+	m := metrics.NewSQLMetrics(metrics.Config{}, func(query string) string {
+		if i := strings.Index(query, "-- name: "); i >= 0 {
+			return strings.Fields(query[i+9:])[0]
+		}
+		return ""
+	})
+	db := sql.OpenDB(fakeConnector{m.Driver(fakeDriver{})})
+	defer db.Close()
+
+	var n int
+	if err := db.QueryRow("SELECT 1 -- name: one").Scan(&n); err != nil || n != 1 {
+		t.Fatalf("got %d, %v; expected 1, nil", n, err)
+	}
+	if _, err := db.Exec("UPDATE t SET fail=1 -- name: update"); err == nil {
+		t.Error("Exec: no error, expected error")
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[metrics.SQLKey][2]int64{}
+	for _, k := range m.Keys() {
+		got[k] = [2]int64{m.Latency(k).Snapshot(true).N, m.Errors(k).Count()}
+	}
+	expect := map[metrics.SQLKey][2]int64{
+		{Op: metrics.SQLPrepare, Name: "one"}:    {1, 0},
+		{Op: metrics.SQLQuery, Name: "one"}:      {1, 0},
+		{Op: metrics.SQLPrepare, Name: "update"}: {1, 0},
+		{Op: metrics.SQLExec, Name: "update"}:    {1, 1},
+		{Op: metrics.SQLBegin}:                   {1, 0},
+		{Op: metrics.SQLCommit}:                  {1, 0},
+	}
+	for k, v := range expect {
+		if got[k] != v {
+			t.Errorf("%+v: got N, errors %v, expected %v", k, got[k], v)
+		}
+	}
+	if len(got) != len(expect) {
+		t.Errorf("got %d keys, expected %d: %v", len(got), len(expect), got)
+	}
+}
+
+func TestSQLMetricsStmtConverters(t *testing.T) {
+	// The statement ColumnConverter and NamedValueChecker are used
+	var args []driver.Value
+	m := metrics.NewSQLMetrics(metrics.Config{}, nil)
+	db := sql.OpenDB(fakeConnector{m.Driver(convertDriver{&args})})
+	defer db.Close()
+
+	if _, err := db.Exec("UPDATE t SET n=?", "7"); err != nil {
+		t.Fatal(err)
+	}
+	if len(args) != 1 || args[0] != int64(7) {
+		t.Errorf("got args %#v, expected int64(7) from driver.Int32", args)
+	}
+	if _, err := db.Exec("UPDATE t SET n=?", "reject"); err == nil || !strings.Contains(err.Error(), "rejected") {
+		t.Errorf("got error %v, expected rejected", err)
+	}
+}
+
+func TestSQLMetricsLegacyConnector(t *testing.T) {
+	// Exec and Query use the connection Execer and Queryer, without
+	// preparing, through a wrapped Connector and a wrapped DriverContext
+	m := metrics.NewSQLMetrics(metrics.Config{}, nil)
+	dc, ok := m.Driver(legacyDriver{}).(driver.DriverContext)
+	if !ok {
+		t.Fatal("wrapped driver is not a driver.DriverContext")
+	}
+	c, err := dc.OpenConnector("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []driver.Connector{m.Connector(fakeConnector{legacyDriver{}}), c} {
+		db := sql.OpenDB(c)
+		var n int
+		if err := db.QueryRow("SELECT 1").Scan(&n); err != nil || n != 1 {
+			t.Fatalf("got %d, %v; expected 1, nil", n, err)
+		}
+		if _, err := db.Exec("UPDATE t SET fail=1"); err == nil {
+			t.Error("Exec: no error, expected error")
+		}
+		db.Close()
+	}
+
+	got := map[metrics.SQLKey][2]int64{}
+	for _, k := range m.Keys() {
+		got[k] = [2]int64{m.Latency(k).Snapshot(true).N, m.Errors(k).Count()}
+	}
+	expect := map[metrics.SQLKey][2]int64{
+		{Op: metrics.SQLQuery}: {2, 0},
+		{Op: metrics.SQLExec}:  {2, 2},
+	}
+	if diff := deep.Equal(got, expect); diff != nil {
+		t.Error(diff)
+	}
+}
@@ -0,0 +1,102 @@
+package metrics
+
+import (
+	"sync"
+)
+
+// --------------------------------------------------------------------------
+// Status
+// --------------------------------------------------------------------------
+
+// Default Status states. Their values are 0, 1, and 2.
+const (
+	StatusOK       = "ok"
+	StatusDegraded = "degraded"
+	StatusDown     = "down"
+)
+
+// Status is the current state of a component, like "ok" or "down", from an
+// enumerated set of states. Each state has a value, its index in the set, so
+// it can be reported as one gauge (Snapshot) or as one 0/1 gauge per state
+// (StateValues), which is how Kubernetes-style dashboards show health.
+type Status struct {
+	*sync.Mutex
+	states []string
+	state  int
+}
+
+// NewStatus returns a Status with the default states StatusOK, StatusDegraded,
+// and StatusDown followed by states, in order. The initial state is StatusOK.
+// Duplicate states are ignored.
+func NewStatus(states ...string) *Status {
+	s := &Status{
+		Mutex:  &sync.Mutex{},
+		states: []string{StatusOK, StatusDegraded, StatusDown},
+	}
+	for _, state := range states {
+		if s.index(state) < 0 {
+			s.states = append(s.states, state)
+		}
+	}
+	return s
+}
+
+// Set sets the current state. It returns ErrUnknownStatus, and the state does
+// not change, if state is not one of the states.
+func (s *Status) Set(state string) error {
+	i := s.index(state)
+	if i < 0 {
+		return ErrUnknownStatus
+	}
+	s.Lock()
+	s.state = i
+	s.Unlock()
+	return nil
+}
+
+// State returns the current state.
+func (s *Status) State() string {
+	s.Lock()
+	defer s.Unlock()
+	return s.states[s.state]
+}
+
+// States returns a copy of the states in order of their values.
+func (s *Status) States() []string {
+	return append([]string(nil), s.states...)
+}
+
+// StateValues returns every state with value 1 for the current state and 0
+// for the others, to report one gauge per state labeled with the state.
+func (s *Status) StateValues() map[string]float64 {
+	s.Lock()
+	defer s.Unlock()
+	values := make(map[string]float64, len(s.states))
+	for i, state := range s.states {
+		values[state] = 0
+		if i == s.state {
+			values[state] = 1
+		}
+	}
+	return values
+}
+
+// Snapshot returns the value of the current state as N = 1 and Sum and Last
+// equal to the value. Reset does nothing because the state is not a count.
+func (s *Status) Snapshot(reset bool) Snapshot {
+	s.Lock()
+	v := float64(s.state)
+	s.Unlock()
+	return Snapshot{N: 1, Sum: v, Last: v}
+}
+
+// index returns the value of state, or -1 if it is not one of the states.
+// states is not changed after NewStatus, so it does not need the lock.
+func (s *Status) index(state string) int {
+	for i, st := range s.states {
+		if st == state {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,99 @@
+package metrics
+
+import (
+	"sort"
+)
+
+// --------------------------------------------------------------------------
+// View
+// --------------------------------------------------------------------------
+
+// View is a read-only view of a Gauge or Histogram at one point in time, like
+// a snapshot without reset. Instead of a map of the configured percentiles, it
+// has a sorted copy of the sample, so Percentile can return any percentile.
+// Creating a View allocates and copies the whole sample (up to SampleSize
+// values, or the sketch), but Percentile does not allocate, so use it for
+// programs that query many percentiles of the same view, like a load balancer
+// or admission controller. A View is safe for use by multiple goroutines.
+type View struct {
+	snapshot Snapshot // without percentiles
+	q        quantiles
+}
+
+// quantiles is a copy of a sample returned by sample.quantiles. sort is called
+// once, without the metric lock, before quantile.
+type quantiles interface {
+	sort()
+	quantile(p float64) float64
+}
+
+// View returns a view of the gauge. It copies the sample while the gauge is
+// locked, then sorts the copy.
+func (g *Gauge) View() View {
+	var q quantiles
+	snapshot := g.snapshot(false, true, func() { q = g.resv.quantiles() })
+	q.sort()
+	return View{snapshot: snapshot, q: q}
+}
+
+// View returns a view of the histogram, like Gauge.View.
+func (h *Histogram) View() View {
+	var q quantiles
+	snapshot := h.snapshot(false, true, func() { q = h.resv.quantiles() })
+	q.sort()
+	return View{snapshot: snapshot, q: q}
+}
+
+// N returns Snapshot.N.
+func (v View) N() int64 { return v.snapshot.N }
+
+// Sum returns Snapshot.Sum.
+func (v View) Sum() float64 { return v.snapshot.Sum }
+
+// Min returns Snapshot.Min.
+func (v View) Min() float64 { return v.snapshot.Min }
+
+// Max returns Snapshot.Max.
+func (v View) Max() float64 { return v.snapshot.Max }
+
+// Last returns Snapshot.Last.
+func (v View) Last() float64 { return v.snapshot.Last }
+
+// Mean returns Sum / N, or zero if N is zero.
+func (v View) Mean() float64 {
+	if v.snapshot.N == 0 {
+		return 0
+	}
+	return v.snapshot.Sum / float64(v.snapshot.N)
+}
+
+// Percentile returns percentile p (0.99 for P99) calculated like the
+// Snapshot percentiles, but p does not have to be one of Config.Percentiles.
+// With the CKMS estimator, only Config.Percentiles are within their target
+// errors. p is clamped between 0 and 1, and NaN is 0. It returns zero if there
+// are no values.
+func (v View) Percentile(p float64) float64 {
+	if !(p >= 0) { // true for NaN
+		p = 0
+	} else if p > 1 {
+		p = 1
+	}
+	return v.q.quantile(p)
+}
+
+// sortedValues is a copy of a randomSample.
+type sortedValues struct {
+	values     []float64
+	sampleSize int
+}
+
+func (q *sortedValues) sort() {
+	sort.Float64s(q.values)
+}
+
+func (q *sortedValues) quantile(p float64) float64 {
+	if len(q.values) == 0 {
+		return 0
+	}
+	return percentile(p, q.values, q.sampleSize)
+}